@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/DexterLB/traytor/hdrimage"
+	"github.com/DexterLB/traytor/rpc"
+)
+
+const (
+	// defaultBatchTime is how long each request to a worker should take
+	defaultBatchTime = 2 * time.Second
+	// speedSmoothing is the weight of the latest request in the measured
+	// time per sample of a worker
+	speedSmoothing = 0.3
+)
+
+// batch is a number of samples which are being rendered on a worker
+type batch struct {
+	job        string // ID by which the batch's requests can be cancelled
+	worker     *worker
+	duplicate  *worker // the worker which renders the samples again (if any)
+	samples    rpc.SampleRange
+	started    time.Time
+	attempts   int  // requests which are rendering the samples
+	duplicated bool // the samples are also rendered on another worker
+	received   bool
+	done       chan struct{} // closed when the samples are received
+}
+
+// measure updates the worker's average time per sample with a request which
+// rendered the given samples. The mutex must be held.
+func (w *worker) measure(samples int, elapsed time.Duration) {
+	perSample := elapsed / time.Duration(samples)
+	if w.sampleTime == 0 {
+		w.sampleTime = perSample
+		return
+	}
+	w.sampleTime = time.Duration(
+		float64(w.sampleTime)*(1-speedSmoothing) + float64(perSample)*speedSmoothing,
+	)
+}
+
+// speed returns the measured time per sample of the worker's requests
+// (0 if none of them have finished yet)
+func (w *worker) speed() time.Duration {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.sampleTime
+}
+
+// batchSize returns the samples to request from the worker at once, so that
+// each request takes about batchTime. It's the number of samples the worker
+// asks for if batchTime is 0 or the worker's speed isn't measured yet.
+func (w *worker) batchSize(batchTime time.Duration) int {
+	sampleTime := w.speed()
+	if batchTime <= 0 || sampleTime <= 0 {
+		return w.samples
+	}
+	samples := int(batchTime / sampleTime)
+	if samples < 1 {
+		return 1
+	}
+	// the worker refuses larger requests, which would also take too long
+	// if its speed is misjudged
+	if samples > rpc.MaxBatchGrowth*w.samples {
+		return rpc.MaxBatchGrowth * w.samples
+	}
+	return samples
+}
+
+// outstanding returns the number of requests to keep running on the worker.
+// When balancing, requests which would only wait in the worker's queue
+// aren't sent, so that their samples can go to other workers: one request
+// more than the worker's threads keeps all of them busy.
+func (w *worker) outstanding(balanced bool) int {
+	if balanced && w.threads > 0 && w.threads+1 < w.requests {
+		return w.threads + 1
+	}
+	return w.requests
+}
+
+// begin registers a batch of samples which the worker starts rendering
+func (pass *renderPass) begin(w *worker, samples rpc.SampleRange) *batch {
+	pass.batchMutex.Lock()
+	defer pass.batchMutex.Unlock()
+	pass.batchCount++
+	b := &batch{
+		job:      fmt.Sprintf("%s/%d", pass.job, pass.batchCount),
+		worker:   w,
+		samples:  samples,
+		started:  time.Now(),
+		attempts: 1,
+		done:     make(chan struct{}),
+	}
+	if pass.batches == nil {
+		pass.batches = make(map[*batch]struct{})
+	}
+	pass.batches[b] = struct{}{}
+	return b
+}
+
+// straggler finds the batch on another worker which is expected to finish
+// last, if the given worker would finish rendering it sooner, and marks it
+// as duplicated. Batches on workers whose speed isn't measured yet are
+// expected to be late. It returns nil if there's no such batch.
+func (pass *renderPass) straggler(w *worker) *batch {
+	sampleTime := w.speed()
+	if sampleTime <= 0 {
+		return nil
+	}
+	now := time.Now()
+
+	pass.batchMutex.Lock()
+	defer pass.batchMutex.Unlock()
+
+	var latest *batch
+	var latestFinish time.Time
+	for b := range pass.batches {
+		if b.worker == w || b.duplicated {
+			continue
+		}
+		finish := now.Add(maxRetryDelay)
+		if otherTime := b.worker.speed(); otherTime > 0 {
+			finish = b.started.Add(otherTime * time.Duration(b.samples.Count))
+		}
+		if !now.Add(sampleTime * time.Duration(b.samples.Count)).Before(finish) {
+			continue
+		}
+		if latest == nil || finish.After(latestFinish) {
+			latest, latestFinish = b, finish
+		}
+	}
+	if latest != nil {
+		latest.duplicate = w
+		latest.duplicated = true
+		latest.attempts++
+	}
+	return latest
+}
+
+// sampleBatch renders the batch's samples on the worker. A synchronous
+// request is abandoned once the samples have been received from another
+// worker (and its image is thrown away when it arrives). If the request
+// fails, its error is returned, and the samples are given back to the
+// counter unless another worker is still rendering them, or the worker may
+// have stored them anyway.
+func (pass *renderPass) sampleBatch(
+	b *batch,
+	w *worker,
+	settings *rpc.SampleSettings,
+	synchronous bool,
+) error {
+	type result struct {
+		image *hdrimage.Image
+		err   error
+	}
+	results := make(chan result, 1)
+	requestSettings := *settings
+	requestSettings.SamplesAtOnce = b.samples.Count
+	requestSettings.FirstSample = b.samples.First
+	requestSettings.Job = b.job
+	go func() {
+		image, err := w.sample(&requestSettings, synchronous)
+		results <- result{image, err}
+	}()
+
+	select {
+	case <-b.done:
+		return nil
+	case r := <-results:
+		if r.err != nil {
+			if !synchronous && w.storeFailed(&requestSettings, r.err) {
+				pass.abandon(b)
+			} else {
+				pass.failed(b)
+			}
+			return r.err
+		}
+		pass.receive(b, w, r.image, synchronous)
+		return nil
+	}
+}
+
+// receive records that the batch's samples have been rendered by the
+// worker, sending the image to the pass's rendered images (unless the
+// samples have already been received from another worker). The request of
+// the other worker which renders the same samples is cancelled.
+func (pass *renderPass) receive(b *batch, w *worker, image *hdrimage.Image, synchronous bool) {
+	pass.batchMutex.Lock()
+	first := !b.received
+	if first {
+		b.received = true
+		delete(pass.batches, b)
+		close(b.done)
+	}
+	other := b.duplicate
+	if other == w {
+		other = b.worker
+	}
+	pass.batchMutex.Unlock()
+	if !first {
+		return
+	}
+	if other != nil {
+		go other.cancel(b.job)
+	}
+
+	if synchronous {
+		w.contribute(b.samples.Count)
+		pass.renderedImages <- image
+	}
+	if pass.bar != nil {
+		pass.bar.Add(b.samples.Count)
+	}
+}
+
+// stopped returns true if the render has been stopped
+func (pass *renderPass) stopped() bool {
+	if pass.stop == nil {
+		return false
+	}
+	select {
+	case <-pass.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// abandon drops a batch whose request has failed without giving its samples
+// back: they're given back once they turn out not to be stored on the worker
+func (pass *renderPass) abandon(b *batch) {
+	pass.batchMutex.Lock()
+	defer pass.batchMutex.Unlock()
+	delete(pass.batches, b)
+}
+
+// failed records a failed request for the batch, giving its samples back to
+// the counter if no other request is rendering them
+func (pass *renderPass) failed(b *batch) {
+	pass.batchMutex.Lock()
+	defer pass.batchMutex.Unlock()
+	b.attempts--
+	if b.attempts == 0 && !b.received {
+		delete(pass.batches, b)
+		pass.sampleCounter.Inc(b.samples)
+	}
+}
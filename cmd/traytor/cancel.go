@@ -0,0 +1,45 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// newJobID returns a random ID for the requests of a render, by which they
+// can be cancelled
+func newJobID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		log.Printf("can't generate a job ID: %s", err)
+	}
+	return hex.EncodeToString(id)
+}
+
+// cancel cancels the worker's requests of the job (workers which can't
+// cancel requests finish them)
+func (w *worker) cancel(job string) {
+	if w.capabilities == nil || !w.capabilities.Cancel {
+		return
+	}
+	if _, err := w.caller.Cancel(job); err != nil {
+		log.Printf("can't cancel requests on %s: %s", w.address, err)
+	}
+}
+
+// stopOnInterrupt closes stop when the process is interrupted, so that the
+// render finishes early with the samples received so far. Interrupting it
+// again kills the process.
+func stopOnInterrupt(stop chan struct{}) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		signal.Stop(signals)
+		log.Printf("interrupted: cancelling the requests on the workers (interrupt again to quit)")
+		close(stop)
+	}()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/DexterLB/traytor/hdrimage"
+	"github.com/DexterLB/traytor/rpc"
+	"github.com/codegangsta/cli"
+)
+
+// checkpoint is a saved unfinished render
+type checkpoint struct {
+	SceneHash string
+	Settings  rpc.SampleSettings
+	// Image contains the sums of all samples rendered so far
+	Image *hdrimage.Image
+	// NextSample is the index of the first sample which hasn't been handed
+	// out
+	NextSample int
+	// Returned are the samples before NextSample which were given back
+	// (e.g. by failed workers) and haven't been rendered, so they're handed
+	// out first when the render is resumed
+	Returned []rpc.SampleRange
+}
+
+// checkpointer periodically saves the frame being rendered, so that the
+// render can be resumed if it's interrupted
+type checkpointer struct {
+	path      string
+	interval  time.Duration
+	sceneHash string
+	// resumed is the checkpoint the render was resumed from (if any)
+	resumed  *checkpoint
+	lastSave time.Time
+}
+
+// getCheckpointer reads the checkpoint options from the command line, and
+// returns nil if no checkpoints should be made or loaded
+func getCheckpointer(c *cli.Context, output string, sceneData []byte) *checkpointer {
+	interval := c.Duration("checkpoint-interval")
+	if interval <= 0 && !c.Bool("resume") {
+		return nil
+	}
+	path := c.String("checkpoint")
+	if path == "" {
+		path = output + ".checkpoint"
+	}
+	return &checkpointer{
+		path:      path,
+		interval:  interval,
+		sceneHash: fmt.Sprintf("%x", sha256.Sum256(sceneData)),
+		lastSave:  time.Now(),
+	}
+}
+
+// resume loads the checkpoint and checks that it was made with the same scene
+// and settings
+func (cp *checkpointer) resume(settings *rpc.SampleSettings) error {
+	file, err := os.Open(cp.path)
+	if err != nil {
+		return fmt.Errorf("can't open checkpoint: %s", err)
+	}
+	defer file.Close()
+
+	saved := &checkpoint{}
+	if err := gob.NewDecoder(file).Decode(saved); err != nil {
+		return fmt.Errorf("can't read checkpoint: %s", err)
+	}
+	if saved.SceneHash != cp.sceneHash {
+		return fmt.Errorf("checkpoint was made with a different scene")
+	}
+	if !sameSettings(&saved.Settings, settings) {
+		return fmt.Errorf("checkpoint was made with different settings")
+	}
+	cp.resumed = saved
+	return nil
+}
+
+// sameSettings returns true if images rendered with the two settings can be
+// added together
+func sameSettings(a, b *rpc.SampleSettings) bool {
+	return a.Width == b.Width && a.Height == b.Height &&
+		a.Sequence == b.Sequence && a.Seed == b.Seed &&
+		a.Filter == b.Filter && a.FilterRadius == b.FilterRadius &&
+		a.Region == b.Region
+}
+
+// start returns the frame to which new samples should be added: the image
+// from the checkpoint if the render is being resumed, otherwise an empty one
+func (cp *checkpointer) start(settings *rpc.SampleSettings) *hdrimage.Image {
+	if cp != nil && cp.resumed != nil {
+		return cp.resumed.Image
+	}
+	frame := hdrimage.New(settings.Width, settings.Height)
+	frame.Divisor = 0
+	return frame
+}
+
+// nextSample returns the index of the first sample which should be rendered
+// into the frame returned by start
+func (cp *checkpointer) nextSample(frame *hdrimage.Image) int {
+	if cp != nil && cp.resumed != nil && cp.resumed.NextSample > frame.Divisor {
+		return cp.resumed.NextSample
+	}
+	return frame.Divisor
+}
+
+// returnedSamples returns the samples which were handed out, but not
+// rendered, before the checkpoint was saved
+func (cp *checkpointer) returnedSamples() []rpc.SampleRange {
+	if cp != nil && cp.resumed != nil {
+		return cp.resumed.Returned
+	}
+	return nil
+}
+
+// chunk limits counter so that it runs out when the next checkpoint is due
+func (cp *checkpointer) chunk(counter rpc.Counter) rpc.Counter {
+	if cp == nil || cp.interval <= 0 {
+		return counter
+	}
+	return rpc.NewDeadlineCounter(counter, cp.lastSave.Add(cp.interval))
+}
+
+// periodic returns true if checkpoints should be saved during the render
+func (cp *checkpointer) periodic() bool {
+	return cp != nil && cp.interval > 0
+}
+
+// update saves a checkpoint if one is due (or if final is set, when the
+// render has finished), and logs any errors. next is the index of the first
+// sample which hasn't been handed out, and returned are the samples before it
+// which were given back without being rendered.
+func (cp *checkpointer) update(
+	settings *rpc.SampleSettings,
+	frame *hdrimage.Image,
+	next int,
+	returned []rpc.SampleRange,
+	final bool,
+) {
+	if !cp.periodic() {
+		return
+	}
+	if !final && time.Now().Before(cp.lastSave.Add(cp.interval)) {
+		return
+	}
+	if err := cp.save(settings, frame, next, returned); err != nil {
+		log.Printf("%s", err)
+	}
+}
+
+// save writes a checkpoint with the given frame. The checkpoint is written
+// to a temporary file first, so an interrupted save doesn't destroy the
+// previous checkpoint.
+func (cp *checkpointer) save(
+	settings *rpc.SampleSettings,
+	frame *hdrimage.Image,
+	next int,
+	returned []rpc.SampleRange,
+) error {
+	cp.lastSave = time.Now()
+
+	saved := &checkpoint{
+		SceneHash:  cp.sceneHash,
+		Settings:   *settings,
+		Image:      frame,
+		NextSample: next,
+		Returned:   returned,
+	}
+	saved.Settings.Mask = nil
+
+	file, err := ioutil.TempFile(filepath.Dir(cp.path), ".traytor-checkpoint")
+	if err != nil {
+		return fmt.Errorf("can't create checkpoint: %s", err)
+	}
+	err = gob.NewEncoder(file).Encode(saved)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("can't write checkpoint: %s", err)
+	}
+	if err := os.Rename(file.Name(), cp.path); err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("can't write checkpoint: %s", err)
+	}
+	return nil
+}
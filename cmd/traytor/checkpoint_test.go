@@ -0,0 +1,99 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/DexterLB/mvm/progress"
+	"github.com/DexterLB/traytor/hdrcolour"
+	"github.com/DexterLB/traytor/hdrimage"
+	"github.com/DexterLB/traytor/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+// indexRenderer renders samples whose colours depend only on their indices,
+// taking 3 at a time. After failAfter samples (if it's positive), it gives
+// back the samples it takes instead of rendering them, like a render whose
+// workers have all failed.
+type indexRenderer struct {
+	failAfter int
+	rendered  int
+}
+
+func (r *indexRenderer) render(
+	settings *rpc.SampleSettings,
+	counter rpc.Counter,
+	bar *progress.ProgressBar,
+	previews *previewer,
+) *hdrimage.Image {
+	im := hdrimage.New(settings.Width, settings.Height)
+	im.Divisor = 0
+	for {
+		samples := counter.Dec(3)
+		if samples.Count == 0 {
+			return im
+		}
+		if r.failAfter > 0 && r.rendered >= r.failAfter {
+			counter.Inc(samples)
+			return im
+		}
+		for k := samples.First; k < samples.First+samples.Count; k++ {
+			for i := 0; i < im.Width; i++ {
+				for j := 0; j < im.Height; j++ {
+					im.Pixels[i][j].AddColour(hdrcolour.New(float32(k), float32(i*k), float32(j)))
+				}
+			}
+		}
+		im.Divisor += samples.Count
+		r.rendered += samples.Count
+		previews.progress(samples.Count)
+	}
+}
+
+func (r *indexRenderer) snapshot() *hdrimage.Image {
+	return nil
+}
+
+func TestResumedRenderIsLikeUninterruptedOne(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "traytor-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	settings := rpc.SampleSettings{Width: 3, Height: 2, SamplesAtOnce: 1}
+	limits := &renderLimits{totalSamples: 10, roundSamples: 1}
+	newCheckpointer := func() *checkpointer {
+		return &checkpointer{
+			path:      filepath.Join(dir, "image.checkpoint"),
+			interval:  time.Hour,
+			sceneHash: "scene",
+			lastSave:  time.Now(),
+		}
+	}
+
+	uninterrupted := renderWithLimits(settings, limits, true, nil, nil, &indexRenderer{})
+
+	// the second batch of samples is given back when the render stops
+	renderWithLimits(settings, limits, true, newCheckpointer(), nil, &indexRenderer{failAfter: 3})
+
+	resumed := newCheckpointer()
+	if err := resumed.resume(&settings); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(3, resumed.resumed.Image.Divisor)
+	assert.Equal([]rpc.SampleRange{{First: 3, Count: 3}}, resumed.resumed.Returned)
+
+	result := renderWithLimits(settings, limits, true, resumed, nil, &indexRenderer{})
+	assert.Equal(uninterrupted.Divisor, result.Divisor)
+	for i := 0; i < settings.Width; i++ {
+		for j := 0; j < settings.Height; j++ {
+			assert.Equal(uninterrupted.AtHDR(i, j), result.AtHDR(i, j))
+		}
+	}
+}
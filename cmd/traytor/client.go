@@ -11,69 +11,645 @@ import (
 	"github.com/codegangsta/cli"
 
 	"github.com/DexterLB/mvm/progress"
+	"github.com/DexterLB/traytor/filter"
 	"github.com/DexterLB/traytor/hdrimage"
 	"github.com/DexterLB/traytor/rpc"
+	"github.com/DexterLB/traytor/sequence"
 )
 
-// RenderLoop renders samples of an image until the sample counter reaches
-// 0, and then returns the combined result. If synchronous is set, images
-// will be transferred from the worker after every sample. Otherwise,
-// the image is transferred at the end.
+// RenderLoop renders samples of an image on a worker until the pass's
+// sample counter runs out. If synchronous is set, images will be transferred
+// from the worker after every request. Otherwise, they're stored on the
+// worker until they're collected. If batchTime isn't 0, the samples in each
+// request are adapted to the worker's speed so that it takes about that
+// long. If speculate is set, once the counter runs out, synchronous workers
+// render again the samples which are late on slower workers. The samples of
+// failed requests are given back to the counter, and the loop stops if the
+// worker gets evicted or the render is stopped.
 func RenderLoop(
-	sampleCounter *rpc.SampleCounter,
-	client *rpc.RemoteRaytracerCaller,
-	renderedImages chan<- *hdrimage.Image,
+	pass *renderPass,
+	w *worker,
 	globalSettings *rpc.SampleSettings,
 	synchronous bool,
-	bar *progress.ProgressBar,
+	batchTime time.Duration,
+	speculate bool,
 ) {
-	settings := *globalSettings
-	for {
-		settings.SamplesAtOnce = sampleCounter.Dec(globalSettings.SamplesAtOnce)
-		if settings.SamplesAtOnce == 0 {
+	for w.alive() {
+		var b *batch
+		if samples := pass.sampleCounter.Dec(w.batchSize(batchTime)); samples.Count > 0 {
+			b = pass.begin(w, samples)
+		} else if speculate && synchronous {
+			b = pass.straggler(w)
+		}
+		if b == nil {
 			return
 		}
-		var err error
-		var image *hdrimage.Image
 
-		if synchronous {
-			image, err = client.Sample(&settings)
-		} else {
-			err = client.StoreSample(&settings)
-		}
-		//both samples log the error, but only synchronous sample pushes
-		//image into the channel
-		if err == nil {
-			if synchronous {
-				renderedImages <- image
-			}
-			if bar != nil {
-				bar.Add(1)
+		if err := pass.sampleBatch(b, w, globalSettings, synchronous); err != nil {
+			if pass.stopped() {
+				// the request has been cancelled
+				return
 			}
-		} else {
-			log.Printf("No sample :( %s\n", err)
+			w.fail(err, pass.sampleCounter)
 		}
 	}
 }
 
-// JoinSamples combines samples into a single image
+// JoinSamples adds samples to a single image as they arrive, locking
+// mutex while changing the image, and tells the previewer (if any) about them
 func JoinSamples(
 	renderedImages <-chan *hdrimage.Image,
-	width int,
-	height int,
-) *hdrimage.Image {
-	averageImage := hdrimage.New(width, height)
-	averageImage.Divisor = 0
+	averageImage *hdrimage.Image,
+	mutex *sync.Mutex,
+	previews *previewer,
+) {
 	for image := range renderedImages {
+		mutex.Lock()
 		averageImage.Add(image)
 		averageImage.Divisor += image.Divisor
+		mutex.Unlock()
+		previews.progress(image.Divisor)
+	}
+}
+
+// defaultWireFormat is the format in which workers send images, unless
+// another one is chosen: lossless, but compressed and cropped
+var defaultWireFormat = &hdrimage.WireFormat{
+	Encoding:    hdrimage.EncodingFloat64,
+	Compression: hdrimage.CompressionDeflate,
+	Crop:        true,
+}
+
+// snapshotTimeout is the time in which workers must send the samples
+// stored on them for a preview
+const snapshotTimeout = 30 * time.Second
+
+// worker is a connected worker which has loaded the scene
+type worker struct {
+	address     string
+	caller      *rpc.RemoteRaytracerCaller
+	requests    int
+	samples     int
+	maxFailures int    // failures in a row after which it's evicted (0 for never)
+	scene       string // ID of the scene on the worker
+	sceneData   []byte
+
+	capabilities *rpc.Capabilities    // nil for workers which don't report them
+	wire         *hdrimage.WireFormat // format of the images from the worker (nil for plain images)
+
+	// collecting is held for writing while the samples stored on the worker
+	// are collected, and for reading while samples are stored
+	collecting sync.RWMutex
+
+	mutex         sync.Mutex
+	failures      int // failures in a row
+	totalFailures int
+	evicted       bool
+	left          bool              // the worker is leaving, and refuses new samples
+	contributed   int               // samples received from the worker
+	pending       []rpc.SampleRange // samples stored on the worker which aren't collected yet
+	uncertain     []rpc.SampleRange // samples of failed requests which may have been stored anyway
+	threads       int               // parallel rendering threads (0 for workers which don't report them)
+	sampleTime    time.Duration     // average time per sample of the requests
+}
+
+// workerRenderer renders samples on all workers at once. Workers can be
+// added while it's rendering.
+type workerRenderer struct {
+	synchronous bool
+	// collectInterval is the time between collecting the samples stored on
+	// asynchronous workers, so that little work is lost if one of them dies
+	// (0 to collect them only at the end)
+	collectInterval time.Duration
+	// batchTime is how long each request should take: the samples in it are
+	// adapted to the worker's measured speed (0 to request the samples the
+	// worker asks for, and as many requests as it allows)
+	batchTime time.Duration
+	// speculate makes synchronous workers which have nothing left to render
+	// render again the samples which are late on slower workers, using
+	// whichever result comes first
+	speculate bool
+	// stop (if not nil) is closed when the render is stopped early, which
+	// cancels the requests which are being rendered
+	stop <-chan struct{}
+	// job is the ID of the requests of the renderer, by which they're
+	// cancelled
+	job    string
+	passes int
+	added  chan struct{} // receives when a worker is added
+
+	poolMutex sync.Mutex
+	workers   []*worker
+	pass      *renderPass // the running pass (if any)
+	// released is set when workers have been released (see release):
+	// a render which has no workers left then waits for workers to be added,
+	// instead of ending
+	released bool
+	closed   bool // set when the workers have been disconnected (see close)
+
+	mutex    sync.Mutex
+	joined   *hdrimage.Image     // samples received during the running render
+	settings *rpc.SampleSettings // settings of the running render
+}
+
+// renderPass is a run of render loops on the workers, which lasts until the
+// sample counter runs out (or the workers are gone)
+type renderPass struct {
+	settings       *rpc.SampleSettings
+	sampleCounter  rpc.Counter
+	bar            *progress.ProgressBar
+	renderedImages chan *hdrimage.Image
+	active         int    // workers which are still rendering
+	job            string // ID of the pass's requests
+	stop           <-chan struct{}
+
+	batchMutex sync.Mutex
+	batches    map[*batch]struct{} // batches which are being rendered
+	batchCount int
+}
+
+// newWorkerRenderer returns a renderer which uses the given workers
+func newWorkerRenderer(workers []*worker, synchronous bool) *workerRenderer {
+	return &workerRenderer{
+		workers:         workers,
+		synchronous:     synchronous,
+		collectInterval: defaultCollectInterval,
+		batchTime:       defaultBatchTime,
+		speculate:       true,
+		job:             newJobID(),
+		added:           make(chan struct{}, 1),
+	}
+}
+
+// add adds a worker which has loaded the scene. If a render is running,
+// the worker starts rendering the samples which are left. It returns false
+// if a worker with the same address has already been added (unless that one
+// has been evicted, has left or has been released), or if the renderer has
+// been closed.
+func (r *workerRenderer) add(w *worker) bool {
+	r.poolMutex.Lock()
+	defer r.poolMutex.Unlock()
+
+	if r.closed {
+		return false
+	}
+	for _, other := range r.workers {
+		if other.address == w.address && other.alive() {
+			return false
+		}
+	}
+	r.workers = append(r.workers, w)
+	if r.pass != nil {
+		r.start(r.pass, w)
+	}
+	select {
+	case r.added <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// release stops giving samples to the worker with the given address, and
+// returns false if there's no such worker which is alive. The samples stored
+// on the worker are still collected.
+func (r *workerRenderer) release(address string) bool {
+	r.poolMutex.Lock()
+	defer r.poolMutex.Unlock()
+
+	for _, w := range r.workers {
+		if w.address == address && w.alive() {
+			w.release()
+			r.released = true
+			return true
+		}
+	}
+	return false
+}
+
+// close disconnects from the workers once the renderer isn't needed any
+// more. Workers can't be added to it afterwards.
+func (r *workerRenderer) close() {
+	r.poolMutex.Lock()
+	defer r.poolMutex.Unlock()
+	r.closed = true
+	closeWorkers(r.workers)
+}
+
+// has returns true if a worker with the given address has been added
+func (r *workerRenderer) has(address string) bool {
+	for _, w := range r.allWorkers() {
+		if w.address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// render renders samples on all workers until the sample counter runs out,
+// and returns the combined result. If samples are given back by a worker
+// after the others have finished, they're rendered on the remaining workers.
+func (r *workerRenderer) render(
+	globalSettings *rpc.SampleSettings,
+	sampleCounter rpc.Counter,
+	bar *progress.ProgressBar,
+	previews *previewer,
+) *hdrimage.Image {
+	r.mutex.Lock()
+	r.joined = mergeImages(globalSettings.Width, globalSettings.Height)
+	r.settings = globalSettings
+	r.mutex.Unlock()
+
+	if r.stop != nil {
+		finished := make(chan struct{})
+		defer close(finished)
+		go func() {
+			select {
+			case <-r.stop:
+				r.cancel()
+			case <-finished:
+			}
+		}()
+	}
+
+	for {
+		r.mutex.Lock()
+		r.passes++
+		pass := &renderPass{
+			settings:      globalSettings,
+			sampleCounter: sampleCounter,
+			bar:           bar,
+			job:           fmt.Sprintf("%s/%d", r.job, r.passes),
+			stop:          r.stop,
+		}
+		r.mutex.Unlock()
+		if !r.startPass(pass) {
+			if r.waitForWorkers(sampleCounter) {
+				continue
+			}
+			log.Printf("no workers left to render on")
+			break
+		}
+		JoinSamples(pass.renderedImages, r.joined, &r.mutex, previews)
+		if !hasSamples(sampleCounter) {
+			break
+		}
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	joined := r.joined
+	r.joined = nil
+	return joined
+}
+
+// waitForWorkers waits until a worker is added if workers have been
+// released, and returns false if they haven't or if the render is stopped
+// or the counter runs out in the meantime
+func (r *workerRenderer) waitForWorkers(counter rpc.Counter) bool {
+	r.poolMutex.Lock()
+	released := r.released
+	r.poolMutex.Unlock()
+	if !released {
+		return false
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.added:
+			return true
+		case <-r.stop:
+			return false
+		case <-ticker.C:
+			if !hasSamples(counter) {
+				return false
+			}
+		}
+	}
+}
+
+// startPass starts the pass on all workers which are alive, and returns
+// false if there are none
+func (r *workerRenderer) startPass(pass *renderPass) bool {
+	r.poolMutex.Lock()
+	defer r.poolMutex.Unlock()
+
+	var workers []*worker
+	for _, w := range r.workers {
+		if w.alive() {
+			workers = append(workers, w)
+		}
+	}
+	if len(workers) == 0 {
+		return false
+	}
+
+	pass.renderedImages = make(chan *hdrimage.Image, len(workers))
+	r.pass = pass
+	for _, w := range workers {
+		r.start(pass, w)
 	}
-	return averageImage
+	return true
+}
+
+// start runs render loops on the worker until the pass is over, and then
+// collects its samples (if it's asynchronous). The last worker to finish
+// ends the pass. The pool mutex must be held.
+func (r *workerRenderer) start(pass *renderPass, w *worker) {
+	pass.active++
+	synchronous := r.synchronous
+	batchTime, speculate := r.batchTime, r.speculate
+	settings := *pass.settings
+	settings.Scene = w.scene
+	settings.Wire = w.wire
+	settings.Session = r.job
+
+	go func() {
+		stopCollecting := make(chan struct{})
+		finishCollecting := &sync.WaitGroup{}
+		if !synchronous && r.collectInterval > 0 {
+			finishCollecting.Add(1)
+			go func() {
+				ticker := time.NewTicker(r.collectInterval)
+				defer ticker.Stop()
+				for {
+					select {
+					case <-stopCollecting:
+						finishCollecting.Done()
+						return
+					case <-ticker.C:
+						collectFrom(w, &settings, pass.sampleCounter, pass.renderedImages, false)
+					}
+				}
+			}()
+		}
+
+		finishRender := &sync.WaitGroup{}
+		requests := w.outstanding(batchTime > 0)
+		finishRender.Add(requests)
+		for request := 0; request < requests; request++ {
+			go func() {
+				RenderLoop(pass, w, &settings, synchronous, batchTime, speculate)
+				finishRender.Done()
+			}()
+		}
+		finishRender.Wait()
+		close(stopCollecting)
+		finishCollecting.Wait()
+
+		if !synchronous {
+			if pass.bar != nil {
+				pass.bar.Prefix(fmt.Sprintf("Getting image from %s", w.address))
+			}
+			collectFrom(w, &settings, pass.sampleCounter, pass.renderedImages, true)
+		}
+		// workers which have been released, evicted or have left don't
+		// render again (they're connected again if they're added back)
+		if !w.alive() {
+			w.caller.Close()
+		}
+
+		r.poolMutex.Lock()
+		defer r.poolMutex.Unlock()
+		pass.active--
+		if pass.active == 0 {
+			r.pass = nil
+			close(pass.renderedImages)
+		}
+	}()
+}
+
+// collectFrom gets the samples stored on an asynchronous worker and sends
+// them to renderedImages (even if the worker is leaving). If retry is set,
+// failed attempts are repeated until they succeed or the worker is evicted.
+func collectFrom(
+	w *worker,
+	settings *rpc.SampleSettings,
+	sampleCounter rpc.Counter,
+	renderedImages chan<- *hdrimage.Image,
+	retry bool,
+) {
+	for !w.isEvicted() {
+		image, err := w.collect(settings, sampleCounter)
+		if err == nil {
+			if image.Width != 0 {
+				renderedImages <- image
+			}
+			return
+		}
+		w.fail(err, sampleCounter)
+		if !retry {
+			return
+		}
+	}
+}
+
+// hasSamples returns true if the counter has samples left
+func hasSamples(counter rpc.Counter) bool {
+	taken := counter.Dec(1)
+	counter.Inc(taken)
+	return taken.Count > 0
+}
+
+// allWorkers returns all workers which have been added, including the ones
+// which have been evicted or have left
+func (r *workerRenderer) allWorkers() []*worker {
+	r.poolMutex.Lock()
+	defer r.poolMutex.Unlock()
+	return append([]*worker(nil), r.workers...)
+}
+
+// cancel cancels the requests which are being rendered on the workers
+func (r *workerRenderer) cancel() {
+	for _, w := range r.allWorkers() {
+		if w.alive() {
+			go w.cancel(r.job)
+		}
+	}
+}
+
+// report prints how many samples each worker has contributed
+func (r *workerRenderer) report() {
+	for _, w := range r.allWorkers() {
+		fmt.Printf("  %s\n", w.report())
+	}
+}
+
+// snapshot returns the samples received so far during the running render,
+// together with the samples stored on the workers if they're asynchronous.
+// The workers are asked for their samples at once, and the ones which don't
+// answer within snapshotTimeout are left out.
+func (r *workerRenderer) snapshot() *hdrimage.Image {
+	r.mutex.Lock()
+	if r.joined == nil {
+		r.mutex.Unlock()
+		return hdrimage.New(0, 0)
+	}
+	joined := mergeImages(r.joined.Width, r.joined.Height, r.joined)
+	settings := *r.settings
+	r.mutex.Unlock()
+
+	images := make([]*hdrimage.Image, 1, len(r.allWorkers())+1)
+	images[0] = joined
+	if !r.synchronous {
+		results := make(chan *hdrimage.Image)
+		asked := make(map[string]bool)
+		for _, w := range r.allWorkers() {
+			// a worker which has been added again has its samples stored
+			// once, under the same key
+			if w.isEvicted() || asked[w.address] {
+				continue
+			}
+			asked[w.address] = true
+			go func(w *worker, settings rpc.SampleSettings) {
+				settings.Scene = w.scene
+				settings.Wire = w.wire
+				settings.Session = r.job
+				image, err := w.caller.WithTimeout(snapshotTimeout).Snapshot(&settings)
+				if err != nil {
+					log.Printf("can't get snapshot from %s: %s", w.address, err)
+				}
+				results <- image
+			}(w, settings)
+		}
+		for range asked {
+			images = append(images, <-results)
+		}
+	}
+	return mergeImages(joined.Width, joined.Height, images...)
+}
+
+// connectWorkers connects to the workers with the given addresses, and
+// loads the scene on them
+func connectWorkers(
+	addresses []string,
+	sceneData []byte,
+	trust *workerTrust,
+	showProgress bool,
+) ([]*worker, error) {
+	workers := make([]*worker, len(addresses))
+	for i := range addresses {
+		var err error
+		workers[i], err = connectWorker(addresses[i], sceneData, trust, showProgress)
+		if err != nil {
+			closeWorkers(workers[:i])
+			return nil, err
+		}
+	}
+	return workers, nil
+}
+
+// closeWorkers disconnects from the workers
+func closeWorkers(workers []*worker) {
+	for _, w := range workers {
+		w.caller.Close()
+	}
+}
+
+// connectWorker connects to the worker with the given address (presenting
+// the token only if the worker is trusted with it), and loads the scene on
+// it (showing the progress of large uploads if showProgress is set). The
+// connection is closed if it fails.
+func connectWorker(
+	address string,
+	sceneData []byte,
+	trust *workerTrust,
+	showProgress bool,
+) (*worker, error) {
+	var err error
+	w := &worker{
+		address:     address,
+		caller:      rpc.NewRemoteRaytracerCaller(address, 10*time.Minute, trust.forWorker(address)),
+		maxFailures: defaultMaxFailures,
+	}
+	w.requests, err = w.caller.MaxRequestsAtOnce()
+	if err != nil || w.requests < 1 {
+		w.caller.Close()
+		return nil, fmt.Errorf("Can't get worker's allowed requests: %s", err)
+	}
+
+	w.samples, err = w.caller.MaxSamplesAtOnce()
+	if err != nil || w.samples < 1 {
+		w.caller.Close()
+		return nil, fmt.Errorf("Can't get worker's allowed samples: %s", err)
+	}
+
+	// older workers don't report their threads, so all requests they allow
+	// are used
+	if stats, err := w.caller.Stats(); err == nil {
+		w.threads = stats.Threads
+	}
+
+	// older workers don't report capabilities, and send plain images
+	if w.capabilities, err = w.caller.Capabilities(); err == nil {
+		w.useWireFormat(defaultWireFormat)
+	}
+
+	w.sceneData = sceneData
+	w.scene, err = w.uploadScene(showProgress)
+	if err != nil {
+		w.caller.Close()
+		return nil, fmt.Errorf("Can't load scene: %s", err)
+	}
+	return w, nil
+}
+
+// uploadScene uploads the scene to the worker (unless it already has it),
+// and returns its ID
+func (w *worker) uploadScene(showProgress bool) (string, error) {
+	chunked := w.capabilities != nil && w.capabilities.ChunkedUpload
+
+	var sent func(int)
+	var bar *progress.ProgressBar
+	if showProgress && chunked && len(w.sceneData) > rpc.SceneChunkSize {
+		bar = progress.StartProgressBar(len(w.sceneData), fmt.Sprintf("uploading scene to %s ", w.address))
+		sent = bar.Add
+	}
+
+	id, err := w.caller.UploadScene(w.sceneData, chunked, sent)
+	if bar != nil {
+		bar.Done()
+	}
+	return id, err
+}
+
+// useWireFormat makes the worker send images in the format closest to the
+// preferred one which it supports
+func (w *worker) useWireFormat(preferred *hdrimage.WireFormat) {
+	if w.capabilities != nil {
+		w.wire = w.capabilities.Negotiate(preferred)
+	}
+}
+
+// getWireFormat returns the wire format of images chosen with the flags
+func getWireFormat(c *cli.Context) (*hdrimage.WireFormat, error) {
+	format := &hdrimage.WireFormat{
+		Encoding:    c.String("wire-encoding"),
+		Compression: c.String("wire-compression"),
+		Crop:        c.BoolT("wire-crop"),
+	}
+	if err := format.Check(); err != nil {
+		return nil, err
+	}
+	return format, nil
 }
 
 func runClient(c *cli.Context) error {
 	scene, image := getArguments(c)
 	workerAdresses := c.StringSlice("worker")
+	if c.Bool("discover") {
+		var err error
+		workerAdresses, err = discoverWorkers(
+			workerAdresses,
+			c.String("discovery-group"),
+			c.Duration("discover-timeout"),
+			c.GlobalBool("quiet"),
+		)
+		if err != nil {
+			log.Printf("%s", err)
+		}
+	}
 
 	if len(workerAdresses) == 0 {
 		showError(c, "can't render on zero workers :(")
@@ -81,11 +657,12 @@ func runClient(c *cli.Context) error {
 	synchronous := c.Bool("synchronous")
 
 	quiet := c.GlobalBool("quiet")
+	limits := getLimits(c)
 
 	if !quiet {
 		fmt.Printf(
-			"will render %s to %s of size %dx%d on those workers: %s, synchronous %v\n",
-			scene, image,
+			"will render %s of %s to %s of size %dx%d on those workers: %s, synchronous %v\n",
+			limits, scene, image,
 			c.Int("width"), c.Int("height"),
 			strings.Join(workerAdresses, ", "),
 			synchronous,
@@ -93,81 +670,130 @@ func runClient(c *cli.Context) error {
 	}
 
 	width, height := c.Int("width"), c.Int("height")
-	totalSamples := c.Int("total-samples")
-	sampleCounter := rpc.NewSampleCounter(totalSamples)
-	renderedImages := make(chan *hdrimage.Image, len(workerAdresses))
-	workers := make([]*rpc.RemoteRaytracerCaller, len(workerAdresses))
-	finishWorker := &sync.WaitGroup{}
-	data, err := ioutil.ReadFile(scene)
+	sequenceName := c.String("sampler")
+	if _, err := sequence.New(sequenceName, 0); err != nil {
+		return err
+	}
+	filterName, filterRadius := c.String("filter"), c.Float64("filter-radius")
+	if _, err := filter.New(filterName, filterRadius); err != nil {
+		return err
+	}
 
-	var bar *progress.ProgressBar
-	if !quiet {
-		bar = progress.StartProgressBar(totalSamples, "rendering samples ")
+	wireFormat, err := getWireFormat(c)
+	if err != nil {
+		return err
 	}
 
+	region, err := parseRegion(c.String("region"), width, height)
 	if err != nil {
-		return fmt.Errorf("Error when loading scene: %s", err)
+		return err
+	}
+	format, err := getOutputFormat(c, image)
+	if err != nil {
+		return err
+	}
+	previews, err := getPreviewer(c, image, format)
+	if err != nil {
+		return err
 	}
-	for i := range workerAdresses {
-		workers[i] = rpc.NewRemoteRaytracerCaller(workerAdresses[i], 10*time.Minute)
-		finishWorker.Add(1)
 
-		requests, err := workers[i].MaxRequestsAtOnce()
-		if err != nil || requests < 1 {
-			return fmt.Errorf("Can't get worker's allowed requests: %s", err)
-		}
+	settings := &rpc.SampleSettings{
+		Width:        width,
+		Height:       height,
+		Sequence:     sequenceName,
+		Filter:       filterName,
+		FilterRadius: filterRadius,
+		Region:       region,
+		Indexed:      true,
+		Seed:         int64(c.Int("seed")),
+	}
 
-		samples, err := workers[i].MaxSamplesAtOnce()
-		if err != nil || samples < 1 {
-			return fmt.Errorf("Can't get worker's allowed samples: %s", err)
-		}
+	data, err := ioutil.ReadFile(scene)
+	if err != nil {
+		return fmt.Errorf("Error when loading scene: %s", err)
+	}
+	trust, err := clientTrust(c)
+	if err != nil {
+		return err
+	}
+	workers, err := connectWorkers(workerAdresses, data, trust, !quiet)
+	if err != nil {
+		return err
+	}
 
-		settings := &rpc.SampleSettings{
-			Width:         width,
-			Height:        height,
-			SamplesAtOnce: samples,
-		}
+	maxFailures := c.Int("max-failures")
+	for _, w := range workers {
+		w.maxFailures = maxFailures
+		w.useWireFormat(wireFormat)
+	}
+	renderer := newWorkerRenderer(workers, synchronous)
+	defer renderer.close()
+	renderer.collectInterval = c.Duration("collect-interval")
+	renderer.batchTime = c.Duration("batch-time")
+	renderer.speculate = c.BoolT("speculate")
+	limits.stop = make(chan struct{})
+	renderer.stop = limits.stop
+	stopOnInterrupt(limits.stop)
 
-		err = workers[i].LoadScene(data)
-		if err != nil {
-			return fmt.Errorf("Can't load scene: %s", err)
+	checkpoints := getCheckpointer(c, image, data)
+	if c.Bool("resume") {
+		if err := checkpoints.resume(settings); err != nil {
+			return err
 		}
+	}
 
-		go func(i int) {
-			finishRender := &sync.WaitGroup{}
-			finishRender.Add(requests)
-			for request := 0; request < requests; request++ {
-				go func() {
-					RenderLoop(sampleCounter, workers[i], renderedImages, settings, synchronous, bar)
-					finishRender.Done()
-				}()
+	var averageImage *hdrimage.Image
+	if tileSize := c.Int("tile-size"); tileSize > 0 {
+		if err := checkTileLimits(limits, checkpoints); err != nil {
+			return err
+		}
+		sources := make([]*tileSource, len(workers))
+		for i, w := range workers {
+			sources[i] = &tileSource{
+				name:     w.address,
+				parallel: w.requests,
+				samples:  w.samples,
+				sample:   w.sampleTile,
+				fail:     w.failTile,
 			}
-			finishRender.Wait()
-			if !synchronous {
-				if !quiet {
-					bar.Prefix(fmt.Sprintf("Getting image from %s", workerAdresses[i]))
+		}
+		averageImage = renderTiles(*settings, tileSize, limits, quiet, previews, sources)
+	} else {
+		if c.Bool("discover") {
+			stopWatching := make(chan struct{})
+			defer close(stopWatching)
+			go watchForWorkers(workerAdresses, c.String("discovery-group"), func(address string) error {
+				w, err := connectWorker(address, data, trust, false)
+				if err != nil {
+					return err
 				}
-				image, err := workers[i].GetImage()
-				if err == nil {
-					if image.Width != 0 {
-						renderedImages <- image
-					}
-				} else {
-					fmt.Printf("Smelly image x_x %s\n", err)
+				w.maxFailures = maxFailures
+				w.useWireFormat(wireFormat)
+				if !renderer.add(w) {
+					w.caller.Close()
+					return fmt.Errorf("the render has finished, or the worker has already joined it")
 				}
-			}
-			finishWorker.Done()
-		}(i)
-	}
+				if !quiet {
+					log.Printf("worker %s joined the render", address)
+				}
+				return nil
+			}, nil, stopWatching)
+		}
 
-	go func() {
-		finishWorker.Wait()
-		close(renderedImages)
+		averageImage = renderWithLimits(*settings, limits, quiet, checkpoints, previews, renderer)
 		if !quiet {
-			bar.Done()
+			fmt.Printf("samples contributed by each worker:\n")
+			renderer.report()
 		}
-	}()
+	}
+	if !quiet {
+		fmt.Printf("rendered %.1f samples per pixel\n", averageImage.SamplesPerPixel())
+	}
+	if background := c.String("composite"); background != "" {
+		if err := compositeOver(averageImage, background, renderedRegion(settings)); err != nil {
+			return err
+		}
+	}
 
-	averageImage := JoinSamples(renderedImages, width, height)
-	return saveImage(averageImage, image, c.String("format"))
+	return saveImage(averageImage, image, format)
 }
@@ -3,32 +3,27 @@ package main
 import (
 	"fmt"
 	"log"
-	"os"
 
-	"github.com/DexterLB/traytor/hdrimage"
 	"github.com/codegangsta/cli"
 )
 
-func runConvert(c *cli.Context) (err error) {
+func runConvert(c *cli.Context) error {
 	fromFilename, toFilename := getArguments(c)
 	quiet := c.GlobalBool("quiet")
 
-	if !quiet {
-		log.Printf("will convert %s to %s", fromFilename, toFilename)
+	format, err := getOutputFormat(c, toFilename)
+	if err != nil {
+		return err
 	}
 
-	from, err := os.Open(fromFilename)
-	if err != nil {
-		return fmt.Errorf("unable to open input file: %s", err)
+	if !quiet {
+		log.Printf("will convert %s to %s", fromFilename, toFilename)
 	}
-	defer func() {
-		err = from.Close()
-	}()
 
-	image, err := hdrimage.Decode(from)
+	image, err := loadImage(fromFilename, c.String("layer"))
 	if err != nil {
 		return fmt.Errorf("unable to read input image: %s", err)
 	}
 
-	return saveImage(image, toFilename, "png")
+	return saveImage(image, toFilename, format)
 }
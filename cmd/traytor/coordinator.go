@@ -0,0 +1,628 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DexterLB/traytor/filter"
+	"github.com/DexterLB/traytor/hdrimage"
+	"github.com/DexterLB/traytor/rpc"
+	"github.com/DexterLB/traytor/scene"
+	"github.com/DexterLB/traytor/sequence"
+	"github.com/codegangsta/cli"
+)
+
+// states of a job in the coordinator's queue
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobDone      = "done"
+	jobFailed    = "failed"
+	jobCancelled = "cancelled"
+)
+
+// jobRequest describes a render submitted to the coordinator
+type jobRequest struct {
+	Name         string  `json:"name"`  // file name of the output image (after the job's ID)
+	Scene        []byte  `json:"scene"` // contents of the scene file
+	Priority     int     `json:"priority"`
+	Width        int     `json:"width"`
+	Height       int     `json:"height"`
+	Samples      int     `json:"samples"`
+	TimeLimit    string  `json:"time_limit,omitempty"` // e.g. 1h30m
+	Sampler      string  `json:"sampler"`
+	Filter       string  `json:"filter"`
+	FilterRadius float64 `json:"filter_radius"`
+	Format       string  `json:"format"`
+}
+
+// jobStatus describes a job in the coordinator's queue
+type jobStatus struct {
+	ID           int       `json:"id"`
+	Name         string    `json:"name"`
+	State        string    `json:"state"`
+	Priority     int       `json:"priority"`
+	Workers      int       `json:"workers"`
+	Samples      float64   `json:"samples"`
+	TotalSamples int       `json:"total_samples"`
+	Submitted    time.Time `json:"submitted"`
+	Started      time.Time `json:"started"`
+	Finished     time.Time `json:"finished"`
+	Output       string    `json:"output,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// job is a render in the coordinator's queue
+type job struct {
+	status    jobStatus
+	request   *jobRequest
+	settings  rpc.SampleSettings
+	limits    *renderLimits
+	timeLimit time.Duration // the deadline is set when the job starts
+	stop      chan struct{}
+	renderer  *workerRenderer // nil until the job's workers are connected
+}
+
+// coordinator queues render jobs from several users, and runs them on
+// a shared pool of workers. Each worker renders one job at a time: free
+// workers go to the queued job with the highest priority, or join the
+// running job with the highest priority if nothing is queued. A queued job
+// also takes the workers of running jobs with a lower priority, which wait
+// until workers are free again.
+type coordinator struct {
+	outputDir string
+	trust     *workerTrust
+
+	mutex   sync.Mutex
+	jobs    []*job
+	workers map[string]*job // the job of each worker (nil if it's free)
+	order   []string        // the addresses of the workers, in order of adding
+	joining map[string]bool // workers which are joining a running job
+	// forget receives the addresses of removed workers, so that they're
+	// added again if they're discovered (nil if workers aren't discovered)
+	forget chan string
+}
+
+func runCoordinator(c *cli.Context) error {
+	co := &coordinator{
+		outputDir: c.String("output-dir"),
+		workers:   make(map[string]*job),
+		joining:   make(map[string]bool),
+	}
+	if info, err := os.Stat(co.outputDir); err != nil || !info.IsDir() {
+		return fmt.Errorf("Invalid output directory: '%s'", co.outputDir)
+	}
+	trust, err := clientTrust(c)
+	if err != nil {
+		return err
+	}
+	co.trust = trust
+	for _, address := range c.StringSlice("worker") {
+		co.addWorker(address)
+	}
+	if c.Bool("discover") {
+		co.forget = make(chan string, 16)
+		go watchForWorkers(nil, c.String("discovery-group"), co.addWorker, co.forget, nil)
+	}
+
+	address, token := c.String("listen-address"), c.String("api-token")
+	config, err := apiTLS(c)
+	if err != nil {
+		return err
+	}
+	if err := checkListenAddress(address, token, config); err != nil {
+		return err
+	}
+	if !c.GlobalBool("quiet") {
+		log.Printf("accepting jobs on %s", apiURL(address, config))
+	}
+	if err := serveAPI(address, co.handler(), token, config); err != nil {
+		return fmt.Errorf("Cannot start http server: %s", err)
+	}
+	return nil
+}
+
+// handler returns the http handler for the coordinator's API
+func (co *coordinator) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/jobs", co.handleJobs)
+	mux.HandleFunc("/api/jobs/", co.handleJob)
+	mux.HandleFunc("/api/workers", co.handleWorkers)
+	return mux
+}
+
+// handleJobs lists the jobs (GET), or submits a job described by
+// a jobRequest (POST)
+func (co *coordinator) handleJobs(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, co.statuses())
+	case "POST":
+		request := &jobRequest{Width: 800, Height: 450, Samples: 20}
+		body := http.MaxBytesReader(w, r.Body, 2*maxSceneSize)
+		if err := json.NewDecoder(body).Decode(request); err != nil {
+			http.Error(w, fmt.Sprintf("can't read job: %s", err), http.StatusBadRequest)
+			return
+		}
+		status, err := co.submit(request)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, status)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleJob shows the status of a job (GET), or cancels it (DELETE)
+func (co *coordinator) handleJob(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/api/jobs/"))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	var status *jobStatus
+	switch r.Method {
+	case "GET":
+		status = co.jobStatus(id)
+	case "DELETE":
+		status = co.cancel(id)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if status == nil {
+		http.NotFound(w, r)
+		return
+	}
+	writeJSON(w, status)
+}
+
+// handleWorkers lists the workers with the jobs they're rendering (GET),
+// or adds the worker with the address given in the "address" parameter (POST)
+func (co *coordinator) handleWorkers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		address := r.URL.Query().Get("address")
+		if address == "" {
+			http.Error(w, "missing worker address", http.StatusBadRequest)
+			return
+		}
+		co.addWorker(address)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, co.workerJobs())
+}
+
+// submit checks the request and adds a job for it to the queue
+func (co *coordinator) submit(request *jobRequest) (*jobStatus, error) {
+	name := filepath.Base(request.Name)
+	if request.Name == "" || name != request.Name {
+		return nil, fmt.Errorf("Invalid output name: '%s'", request.Name)
+	}
+	if _, err := sequence.New(request.Sampler, 0); err != nil {
+		return nil, err
+	}
+	if _, err := filter.New(request.Filter, request.FilterRadius); err != nil {
+		return nil, err
+	}
+	if request.Format == "" {
+		request.Format = formatFromExtension(request.Name)
+	}
+	if err := (&outputFormat{name: request.Format}).check(); err != nil {
+		return nil, err
+	}
+	if err := hdrimage.CheckSize(request.Width, request.Height); err != nil {
+		return nil, err
+	}
+
+	limits := &renderLimits{totalSamples: request.Samples, stop: make(chan struct{})}
+	var timeLimit time.Duration
+	if request.TimeLimit != "" {
+		var err error
+		timeLimit, err = time.ParseDuration(request.TimeLimit)
+		if err != nil || timeLimit <= 0 {
+			return nil, fmt.Errorf("Invalid time limit: '%s'", request.TimeLimit)
+		}
+	}
+	if limits.totalSamples <= 0 && timeLimit <= 0 {
+		return nil, fmt.Errorf("a job needs a number of samples or a time limit")
+	}
+	if _, err := scene.LoadFromBytes(request.Scene); err != nil {
+		return nil, fmt.Errorf("can't load scene: %s", err)
+	}
+
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+
+	j := &job{
+		request: request,
+		settings: rpc.SampleSettings{
+			Width:        request.Width,
+			Height:       request.Height,
+			Sequence:     request.Sampler,
+			Filter:       request.Filter,
+			FilterRadius: request.FilterRadius,
+			Indexed:      true,
+		},
+		limits:    limits,
+		timeLimit: timeLimit,
+		stop:      limits.stop,
+		status: jobStatus{
+			ID:           len(co.jobs) + 1,
+			Name:         name,
+			State:        jobQueued,
+			Priority:     request.Priority,
+			TotalSamples: request.Samples,
+			Submitted:    time.Now(),
+		},
+	}
+	co.jobs = append(co.jobs, j)
+	co.schedule()
+
+	status := j.status
+	return &status, nil
+}
+
+// cancel stops a job (or removes it from the queue), and returns its status
+func (co *coordinator) cancel(id int) *jobStatus {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+
+	j := co.job(id)
+	if j == nil {
+		return nil
+	}
+	switch j.status.State {
+	case jobQueued:
+		j.status.State = jobCancelled
+		j.status.Finished = time.Now()
+	case jobRunning:
+		// the render stops, and the job is finished with what was rendered
+		if !j.cancelled() {
+			close(j.stop)
+		}
+	}
+	status := j.status
+	return &status
+}
+
+// cancelled returns true if the job has been cancelled while running
+func (j *job) cancelled() bool {
+	select {
+	case <-j.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// addWorker adds a worker to the pool, and gives it a job if there is one
+// to give
+func (co *coordinator) addWorker(address string) error {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+
+	if _, ok := co.workers[address]; !ok {
+		co.workers[address] = nil
+		co.order = append(co.order, address)
+		co.schedule()
+	}
+	return nil
+}
+
+// schedule gives the free workers (and the workers taken from running jobs
+// with a lower priority) to the queued job with the highest priority, or
+// gives the free workers to the running job with the highest priority if
+// nothing is queued. The mutex must be held.
+func (co *coordinator) schedule() {
+	for {
+		var free []string
+		for _, address := range co.order {
+			if co.workers[address] == nil {
+				free = append(free, address)
+			}
+		}
+
+		if j := co.next(jobQueued); j != nil {
+			free = append(free, co.preempt(j.status.Priority)...)
+			if len(free) == 0 {
+				return
+			}
+			co.start(j, free)
+			continue
+		}
+		if len(free) == 0 {
+			return
+		}
+		if j := co.next(jobRunning); j != nil {
+			for _, address := range free {
+				co.workers[address] = j
+				co.joining[address] = true
+				j.status.Workers++
+				go co.join(j, address, j.request.Scene)
+			}
+		}
+		return
+	}
+}
+
+// preempt takes the workers of the running jobs with a priority lower than
+// the given one, and returns their addresses. The jobs keep what their
+// workers have rendered, and wait for other workers. Workers of jobs which
+// are still connecting them (or which are joining a job) aren't taken: the
+// jobs are scheduled again when they've connected. The mutex must be held.
+func (co *coordinator) preempt(priority int) []string {
+	var taken []string
+	for _, address := range co.order {
+		j := co.workers[address]
+		if j == nil || j.renderer == nil || co.joining[address] || j.status.Priority >= priority {
+			continue
+		}
+		if j.renderer.release(address) {
+			log.Printf("worker %s leaves job %d for a job with a higher priority", address, j.status.ID)
+		}
+		j.status.Workers--
+		co.workers[address] = nil
+		taken = append(taken, address)
+	}
+	return taken
+}
+
+// next returns the job in the given state which has the highest priority
+// (and was submitted first, if there are several), or nil if there isn't one
+func (co *coordinator) next(state string) *job {
+	var best *job
+	for _, j := range co.jobs {
+		if j.status.State != state || (state == jobRunning && j.renderer == nil) {
+			continue
+		}
+		if best == nil || j.status.Priority > best.status.Priority {
+			best = j
+		}
+	}
+	return best
+}
+
+// start assigns the workers to the job and starts rendering it. The mutex
+// must be held.
+func (co *coordinator) start(j *job, addresses []string) {
+	j.status.State = jobRunning
+	j.status.Started = time.Now()
+	j.status.Workers = len(addresses)
+	if j.timeLimit > 0 {
+		j.limits.deadline = j.status.Started.Add(j.timeLimit)
+	}
+	for _, address := range addresses {
+		co.workers[address] = j
+	}
+	go co.run(j, addresses)
+}
+
+// run connects the job's workers and renders it, saving the image when it
+// finishes
+func (co *coordinator) run(j *job, addresses []string) {
+	var workers []*worker
+	for _, address := range addresses {
+		w, err := connectWorker(address, j.request.Scene, co.trust, false)
+		if err != nil {
+			log.Printf("can't use worker %s: %s", address, err)
+			co.dropWorker(address, j)
+			continue
+		}
+		workers = append(workers, w)
+	}
+
+	co.mutex.Lock()
+	if len(workers) == 0 {
+		// wait for other workers (unless the job has been cancelled)
+		j.status.State = jobQueued
+		j.status.Started = time.Time{}
+		if j.cancelled() {
+			j.status.State = jobCancelled
+			j.status.Finished = time.Now()
+		}
+		co.schedule()
+		co.mutex.Unlock()
+		return
+	}
+	j.renderer = newWorkerRenderer(workers, false)
+	j.renderer.stop = j.stop
+	// workers may have been freed while the job's workers were connecting
+	co.schedule()
+	co.mutex.Unlock()
+
+	previews := &previewer{interval: 5 * time.Second, publish: func(image *hdrimage.Image) {
+		co.mutex.Lock()
+		j.status.Samples = image.SamplesPerPixel()
+		co.mutex.Unlock()
+	}}
+	image := renderWithLimits(j.settings, j.limits, true, nil, previews, j.renderer)
+
+	// names aren't unique, so the job's ID keeps jobs from overwriting each
+	// other's images
+	output := filepath.Join(co.outputDir, fmt.Sprintf("%d-%s", j.status.ID, j.status.Name))
+	var err error
+	if image.Width == 0 || image.Divisor == 0 {
+		err = fmt.Errorf("no samples were rendered")
+	} else {
+		err = saveImage(image, output, &outputFormat{name: j.request.Format})
+	}
+	co.finish(j, image, output, err)
+}
+
+// join connects a worker and adds it to a running job. If the job finishes
+// in the meantime, the worker is freed.
+func (co *coordinator) join(j *job, address string, sceneData []byte) {
+	w, err := connectWorker(address, sceneData, co.trust, false)
+
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+	delete(co.joining, address)
+
+	if err != nil {
+		log.Printf("can't use worker %s: %s", address, err)
+		j.status.Workers--
+		co.removeWorker(address)
+		return
+	}
+	if j.status.State != jobRunning || co.workers[address] != j {
+		w.caller.Close()
+		co.workers[address] = nil
+		co.schedule()
+		return
+	}
+	if !j.renderer.add(w) {
+		w.caller.Close()
+	}
+	// a job with a higher priority may have been queued in the meantime
+	co.schedule()
+}
+
+// finish records the result of a job, and frees its workers (closing their
+// connections). Workers which were evicted from the render or have left are
+// dropped from the pool.
+func (co *coordinator) finish(j *job, image *hdrimage.Image, output string, err error) {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+
+	j.status.Finished = time.Now()
+	j.status.Samples = image.SamplesPerPixel()
+	switch {
+	case j.cancelled():
+		// a cancelled job keeps what was rendered until it was cancelled
+		j.status.State = jobCancelled
+		if err == nil {
+			j.status.Output = output
+		}
+	case err != nil:
+		j.status.State = jobFailed
+		j.status.Error = err.Error()
+		log.Printf("job %d (%s) failed: %s", j.status.ID, j.status.Name, err)
+	default:
+		j.status.State = jobDone
+		j.status.Output = output
+	}
+
+	// the scene isn't needed any more (unless another job renders it too)
+	sceneID := rpc.SceneID(j.request.Scene)
+	unload := true
+	for _, other := range co.jobs {
+		unfinished := other.status.State == jobQueued || other.status.State == jobRunning
+		if other != j && unfinished && rpc.SceneID(other.request.Scene) == sceneID {
+			unload = false
+			break
+		}
+	}
+	j.request.Scene = nil
+
+	gone := make(map[string]bool)
+	for _, w := range j.renderer.allWorkers() {
+		gone[w.address] = !w.alive()
+		go func(w *worker, unload bool) {
+			if unload {
+				w.unloadScene()
+			}
+			w.caller.Close()
+		}(w, unload && !gone[w.address])
+	}
+	for address, assigned := range co.workers {
+		if assigned != j || co.joining[address] {
+			// joining workers are freed when they've connected
+			continue
+		}
+		if gone[address] {
+			co.removeWorker(address)
+		} else {
+			co.workers[address] = nil
+		}
+	}
+	co.schedule()
+}
+
+// dropWorker removes a worker which couldn't be used for a job from the pool
+func (co *coordinator) dropWorker(address string, j *job) {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+	if co.workers[address] == j {
+		j.status.Workers--
+		co.removeWorker(address)
+	}
+}
+
+// removeWorker removes a worker from the pool, so that it's added again only
+// once it's discovered again. The mutex must be held.
+func (co *coordinator) removeWorker(address string) {
+	delete(co.workers, address)
+	for i := range co.order {
+		if co.order[i] == address {
+			co.order = append(co.order[:i], co.order[i+1:]...)
+			break
+		}
+	}
+	if co.forget != nil {
+		// the mutex is held, and discovery may be waiting for it
+		go func() { co.forget <- address }()
+	}
+}
+
+// job returns the job with the given ID, or nil. The mutex must be held.
+func (co *coordinator) job(id int) *job {
+	if id < 1 || id > len(co.jobs) {
+		return nil
+	}
+	return co.jobs[id-1]
+}
+
+// jobStatus returns a copy of the status of the job with the given ID, or nil
+func (co *coordinator) jobStatus(id int) *jobStatus {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+
+	j := co.job(id)
+	if j == nil {
+		return nil
+	}
+	status := j.status
+	return &status
+}
+
+// statuses returns copies of the statuses of all jobs
+func (co *coordinator) statuses() []jobStatus {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+
+	statuses := make([]jobStatus, len(co.jobs))
+	for i, j := range co.jobs {
+		statuses[i] = j.status
+	}
+	return statuses
+}
+
+// workerJobs returns the ID of the job of each worker (0 for free workers)
+func (co *coordinator) workerJobs() map[string]int {
+	co.mutex.Lock()
+	defer co.mutex.Unlock()
+
+	jobs := make(map[string]int)
+	for address, j := range co.workers {
+		jobs[address] = 0
+		if j != nil {
+			jobs[address] = j.status.ID
+		}
+	}
+	return jobs
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/DexterLB/traytor/rpc"
+)
+
+// discoverWorkers listens for worker announcements on the multicast group,
+// and returns a new slice with the given addresses together with the
+// addresses of the discovered workers (without duplicates)
+func discoverWorkers(
+	addresses []string,
+	group string,
+	timeout time.Duration,
+	quiet bool,
+) ([]string, error) {
+	announcements, err := rpc.Discover(group, timeout)
+	if err != nil {
+		return addresses, fmt.Errorf("can't discover workers: %s", err)
+	}
+
+	result := append([]string(nil), addresses...)
+	known := make(map[string]bool)
+	for _, address := range addresses {
+		known[address] = true
+	}
+	for _, announcement := range announcements {
+		if known[announcement.Address] {
+			continue
+		}
+		known[announcement.Address] = true
+		result = append(result, announcement.Address)
+		if !quiet {
+			log.Printf(
+				"discovered worker %s (%d threads, %d requests, %d samples at once)",
+				announcement.Address,
+				announcement.Threads,
+				announcement.MaxRequestsAtOnce,
+				announcement.MaxSamplesAtOnce,
+			)
+		}
+	}
+	return result, nil
+}
+
+// watchForWorkers keeps listening for worker announcements until stop is
+// closed, and calls join with the address of each worker which isn't known
+// yet. Workers which fail to join are tried again when they're heard next,
+// and so are the ones whose addresses are received from forget (if it isn't
+// nil), e.g. because they've been removed after failing. Failed discoveries
+// are retried with a backoff.
+func watchForWorkers(
+	known []string,
+	group string,
+	join func(address string) error,
+	forget <-chan string,
+	stop <-chan struct{},
+) {
+	seen := make(map[string]bool)
+	for _, address := range known {
+		seen[address] = true
+	}
+
+	failures := 0 // failed discoveries in a row
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		forgetWorkers(seen, forget)
+
+		announcements, err := rpc.Discover(group, 5*time.Second)
+		if err != nil {
+			failures++
+			delay := backoff(failures)
+			log.Printf("can't discover workers, retrying in %s: %s", delay, err)
+			select {
+			case <-stop:
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		failures = 0
+		for _, announcement := range announcements {
+			if seen[announcement.Address] {
+				continue
+			}
+			if err := join(announcement.Address); err != nil {
+				log.Printf("can't add worker %s: %s", announcement.Address, err)
+				continue
+			}
+			seen[announcement.Address] = true
+		}
+	}
+}
+
+// forgetWorkers removes the addresses which have been sent to forget (if it
+// isn't nil) from seen, without waiting for more
+func forgetWorkers(seen map[string]bool, forget <-chan string) {
+	for {
+		select {
+		case address := <-forget:
+			delete(seen, address)
+		default:
+			return
+		}
+	}
+}
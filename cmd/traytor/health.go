@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/DexterLB/traytor/hdrimage"
+	"github.com/DexterLB/traytor/rpc"
+)
+
+const (
+	// defaultMaxFailures is the number of failures in a row after which
+	// a worker is evicted
+	defaultMaxFailures = 5
+	// defaultCollectInterval is the time between collecting the samples
+	// stored on asynchronous workers
+	defaultCollectInterval = time.Minute
+
+	retryDelay    = 500 * time.Millisecond
+	maxRetryDelay = 30 * time.Second
+)
+
+var errEvicted = errors.New("worker has been evicted")
+
+// backoff returns the time to wait before retrying after the given number
+// of failures in a row: it doubles with each failure, up to maxRetryDelay
+func backoff(failures int) time.Duration {
+	delay := retryDelay
+	for i := 1; i < failures && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+// alive returns false if the worker has been evicted or has left
+func (w *worker) alive() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return !w.evicted && !w.left
+}
+
+// release makes the worker take no new samples, as if it were leaving (the
+// samples stored on it are still collected), so that it can be given to
+// another render
+func (w *worker) release() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.left = true
+}
+
+// isEvicted returns true if the worker has been evicted
+func (w *worker) isEvicted() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.evicted
+}
+
+// sample renders the samples given in the settings. If synchronous is set,
+// it returns the image (whose samples are counted once it's used),
+// otherwise the samples are stored on the worker until they're collected.
+// The time the request takes is used to measure the worker's speed.
+func (w *worker) sample(settings *rpc.SampleSettings, synchronous bool) (*hdrimage.Image, error) {
+	w.collecting.RLock()
+	defer w.collecting.RUnlock()
+
+	started := time.Now()
+	var image *hdrimage.Image
+	var err error
+	if synchronous {
+		image, err = w.caller.Sample(settings)
+	} else {
+		err = w.caller.StoreSample(settings)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.evicted {
+		// the samples of an evicted worker have already been given back
+		return nil, errEvicted
+	}
+	w.failures = 0
+	w.measure(settings.SamplesAtOnce, time.Since(started))
+	if !synchronous {
+		w.pending = append(w.pending, rpc.SampleRange{
+			First: settings.FirstSample,
+			Count: settings.SamplesAtOnce,
+		})
+	}
+	return image, nil
+}
+
+// storeFailed records the samples of a failed request to store them, which
+// the worker may have stored anyway (e.g. if the request timed out while it
+// was still rendering), and cancels the request in case it's still running.
+// Whether the samples were stored is found out when they're collected. It
+// returns false if they weren't stored for sure (and should be given back),
+// i.e. if the worker refused them because it's leaving, or has been evicted.
+func (w *worker) storeFailed(settings *rpc.SampleSettings, err error) bool {
+	if rpc.IsLeaving(err) {
+		return false
+	}
+	w.cancel(settings.Job)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.evicted {
+		return false
+	}
+	w.uncertain = append(w.uncertain, rpc.SampleRange{
+		First: settings.FirstSample,
+		Count: settings.SamplesAtOnce,
+	})
+	return true
+}
+
+// contribute counts samples received from the worker
+func (w *worker) contribute(samples int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.contributed += samples
+}
+
+// collect gets the samples stored on an asynchronous worker. Samples aren't
+// stored while they're being collected, so none of them are counted twice.
+// The samples of workers which are leaving can still be collected. If no
+// more samples were stored than the ones of successful requests, the
+// samples of the failed ones are given back to the counter.
+func (w *worker) collect(settings *rpc.SampleSettings, counter rpc.Counter) (*hdrimage.Image, error) {
+	w.collecting.Lock()
+	defer w.collecting.Unlock()
+
+	if w.isEvicted() {
+		return nil, errEvicted
+	}
+	image, err := w.caller.GetImage(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.failures = 0
+	stored, expected := 0, 0
+	if image.Width != 0 {
+		stored = image.Divisor
+	}
+	for _, samples := range w.pending {
+		expected += samples.Count
+	}
+	if stored <= expected {
+		for _, samples := range w.uncertain {
+			counter.Inc(samples)
+		}
+	}
+	w.contributed += stored
+	w.pending, w.uncertain = nil, nil
+	return image, nil
+}
+
+// fail records a failed request and waits before the worker is used again.
+// If the worker has failed too many times in a row, it's evicted instead,
+// and the samples stored on it (or which may be stored) are given back to
+// the counter. Requests refused by a leaving worker aren't failures: the
+// worker just isn't given new samples any more.
+func (w *worker) fail(err error, counter rpc.Counter) {
+	if rpc.IsLeaving(err) {
+		w.mutex.Lock()
+		alreadyLeft := w.left
+		w.left = true
+		w.mutex.Unlock()
+		if !alreadyLeft {
+			log.Printf("worker %s is leaving", w.address)
+		}
+		return
+	}
+
+	w.mutex.Lock()
+	if w.evicted {
+		w.mutex.Unlock()
+		return
+	}
+	w.failures++
+	w.totalFailures++
+	failures := w.failures
+	evict := w.maxFailures > 0 && failures >= w.maxFailures
+	if evict {
+		w.evicted = true
+		for _, samples := range append(w.pending, w.uncertain...) {
+			counter.Inc(samples)
+		}
+		w.pending, w.uncertain = nil, nil
+	}
+	w.mutex.Unlock()
+
+	if evict {
+		log.Printf("evicting %s after %d failures in a row: %s", w.address, failures, err)
+		return
+	}
+	delay := backoff(failures)
+	log.Printf("request to %s failed, retrying in %s: %s", w.address, delay, err)
+	time.Sleep(delay)
+	w.reloadScene()
+}
+
+// reloadScene loads the scene on the worker again if it doesn't have it
+// (because it has unloaded it, or has been restarted)
+func (w *worker) reloadScene() {
+	if has, err := w.caller.HasScene(w.scene); err != nil || has {
+		return
+	}
+	if _, err := w.uploadScene(false); err != nil {
+		log.Printf("can't load the scene on %s again: %s", w.address, err)
+	}
+}
+
+// unloadScene unloads the scene from the worker when it isn't needed
+// any more
+func (w *worker) unloadScene() {
+	if err := w.caller.UnloadScene(w.scene); err != nil {
+		log.Printf("can't unload the scene from %s: %s", w.address, err)
+	}
+}
+
+// sampleTile renders the tile given in the settings on the worker's scene
+func (w *worker) sampleTile(settings *rpc.SampleSettings) (*hdrimage.Tile, error) {
+	tileSettings := *settings
+	tileSettings.Scene = w.scene
+	tileSettings.Wire = w.wire
+	return w.caller.SampleTile(&tileSettings)
+}
+
+// failTile handles a failed tile request like fail, and returns true if
+// the worker can still render tiles. Tiles aren't stored on the worker,
+// so there are no samples to give back.
+func (w *worker) failTile(err error) bool {
+	w.fail(err, nil)
+	return w.alive()
+}
+
+// report returns a line which tells how many samples the worker has
+// contributed and how reliable it has been
+func (w *worker) report() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	line := fmt.Sprintf("%s: %d samples, %d failures", w.address, w.contributed, w.totalFailures)
+	if w.evicted {
+		line += " (evicted)"
+	} else if w.left {
+		line += " (left)"
+	}
+	return line
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/codegangsta/cli"
+)
+
+// coordinatorURL returns the URL of an API path on the coordinator with the
+// given address
+func coordinatorURL(address string, path string) string {
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+	return strings.TrimSuffix(address, "/") + path
+}
+
+// callCoordinator sends a request to the coordinator's API (presenting the
+// token, unless it's empty), and decodes the JSON response into result
+func callCoordinator(method string, url string, token string, body io.Reader, result interface{}) error {
+	request, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("can't reach coordinator: %s", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("coordinator says: %s", strings.TrimSpace(string(message)))
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+func runSubmit(c *cli.Context) error {
+	sceneFile, output := getArguments(c)
+	data, err := ioutil.ReadFile(sceneFile)
+	if err != nil {
+		return fmt.Errorf("Error when loading scene: %s", err)
+	}
+
+	request := &jobRequest{
+		Name:         filepath.Base(output),
+		Scene:        data,
+		Priority:     c.Int("priority"),
+		Width:        c.Int("width"),
+		Height:       c.Int("height"),
+		Samples:      c.Int("total-samples"),
+		Sampler:      c.String("sampler"),
+		Filter:       c.String("filter"),
+		FilterRadius: c.Float64("filter-radius"),
+		Format:       c.String("format"),
+	}
+	if timeLimit := c.Duration("time-limit"); timeLimit > 0 {
+		request.TimeLimit = timeLimit.String()
+		if !c.IsSet("total-samples") {
+			request.Samples = 0
+		}
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	status := &jobStatus{}
+	url := coordinatorURL(c.String("coordinator"), "/api/jobs")
+	if err := callCoordinator("POST", url, c.String("api-token"), bytes.NewReader(body), status); err != nil {
+		return err
+	}
+	if !c.GlobalBool("quiet") {
+		fmt.Printf("submitted job %d (%s)\n", status.ID, status.Name)
+	}
+	return nil
+}
+
+func runJobs(c *cli.Context) error {
+	address, token := c.String("coordinator"), c.String("api-token")
+
+	var statuses []jobStatus
+	if c.NArg() == 0 {
+		if c.Bool("cancel") {
+			showError(c, "give the IDs of the jobs to cancel")
+		}
+		if err := callCoordinator("GET", coordinatorURL(address, "/api/jobs"), token, nil, &statuses); err != nil {
+			return err
+		}
+	}
+	for _, arg := range c.Args() {
+		id, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("Invalid job ID: '%s'", arg)
+		}
+		method := "GET"
+		if c.Bool("cancel") {
+			method = "DELETE"
+		}
+		status := jobStatus{}
+		url := coordinatorURL(address, fmt.Sprintf("/api/jobs/%d", id))
+		if err := callCoordinator(method, url, token, nil, &status); err != nil {
+			return err
+		}
+		statuses = append(statuses, status)
+	}
+
+	printJobs(os.Stdout, statuses)
+	return nil
+}
+
+// printJobs prints a table of the jobs' statuses
+func printJobs(out io.Writer, statuses []jobStatus) {
+	table := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(table, "ID\tNAME\tSTATE\tPRIORITY\tWORKERS\tSAMPLES\tTIME\tRESULT\n")
+	for _, status := range statuses {
+		var elapsed time.Duration
+		switch {
+		case !status.Finished.IsZero() && !status.Started.IsZero():
+			elapsed = status.Finished.Sub(status.Started)
+		case !status.Started.IsZero():
+			elapsed = time.Since(status.Started)
+		}
+		result := status.Output
+		if status.Error != "" {
+			result = status.Error
+		}
+		fmt.Fprintf(
+			table, "%d\t%s\t%s\t%d\t%d\t%.1f/%d\t%s\t%s\n",
+			status.ID, status.Name, status.State, status.Priority, status.Workers,
+			status.Samples, status.TotalSamples, elapsed/time.Second*time.Second, result,
+		)
+	}
+	table.Flush()
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/DexterLB/mvm/progress"
+	"github.com/DexterLB/traytor/hdrimage"
+	"github.com/DexterLB/traytor/rpc"
+	"github.com/codegangsta/cli"
+)
+
+// roundRenderer renders samples on a local raytracer or on workers
+type roundRenderer interface {
+	// render renders samples with the given settings until the counter
+	// runs out, and returns the combined result. The previewer (if any) is
+	// told about the samples as they're rendered.
+	render(
+		settings *rpc.SampleSettings,
+		counter rpc.Counter,
+		bar *progress.ProgressBar,
+		previews *previewer,
+	) *hdrimage.Image
+	// snapshot returns the samples rendered so far by the running call of
+	// render (without resetting them)
+	snapshot() *hdrimage.Image
+}
+
+// renderLimits describe when rendering stops
+type renderLimits struct {
+	// totalSamples is the number of samples per pixel (on average),
+	// 0 for no limit
+	totalSamples int
+	// deadline is the time when rendering stops, zero for no time limit
+	deadline time.Time
+	// noiseThreshold stops rendering when the relative noise of every pixel
+	// is below it, 0 to disable
+	noiseThreshold float64
+	// adaptiveThreshold stops sampling the pixels whose relative noise is
+	// below it, 0 to disable
+	adaptiveThreshold float64
+	// roundSamples is the number of samples per pixel between noise estimates
+	roundSamples int
+	// stop (if not nil) can be closed to stop rendering early
+	stop chan struct{}
+}
+
+// getLimits reads the render limits from the command line. If there's a time
+// limit or a noise threshold, the number of samples is only limited if
+// --total-samples has been given explicitly.
+func getLimits(c *cli.Context) *renderLimits {
+	limits := &renderLimits{
+		totalSamples:      c.Int("total-samples"),
+		noiseThreshold:    c.Float64("noise-threshold"),
+		adaptiveThreshold: c.Float64("adaptive-threshold"),
+		roundSamples:      c.Int("adaptive-round"),
+	}
+	if timeLimit := c.Duration("time-limit"); timeLimit > 0 {
+		limits.deadline = time.Now().Add(timeLimit)
+	}
+	if (!limits.deadline.IsZero() || limits.noiseThreshold > 0) && !c.IsSet("total-samples") {
+		limits.totalSamples = 0
+	}
+	if limits.roundSamples < 1 {
+		limits.roundSamples = 1
+	}
+	return limits
+}
+
+// String describes the limits in a human-readable way
+func (l *renderLimits) String() string {
+	description := "unlimited samples"
+	if l.totalSamples > 0 {
+		description = fmt.Sprintf("%d samples", l.totalSamples)
+	}
+	if !l.deadline.IsZero() {
+		description += fmt.Sprintf(" until %s", l.deadline.Format(time.Stamp))
+	}
+	if l.noiseThreshold > 0 {
+		description += fmt.Sprintf(" or until noise is below %g", l.noiseThreshold)
+	}
+	return description
+}
+
+// counter returns a counter which hands out the given number of samples
+// (unlimited if 0): first the returned ones (which weren't rendered
+// before), then the ones with indices from first. It runs out at the
+// deadline. The wrapped sample counter is returned too.
+func (l *renderLimits) counter(
+	first int,
+	samples int,
+	returned []rpc.SampleRange,
+) (rpc.Counter, *rpc.SampleCounter) {
+	if samples <= 0 {
+		samples = math.MaxInt32
+	}
+	for _, r := range returned {
+		samples -= r.Count
+	}
+	if samples < 0 {
+		samples = 0
+	}
+	sampleCounter := rpc.NewSampleCounterFrom(first, samples)
+	for _, r := range returned {
+		sampleCounter.Inc(r)
+	}
+	var counter rpc.Counter = sampleCounter
+	if !l.deadline.IsZero() {
+		counter = rpc.NewDeadlineCounter(counter, l.deadline)
+	}
+	if l.stop != nil {
+		counter = &stopCounter{Counter: counter, stop: l.stop}
+	}
+	return counter, sampleCounter
+}
+
+// expired returns true if the deadline has passed or rendering has been
+// stopped
+func (l *renderLimits) expired() bool {
+	return (!l.deadline.IsZero() && !time.Now().Before(l.deadline)) || l.stopped()
+}
+
+// stopped returns true if the stop channel has been closed
+func (l *renderLimits) stopped() bool {
+	if l.stop == nil {
+		return false
+	}
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// stopCounter hands out samples from another counter until stop is closed
+type stopCounter struct {
+	rpc.Counter
+	stop chan struct{}
+}
+
+// Dec works like the wrapped counter's Dec, but returns no samples after
+// stop is closed
+func (sc *stopCounter) Dec(value int) rpc.SampleRange {
+	select {
+	case <-sc.stop:
+		return rpc.SampleRange{}
+	default:
+		return sc.Counter.Dec(value)
+	}
+}
+
+// renderWithLimits renders samples until the limits are reached. If there
+// are noise or adaptive thresholds, samples are rendered in rounds, between
+// which the noise of each pixel is estimated. If checkpoints isn't nil,
+// the render continues from its checkpoint (if resumed) and is saved
+// periodically. If previews isn't nil, the image is saved while it's being
+// rendered.
+func renderWithLimits(
+	settings rpc.SampleSettings,
+	limits *renderLimits,
+	quiet bool,
+	checkpoints *checkpointer,
+	previews *previewer,
+	renderer roundRenderer,
+) *hdrimage.Image {
+	if limits.noiseThreshold > 0 || limits.adaptiveThreshold > 0 {
+		return renderRounds(settings, limits, quiet, checkpoints, previews, renderer)
+	}
+
+	frame := checkpoints.start(&settings)
+	remaining := limits.totalSamples - frame.Divisor
+	if limits.totalSamples > 0 && remaining <= 0 {
+		return frame
+	}
+
+	frameMutex := &sync.Mutex{}
+	previews.start(previewSnapshot(&settings, frame, frameMutex, renderer))
+	defer previews.stop()
+
+	var bar *progress.ProgressBar
+	if !quiet && limits.totalSamples > 0 {
+		bar = progress.StartProgressBar(limits.totalSamples, "rendering samples ")
+		bar.Add(frame.Divisor)
+	}
+
+	counter, samples := limits.counter(
+		checkpoints.nextSample(frame), remaining, checkpoints.returnedSamples(),
+	)
+	for {
+		chunk := renderer.render(&settings, checkpoints.chunk(counter), bar, previews)
+		if chunk.Width == 0 || chunk.Divisor == 0 {
+			break
+		}
+		frameMutex.Lock()
+		frame.Add(chunk)
+		frame.Divisor += chunk.Divisor
+		frameMutex.Unlock()
+
+		if !checkpoints.periodic() || limits.expired() {
+			break
+		}
+		checkpoints.update(&settings, frame, samples.Next(), samples.Returned(), false)
+	}
+	checkpoints.update(&settings, frame, samples.Next(), samples.Returned(), true)
+
+	if bar != nil {
+		bar.Done()
+	}
+	return frame
+}
+
+// renderRounds renders rounds of samples, and after each round estimates
+// the noise of each pixel. If there's an adaptive threshold, the pixels
+// whose relative noise is below it aren't sampled in the next rounds
+// (and the budget of samples is spent on the noisy ones). Rendering stops
+// when there are no noisy pixels left or any of the limits is reached.
+func renderRounds(
+	settings rpc.SampleSettings,
+	limits *renderLimits,
+	quiet bool,
+	checkpoints *checkpointer,
+	previews *previewer,
+	renderer roundRenderer,
+) *hdrimage.Image {
+	frame := checkpoints.start(&settings)
+
+	settings.Adaptive = true
+	settings.Mask = nil
+
+	region := renderedRegion(&settings)
+	budget := limits.totalSamples*region.Dx()*region.Dy() - recordedSamples(frame)
+	if frame.Statistics != nil {
+		if limits.noiseThreshold > 0 && noisyPixels(frame, limits.noiseThreshold, region).Count() == 0 {
+			return frame
+		}
+		if limits.adaptiveThreshold > 0 {
+			settings.Mask = noisyPixels(frame, limits.adaptiveThreshold, region)
+		}
+	}
+
+	frameMutex := &sync.Mutex{}
+	previews.start(previewSnapshot(&settings, frame, frameMutex, renderer))
+	defer previews.stop()
+
+	next, returned := checkpoints.nextSample(frame), checkpoints.returnedSamples()
+	for round := 1; !limits.expired(); round++ {
+		active := region.Dx() * region.Dy()
+		if settings.Mask != nil {
+			active = settings.Mask.Count()
+		}
+		if active == 0 {
+			break
+		}
+
+		samples := limits.roundSamples
+		if limits.totalSamples > 0 {
+			if budget/active < samples {
+				samples = budget / active
+			}
+			if samples < 1 {
+				break
+			}
+			budget -= samples * active
+		}
+
+		var bar *progress.ProgressBar
+		if !quiet {
+			bar = progress.StartProgressBar(
+				samples,
+				fmt.Sprintf("round %d (%d noisy pixels) ", round, active),
+			)
+		}
+
+		counter, roundSamples := limits.counter(next, samples, returned)
+		roundImage := renderer.render(&settings, counter, bar, previews)
+		next, returned = roundSamples.Next(), roundSamples.Returned()
+		if roundImage.Width != 0 {
+			frameMutex.Lock()
+			frame.Add(roundImage)
+			frame.Divisor += roundImage.Divisor
+			frameMutex.Unlock()
+		}
+
+		if !quiet {
+			bar.Done()
+		}
+
+		checkpoints.update(&settings, frame, next, returned, false)
+
+		if limits.noiseThreshold > 0 && noisyPixels(frame, limits.noiseThreshold, region).Count() == 0 {
+			break
+		}
+		if limits.adaptiveThreshold > 0 {
+			settings.Mask = noisyPixels(frame, limits.adaptiveThreshold, region)
+		}
+	}
+
+	checkpoints.update(&settings, frame, next, returned, true)
+	return frame
+}
+
+// previewSnapshot returns a function which combines the frame with the
+// samples of the running round, to be used for previews. The frame must only
+// be changed while holding frameMutex.
+func previewSnapshot(
+	settings *rpc.SampleSettings,
+	frame *hdrimage.Image,
+	frameMutex *sync.Mutex,
+	renderer roundRenderer,
+) func() *hdrimage.Image {
+	width, height := settings.Width, settings.Height
+	return func() *hdrimage.Image {
+		frameMutex.Lock()
+		defer frameMutex.Unlock()
+		return mergeImages(width, height, frame, renderer.snapshot())
+	}
+}
+
+// recordedSamples returns the number of samples recorded in the image's
+// statistics
+func recordedSamples(frame *hdrimage.Image) int {
+	samples := 0
+	for i := range frame.Statistics {
+		for j := range frame.Statistics[i] {
+			samples += frame.Statistics[i][j].Samples
+		}
+	}
+	return samples
+}
+
+// noisyPixels returns a mask of the pixels inside region whose relative
+// noise is above the threshold
+func noisyPixels(frame *hdrimage.Image, threshold float64, region image.Rectangle) *hdrimage.Mask {
+	mask := frame.NoisyPixels(threshold)
+	for i := 0; i < mask.Width; i++ {
+		for j := 0; j < mask.Height; j++ {
+			if !image.Pt(i, j).In(region) {
+				mask.Set(i, j, false)
+			}
+		}
+	}
+	return mask
+}
@@ -5,7 +5,10 @@ import (
 	"log"
 	"os"
 	"runtime"
+	"time"
 
+	"github.com/DexterLB/traytor/hdrimage"
+	"github.com/DexterLB/traytor/rpc"
 	"github.com/codegangsta/cli"
 )
 
@@ -23,6 +26,41 @@ func getArguments(c *cli.Context) (string, string) {
 	return arguments[0], arguments[1]
 }
 
+// exrPixelTypeFlag and exrCompressionFlag choose how exr images are saved
+var exrPixelTypeFlag = cli.StringFlag{
+	Name:  "exr-pixel-type",
+	Value: hdrimage.EXRHalf,
+	Usage: "pixel type of exr images (half or float)",
+}
+var exrCompressionFlag = cli.StringFlag{
+	Name:  "exr-compression",
+	Value: hdrimage.EXRCompressionZIP,
+	Usage: "compression of exr images (none, rle, zips or zip)",
+}
+
+// exposureFlag, whiteBalanceFlag and toneMapFlag choose how colours are
+// mapped when saving png and jpeg images (other formats stay linear)
+var exposureFlag = cli.Float64Flag{
+	Name:  "exposure",
+	Usage: "exposure of png and jpeg images, in stops",
+}
+var whiteBalanceFlag = cli.StringFlag{
+	Name:  "white-balance",
+	Usage: "temperature (e.g. 3200K) or r,g,b colour of light which should look white in png and jpeg images",
+}
+var toneMapFlag = cli.StringFlag{
+	Name:  "tone-map",
+	Value: "clamp",
+	Usage: "tone mapping of png and jpeg images (clamp, reinhard, filmic, aces or agx)",
+}
+
+// coordinatorFlag is the address of the coordinator for the job commands
+var coordinatorFlag = cli.StringFlag{
+	Name:  "coordinator, c",
+	Value: "localhost:8081",
+	Usage: "address of the coordinator",
+}
+
 func main() {
 	app := cli.NewApp()
 	app.Name = "traytor test"
@@ -32,9 +70,24 @@ func main() {
 		{
 			Name:      "convert",
 			Aliases:   []string{"conv", "c"},
-			Usage:     "convert a traytor_hdr file to a png file (loses HDR information)",
-			ArgsUsage: "<traytor_hdr file> <png file>",
+			Usage:     "convert a traytor_hdr, exr, hdr or pfm file to another format",
+			ArgsUsage: "<traytor_hdr, exr, hdr or pfm file> <output image file>",
 			Action:    runConvert,
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "format, f",
+					Usage: "output file format (png, jpeg, traytor_hdr, exr, hdr or pfm; png and jpeg lose HDR information; png, exr and hdr record the sample count; by default chosen by the file's extension)",
+				},
+				exrPixelTypeFlag,
+				exrCompressionFlag,
+				exposureFlag,
+				whiteBalanceFlag,
+				toneMapFlag,
+				cli.StringFlag{
+					Name:  "layer",
+					Usage: "layer of an exr file to convert (e.g. noise), instead of the image",
+				},
+			},
 		},
 		{
 			Name:      "render",
@@ -60,13 +113,84 @@ func main() {
 				},
 				cli.IntFlag{
 					Name:  "total-samples, t",
-					Usage: "total samples to render",
+					Usage: "total samples to render (unlimited with a time limit or noise threshold, unless given)",
 					Value: 20,
 				},
 				cli.StringFlag{
 					Name:  "format, f",
-					Usage: "output file format (png or traytor_hdr)",
-					Value: "png",
+					Usage: "output file format (png, jpeg, traytor_hdr, exr, hdr or pfm; png, exr and hdr record the sample count; by default chosen by the file's extension)",
+				},
+				exrPixelTypeFlag,
+				exrCompressionFlag,
+				exposureFlag,
+				whiteBalanceFlag,
+				toneMapFlag,
+				cli.StringFlag{
+					Name:  "sampler",
+					Usage: "sample sequence (random, stratified, halton, sobol or bluenoise)",
+					Value: "random",
+				},
+				cli.IntFlag{
+					Name:  "seed",
+					Usage: "seed of the sample sequence (renders with the same seed and settings are identical)",
+				},
+				cli.StringFlag{
+					Name:  "filter",
+					Usage: "pixel reconstruction filter (box, tent, gaussian, mitchell or blackman-harris)",
+					Value: "box",
+				},
+				cli.Float64Flag{
+					Name:  "filter-radius",
+					Usage: "radius of the reconstruction filter in pixels (0 for the filter's default)",
+				},
+				cli.Float64Flag{
+					Name:  "adaptive-threshold",
+					Usage: "stop sampling pixels whose relative noise is below this (0 disables adaptive sampling)",
+				},
+				cli.IntFlag{
+					Name:  "adaptive-round",
+					Usage: "samples per pixel between noise estimates in adaptive sampling",
+					Value: 16,
+				},
+				cli.DurationFlag{
+					Name:  "time-limit",
+					Usage: "stop rendering after this much time (e.g. 1h30m)",
+				},
+				cli.Float64Flag{
+					Name:  "noise-threshold",
+					Usage: "stop rendering when the relative noise of every pixel is below this",
+				},
+				cli.IntFlag{
+					Name:  "tile-size",
+					Usage: "render square tiles of this size one after another (0 to render whole frames)",
+				},
+				cli.StringFlag{
+					Name:  "region",
+					Usage: "only render the pixels in x0,y0,x1,y1 (in pixels, or relative to the image size if all are in [0, 1])",
+				},
+				cli.StringFlag{
+					Name:  "composite",
+					Usage: "place the rendered region over this previously rendered traytor_hdr frame",
+				},
+				cli.DurationFlag{
+					Name:  "checkpoint-interval",
+					Usage: "save the unfinished render this often (e.g. 10m), so that it can be resumed",
+				},
+				cli.StringFlag{
+					Name:  "checkpoint",
+					Usage: "file for checkpoints (the output file with .checkpoint appended by default)",
+				},
+				cli.BoolFlag{
+					Name:  "resume",
+					Usage: "continue rendering from the checkpoint, until the limits are reached",
+				},
+				cli.StringFlag{
+					Name:  "preview-interval",
+					Usage: "save the image while rendering, every this often (e.g. 30s) or every this many samples (e.g. 16)",
+				},
+				cli.StringFlag{
+					Name:  "preview",
+					Usage: "file for previews (the output file by default)",
 				},
 			},
 		},
@@ -75,7 +199,7 @@ func main() {
 			Aliases: []string{"wrk", "w"},
 			Usage:   "start a rendering server which takes requests from the client",
 			Action:  runWorker,
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.StringFlag{
 					Name:  "listen-address, l",
 					Value: ":1234",
@@ -96,7 +220,35 @@ func main() {
 					Value: runtime.NumCPU(),
 					Usage: "number of parallel rendering threads",
 				},
-			},
+				cli.IntFlag{
+					Name:  "max-scenes",
+					Value: 4,
+					Usage: "max number of loaded scenes (the least recently used ones are unloaded, 0 for no limit)",
+				},
+				cli.IntFlag{
+					Name:  "max-scene-memory",
+					Usage: "max total size of the loaded scenes in MiB, uncompressed (0 for no limit)",
+				},
+				cli.BoolTFlag{
+					Name:  "announce",
+					Usage: "announce the worker on the local network, so that clients can discover it (use --announce=false to disable)",
+				},
+				cli.StringFlag{
+					Name:  "metrics-address",
+					Usage: "serve statistics in the Prometheus format on <address>/metrics (other than localhost only with --api-token and --tls-cert, which also enables HTTPS)",
+				},
+				apiTokenFlag,
+				cli.DurationFlag{
+					Name:  "leave-timeout",
+					Usage: "when interrupted, wait at most this long for clients to collect the stored samples",
+					Value: time.Minute,
+				},
+				cli.StringFlag{
+					Name:  "discovery-group",
+					Value: rpc.DiscoveryGroup,
+					Usage: "UDP multicast address on which workers are announced",
+				},
+			}, workerSecurityFlags...),
 		},
 		{
 			Name:      "client",
@@ -104,20 +256,247 @@ func main() {
 			Usage:     "render a scene remotely on RPC workers",
 			ArgsUsage: "<scene file> <output image file>",
 			Action:    runClient,
-			Flags: []cli.Flag{
+			Flags: append([]cli.Flag{
 				cli.BoolFlag{
 					Name:  "synchronous, s",
 					Usage: "workers don't wait until the end to synchronise images",
 				},
+				cli.IntFlag{
+					Name:  "max-failures",
+					Usage: "evict a worker after this many failed requests in a row (0 to never evict)",
+					Value: defaultMaxFailures,
+				},
+				cli.DurationFlag{
+					Name:  "collect-interval",
+					Usage: "time between collecting the samples of asynchronous workers (0 to collect only at the end)",
+					Value: defaultCollectInterval,
+				},
+				cli.DurationFlag{
+					Name:  "batch-time",
+					Usage: "how long each request to a worker should take: its samples are adapted to the worker's measured speed (0 to use the samples the worker asks for)",
+					Value: defaultBatchTime,
+				},
+				cli.BoolTFlag{
+					Name:  "speculate",
+					Usage: "with --synchronous, render the late samples of slow workers again on idle ones, using whichever comes first (use --speculate=false to disable)",
+				},
+				cli.StringFlag{
+					Name:  "wire-encoding",
+					Value: defaultWireFormat.Encoding,
+					Usage: "encoding of the pixels sent by workers (float64, float32, or the lossy float16 or rgbe)",
+				},
+				cli.StringFlag{
+					Name:  "wire-compression",
+					Value: defaultWireFormat.Compression,
+					Usage: "compression of the images sent by workers (deflate or none)",
+				},
+				cli.BoolTFlag{
+					Name:  "wire-crop",
+					Usage: "make workers send only the part of the image which has samples (use --wire-crop=false to disable)",
+				},
 				cli.IntFlag{
 					Name:  "total-samples, t",
-					Usage: "total samples to render",
+					Usage: "total samples to render (unlimited with a time limit or noise threshold, unless given)",
 					Value: 20,
 				},
 				cli.StringSliceFlag{
 					Name:  "worker, w",
 					Usage: "address of worker to connect to - can be added multiple times",
 				},
+				cli.BoolFlag{
+					Name:  "discover, d",
+					Usage: "also render on the workers announced on the local network",
+				},
+				cli.DurationFlag{
+					Name:  "discover-timeout",
+					Value: 2 * time.Second,
+					Usage: "how long to listen for worker announcements",
+				},
+				cli.StringFlag{
+					Name:  "discovery-group",
+					Value: rpc.DiscoveryGroup,
+					Usage: "UDP multicast address on which workers are announced",
+				},
+				cli.IntFlag{
+					Name:  "width, x",
+					Usage: "width of the output image",
+					Value: 800,
+				},
+				cli.IntFlag{
+					Name:  "height, y",
+					Usage: "height of the output image",
+					Value: 450,
+				},
+				cli.StringFlag{
+					Name:  "format, f",
+					Usage: "output file format (png, jpeg, traytor_hdr, exr, hdr or pfm; png, exr and hdr record the sample count; by default chosen by the file's extension)",
+				},
+				exrPixelTypeFlag,
+				exrCompressionFlag,
+				exposureFlag,
+				whiteBalanceFlag,
+				toneMapFlag,
+				cli.StringFlag{
+					Name:  "sampler",
+					Usage: "sample sequence (random, stratified, halton, sobol or bluenoise)",
+					Value: "random",
+				},
+				cli.IntFlag{
+					Name:  "seed",
+					Usage: "seed of the sample sequence (renders with the same seed and settings are identical)",
+				},
+				cli.StringFlag{
+					Name:  "filter",
+					Usage: "pixel reconstruction filter (box, tent, gaussian, mitchell or blackman-harris)",
+					Value: "box",
+				},
+				cli.Float64Flag{
+					Name:  "filter-radius",
+					Usage: "radius of the reconstruction filter in pixels (0 for the filter's default)",
+				},
+				cli.Float64Flag{
+					Name:  "adaptive-threshold",
+					Usage: "stop sampling pixels whose relative noise is below this (0 disables adaptive sampling)",
+				},
+				cli.IntFlag{
+					Name:  "adaptive-round",
+					Usage: "samples per pixel between noise estimates in adaptive sampling",
+					Value: 16,
+				},
+				cli.DurationFlag{
+					Name:  "time-limit",
+					Usage: "stop rendering after this much time (e.g. 1h30m)",
+				},
+				cli.Float64Flag{
+					Name:  "noise-threshold",
+					Usage: "stop rendering when the relative noise of every pixel is below this",
+				},
+				cli.IntFlag{
+					Name:  "tile-size",
+					Usage: "render square tiles of this size one after another (0 to render whole frames)",
+				},
+				cli.StringFlag{
+					Name:  "region",
+					Usage: "only render the pixels in x0,y0,x1,y1 (in pixels, or relative to the image size if all are in [0, 1])",
+				},
+				cli.StringFlag{
+					Name:  "composite",
+					Usage: "place the rendered region over this previously rendered traytor_hdr frame",
+				},
+				cli.DurationFlag{
+					Name:  "checkpoint-interval",
+					Usage: "save the unfinished render this often (e.g. 10m), so that it can be resumed",
+				},
+				cli.StringFlag{
+					Name:  "checkpoint",
+					Usage: "file for checkpoints (the output file with .checkpoint appended by default)",
+				},
+				cli.BoolFlag{
+					Name:  "resume",
+					Usage: "continue rendering from the checkpoint, until the limits are reached",
+				},
+				cli.StringFlag{
+					Name:  "preview-interval",
+					Usage: "save the image while rendering, every this often (e.g. 30s) or every this many samples (e.g. 16)",
+				},
+				cli.StringFlag{
+					Name:  "preview",
+					Usage: "file for previews (the output file by default)",
+				},
+			}, securityFlags...),
+		},
+		{
+			Name:   "serve",
+			Usage:  "start a web interface for rendering scenes locally or on workers",
+			Action: runServe,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "listen-address, l",
+					Value: "localhost:8080",
+					Usage: "local network address (interface) to serve the web interface on (other than localhost only with --api-token and --api-tls-cert)",
+				},
+				cli.StringFlag{
+					Name:  "scenes, s",
+					Value: ".",
+					Usage: "directory with scenes (*.json.gz) which can be rendered",
+				},
+				cli.StringSliceFlag{
+					Name:  "worker, w",
+					Usage: "worker address which can be selected for rendering (can be given many times)",
+				},
+				cli.BoolFlag{
+					Name:  "discover, d",
+					Usage: "also offer the workers announced on the local network",
+				},
+				cli.StringFlag{
+					Name:  "discovery-group",
+					Value: rpc.DiscoveryGroup,
+					Usage: "UDP multicast address on which workers are announced",
+				},
+				cli.IntFlag{
+					Name:  "max-jobs, j",
+					Value: runtime.NumCPU(),
+					Usage: "number of parallel rendering threads when rendering locally",
+				},
+				apiTokenFlag,
+				apiTLSCertFlag,
+				apiTLSKeyFlag,
+			}, securityFlags...),
+		},
+		{
+			Name:   "coordinator",
+			Usage:  "queue render jobs from many users and run them on a shared pool of workers",
+			Action: runCoordinator,
+			Flags: append([]cli.Flag{
+				cli.StringFlag{
+					Name:  "listen-address, l",
+					Value: "localhost:8081",
+					Usage: "local network address (interface) to accept jobs on (other than localhost only with --api-token and --api-tls-cert)",
+				},
+				apiTokenFlag,
+				apiTLSCertFlag,
+				apiTLSKeyFlag,
+				cli.StringFlag{
+					Name:  "output-dir, o",
+					Value: ".",
+					Usage: "directory in which the images of finished jobs are written",
+				},
+				cli.StringSliceFlag{
+					Name:  "worker, w",
+					Usage: "address of a worker in the pool (can be given many times)",
+				},
+				cli.BoolFlag{
+					Name:  "discover, d",
+					Usage: "also add the workers announced on the local network to the pool",
+				},
+				cli.StringFlag{
+					Name:  "discovery-group",
+					Value: rpc.DiscoveryGroup,
+					Usage: "UDP multicast address on which workers are announced",
+				},
+			}, securityFlags...),
+		},
+		{
+			Name:      "submit",
+			Usage:     "queue a render job on a coordinator",
+			ArgsUsage: "<scene file> <output image name>",
+			Action:    runSubmit,
+			Flags: []cli.Flag{
+				coordinatorFlag,
+				apiTokenFlag,
+				cli.IntFlag{
+					Name:  "priority, p",
+					Usage: "jobs with higher priority are rendered first",
+				},
+				cli.IntFlag{
+					Name:  "total-samples, t",
+					Usage: "total samples to render (unlimited with a time limit, unless given)",
+					Value: 20,
+				},
+				cli.DurationFlag{
+					Name:  "time-limit",
+					Usage: "stop rendering after this much time (e.g. 1h30m)",
+				},
 				cli.IntFlag{
 					Name:  "width, x",
 					Usage: "width of the output image",
@@ -130,11 +509,63 @@ func main() {
 				},
 				cli.StringFlag{
 					Name:  "format, f",
-					Usage: "output file format (png or traytor_hdr)",
-					Value: "png",
+					Usage: "output file format (png, jpeg, traytor_hdr, exr, hdr or pfm; png, exr and hdr record the sample count; by default chosen by the file's extension)",
+				},
+				cli.StringFlag{
+					Name:  "sampler",
+					Usage: "sample sequence (random, stratified, halton, sobol or bluenoise)",
+					Value: "random",
+				},
+				cli.StringFlag{
+					Name:  "filter",
+					Usage: "pixel reconstruction filter (box, tent, gaussian, mitchell or blackman-harris)",
+					Value: "box",
+				},
+				cli.Float64Flag{
+					Name:  "filter-radius",
+					Usage: "radius of the reconstruction filter in pixels (0 for the filter's default)",
+				},
+			},
+		},
+		{
+			Name:      "jobs",
+			Usage:     "show the jobs on a coordinator",
+			ArgsUsage: "[job IDs]",
+			Action:    runJobs,
+			Flags: []cli.Flag{
+				coordinatorFlag,
+				apiTokenFlag,
+				cli.BoolFlag{
+					Name:  "cancel",
+					Usage: "cancel the given jobs (running jobs keep what has been rendered)",
 				},
 			},
 		},
+		{
+			Name:   "workers",
+			Usage:  "show the status of workers",
+			Action: runWorkers,
+			Flags: append([]cli.Flag{
+				cli.StringSliceFlag{
+					Name:  "worker, w",
+					Usage: "worker address (can be given many times)",
+				},
+				cli.BoolFlag{
+					Name:  "discover, d",
+					Usage: "also show the workers announced on the local network",
+				},
+				cli.DurationFlag{
+					Name:  "discover-timeout",
+					Value: 2 * time.Second,
+					Usage: "how long to listen for worker announcements",
+				},
+				cli.StringFlag{
+					Name:  "discovery-group",
+					Value: rpc.DiscoveryGroup,
+					Usage: "UDP multicast address on which workers are announced",
+				},
+			}, securityFlags...),
+		},
 	}
 
 	app.Flags = []cli.Flag{
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/DexterLB/traytor/rpc"
+)
+
+// serveMetrics serves the worker's statistics in the Prometheus text format
+// on /metrics, over TLS if config isn't nil. If token isn't empty, requests
+// must present it like to the other HTTP APIs.
+func serveMetrics(address string, rr *rpc.RemoteRaytracer, token string, config *tls.Config) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writeMetrics(w, rr.Stats())
+	})
+
+	if err := serveAPI(address, mux, token, config); err != nil {
+		log.Printf("can't serve metrics: %s", err)
+	}
+}
+
+// writeMetrics writes the statistics in the Prometheus text format
+func writeMetrics(out io.Writer, stats *rpc.WorkerStats) {
+	metric := func(name string, kind string, help string, value interface{}) {
+		fmt.Fprintf(out, "# HELP traytor_%s %s\n", name, help)
+		fmt.Fprintf(out, "# TYPE traytor_%s %s\n", name, kind)
+		fmt.Fprintf(out, "traytor_%s %v\n", name, value)
+	}
+	leaving := 0
+	if stats.Leaving {
+		leaving = 1
+	}
+
+	metric("samples_total", "counter", "Samples rendered by the worker.", stats.Samples)
+	metric("rays_total", "counter", "Rays traced by the worker.", stats.Rays)
+	metric("rays_per_second", "gauge", "Rays traced per second recently.", stats.RaysPerSecond)
+	metric("threads", "gauge", "Parallel rendering threads.", stats.Threads)
+	metric("active_requests", "gauge", "Requests being rendered.", stats.ActiveRequests)
+	metric("queued_requests", "gauge", "Requests waiting for a free thread.", stats.QueuedRequests)
+	metric("max_requests", "gauge", "Maximum parallel requests.", stats.MaxRequestsAtOnce)
+	metric("uptime_seconds", "gauge", "Time since the worker started.", stats.Uptime.Seconds())
+	metric("memory_bytes", "gauge", "Memory obtained from the OS.", stats.Memory)
+	metric("leaving", "gauge", "Whether the worker is leaving.", leaving)
+	metric("loaded_scenes", "gauge", "Number of loaded scenes.", len(stats.Scenes))
+
+	fmt.Fprintf(out, "# HELP traytor_scene_loaded Loaded scenes, by ID.\n")
+	fmt.Fprintf(out, "# TYPE traytor_scene_loaded gauge\n")
+	for _, scene := range stats.Scenes {
+		fmt.Fprintf(out, "traytor_scene_loaded{scene=%q} 1\n", scene)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/DexterLB/traytor/hdrimage"
+	"github.com/codegangsta/cli"
+)
+
+// previewer periodically saves the image while it's being rendered,
+// either every few seconds or every few samples
+type previewer struct {
+	path     string
+	format   *outputFormat
+	interval time.Duration // time between previews (0 if counting samples)
+	samples  int           // samples between previews (0 if counting time)
+	// publish, if not nil, receives the previews instead of saving them
+	publish func(image *hdrimage.Image)
+
+	trigger chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+
+	mutex    sync.Mutex
+	rendered int // samples rendered since the last preview
+}
+
+// getPreviewer reads the preview options from the command line, and returns
+// nil if there should be no previews. The interval is either a duration
+// (e.g. 30s) or a number of samples per pixel.
+func getPreviewer(c *cli.Context, output string, format *outputFormat) (*previewer, error) {
+	interval := c.String("preview-interval")
+	if interval == "" {
+		return nil, nil
+	}
+
+	p := &previewer{path: c.String("preview"), format: format}
+	if p.path == "" {
+		p.path = output
+	} else if c.String("format") == "" {
+		previewFormat := *format
+		previewFormat.name = formatFromExtension(p.path)
+		p.format = &previewFormat
+	}
+
+	if samples, err := strconv.Atoi(interval); err == nil {
+		p.samples = samples
+	} else if duration, err := time.ParseDuration(interval); err == nil {
+		p.interval = duration
+	}
+	if p.samples <= 0 && p.interval <= 0 {
+		return nil, fmt.Errorf("Invalid preview interval: '%s'", interval)
+	}
+	return p, nil
+}
+
+// start begins saving the images returned by snapshot as previews, until
+// stop is called
+func (p *previewer) start(snapshot func() *hdrimage.Image) {
+	if p == nil {
+		return
+	}
+	p.trigger = make(chan struct{}, 1)
+	p.done = make(chan struct{})
+	p.rendered = 0
+
+	p.wg.Add(1)
+	go func() {
+		defer p.wg.Done()
+
+		var tick <-chan time.Time
+		if p.interval > 0 {
+			ticker := time.NewTicker(p.interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-tick:
+			case <-p.trigger:
+			}
+			if err := p.save(snapshot()); err != nil {
+				log.Printf("can't save preview: %s", err)
+			}
+		}
+	}()
+}
+
+// stop stops making previews, and waits for the one being saved (if any),
+// so that it doesn't overwrite the final image
+func (p *previewer) stop() {
+	if p == nil {
+		return
+	}
+	close(p.done)
+	p.wg.Wait()
+}
+
+// progress tells the previewer that more samples have been rendered, so that
+// it can make a preview if enough have been rendered since the last one
+func (p *previewer) progress(samples int) {
+	if p == nil || p.samples <= 0 {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.rendered += samples
+	if p.rendered < p.samples {
+		return
+	}
+	p.rendered = 0
+	select {
+	case p.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// save writes the image to a temporary file and moves it over the preview,
+// so that the preview is never seen half-written
+func (p *previewer) save(image *hdrimage.Image) error {
+	if image.Width == 0 || image.Divisor == 0 {
+		return nil
+	}
+	if p.publish != nil {
+		p.publish(image)
+		return nil
+	}
+	temporary := p.path + ".preview"
+	if err := saveImage(image, temporary, p.format); err != nil {
+		os.Remove(temporary)
+		return err
+	}
+	return os.Rename(temporary, p.path)
+}
+
+// mergeImages returns a new image which contains the samples of all given
+// images (images with zero width, which contain no samples, are skipped)
+func mergeImages(width, height int, images ...*hdrimage.Image) *hdrimage.Image {
+	merged := hdrimage.New(width, height)
+	merged.Divisor = 0
+	for _, image := range images {
+		if image == nil || image.Width == 0 {
+			continue
+		}
+		merged.Add(image)
+		merged.Divisor += image.Divisor
+	}
+	return merged
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/DexterLB/traytor/hdrimage"
+	"github.com/DexterLB/traytor/rpc"
+)
+
+// parseRegion parses a region given as "x0,y0,x1,y1" (from the top left
+// corner of the image). If all coordinates are between 0 and 1, they're
+// relative to the image size, otherwise they're in pixels. An empty string
+// means the whole image (and gives an empty rectangle).
+func parseRegion(description string, width, height int) (image.Rectangle, error) {
+	if description == "" {
+		return image.Rectangle{}, nil
+	}
+
+	parts := strings.Split(description, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("Invalid region: '%s'", description)
+	}
+
+	var coords [4]float64
+	normalised := true
+	for i := range parts {
+		var err error
+		coords[i], err = strconv.ParseFloat(strings.TrimSpace(parts[i]), 64)
+		if err != nil || coords[i] < 0 {
+			return image.Rectangle{}, fmt.Errorf("Invalid region: '%s'", description)
+		}
+		if coords[i] > 1 {
+			normalised = false
+		}
+	}
+	if normalised {
+		coords[0] *= float64(width)
+		coords[1] *= float64(height)
+		coords[2] *= float64(width)
+		coords[3] *= float64(height)
+	}
+
+	region := image.Rect(
+		int(math.Floor(coords[0])), int(math.Floor(coords[1])),
+		int(math.Ceil(coords[2])), int(math.Ceil(coords[3])),
+	).Intersect(image.Rect(0, 0, width, height))
+	if region.Empty() {
+		return image.Rectangle{}, fmt.Errorf("Empty region: '%s'", description)
+	}
+	return region, nil
+}
+
+// renderedRegion returns the region of the image which will be rendered
+// with the given settings
+func renderedRegion(settings *rpc.SampleSettings) image.Rectangle {
+	if settings.Region.Empty() {
+		return image.Rect(0, 0, settings.Width, settings.Height)
+	}
+	return settings.Region
+}
+
+// compositeOver places the rendered region of the image over a frame
+// loaded from a traytor_hdr file
+func compositeOver(im *hdrimage.Image, backgroundPath string, region image.Rectangle) error {
+	background, err := loadImage(backgroundPath, "")
+	if err != nil {
+		return fmt.Errorf("can't read background frame: %s", err)
+	}
+	return im.Composite(background, region)
+}
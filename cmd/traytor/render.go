@@ -2,79 +2,86 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"log"
 	"sync"
 
 	"github.com/DexterLB/mvm/progress"
+	"github.com/DexterLB/traytor/filter"
 	"github.com/DexterLB/traytor/hdrimage"
-	"github.com/DexterLB/traytor/random"
-	"github.com/DexterLB/traytor/raytracer"
 	"github.com/DexterLB/traytor/rpc"
 	"github.com/DexterLB/traytor/scene"
+	"github.com/DexterLB/traytor/sequence"
 	"github.com/codegangsta/cli"
 )
 
-func renderer(
-	width, height int,
-	renderedImages chan *hdrimage.Image,
-	scene *scene.Scene,
-	seed int64,
-	totalSamples int,
-	threads int,
-	quiet bool,
-) {
-	randomGen := random.New(seed)
-
-	sampleCounter := rpc.NewSampleCounter(totalSamples)
-	var bar *progress.ProgressBar
-	if !quiet {
-		bar = progress.StartProgressBar(totalSamples, "rendering samples")
-	}
+// localRenderer renders samples on all units of a local concurrent raytracer
+type localRenderer struct {
+	raytracer *rpc.ConcurrentRaytracer
 
-	wg := sync.WaitGroup{}
-	wg.Add(threads)
-
-	defer func() {
-		wg.Wait()
-		if !quiet {
-			bar.Done()
-		}
-	}()
+	mutex    sync.Mutex
+	settings rpc.SampleSettings // settings of the running render
+}
 
-	for i := 0; i < threads; i++ {
-		go func(seed int64) {
+func (l *localRenderer) render(
+	globalSettings *rpc.SampleSettings,
+	sampleCounter rpc.Counter,
+	bar *progress.ProgressBar,
+	previews *previewer,
+) *hdrimage.Image {
+	l.mutex.Lock()
+	l.settings = *globalSettings
+	l.mutex.Unlock()
+
+	cr := l.raytracer
+	wg := sync.WaitGroup{}
+	wg.Add(cr.ParallelSamples())
+	for i := 0; i < cr.ParallelSamples(); i++ {
+		go func() {
 			defer wg.Done()
 
-			raytracer := raytracer.Raytracer{
-				Scene:  scene,
-				Random: random.New(seed),
-			}
-
-			image := hdrimage.New(width, height)
-			image.Divisor = 0
-
+			settings := *globalSettings
 			for {
-				if sampleCounter.Dec(1) == 0 {
-					renderedImages <- image
+				samples := sampleCounter.Dec(globalSettings.SamplesAtOnce)
+				if samples.Count == 0 {
 					return
 				}
-				raytracer.Sample(image)
-				if !quiet {
+				settings.SamplesAtOnce, settings.FirstSample = samples.Count, samples.First
+				if err := cr.StoreSample(&settings); err != nil {
+					// give the samples back, so that they're recorded in
+					// the checkpoint and rendered when resuming
+					sampleCounter.Inc(samples)
+					log.Printf("can't render sample: %s", err)
+					return
+				}
+				if bar != nil {
 					bar.Add(1)
 				}
+				previews.progress(samples.Count)
 			}
-		}(randomGen.NewSeed())
+		}()
 	}
+	wg.Wait()
+
+	return cr.GetImage(globalSettings)
+}
+
+func (l *localRenderer) snapshot() *hdrimage.Image {
+	l.mutex.Lock()
+	settings := l.settings
+	l.mutex.Unlock()
+	return l.raytracer.Snapshot(&settings)
 }
 
 func runRender(c *cli.Context) error {
 	scenePath, image := getArguments(c)
 	quiet := c.GlobalBool("quiet")
+	limits := getLimits(c)
 
 	if !quiet {
 		log.Printf(
-			"will render %d samples of %s to %s of size %dx%d with %d threads",
-			c.Int("total-samples"),
+			"will render %s of %s to %s of size %dx%d with %d threads",
+			limits,
 			scenePath, image,
 			c.Int("width"), c.Int("height"),
 			c.Int("max-jobs"),
@@ -82,28 +89,88 @@ func runRender(c *cli.Context) error {
 	}
 
 	width, height := c.Int("width"), c.Int("height")
-	totalSamples := c.Int("total-samples")
 	threads := c.Int("max-jobs")
+	sequenceName := c.String("sampler")
 
-	renderedImages := make(chan *hdrimage.Image)
+	if _, err := sequence.New(sequenceName, 0); err != nil {
+		return err
+	}
+	filterName, filterRadius := c.String("filter"), c.Float64("filter-radius")
+	if _, err := filter.New(filterName, filterRadius); err != nil {
+		return err
+	}
+
+	region, err := parseRegion(c.String("region"), width, height)
+	if err != nil {
+		return err
+	}
+	format, err := getOutputFormat(c, image)
+	if err != nil {
+		return err
+	}
+	previews, err := getPreviewer(c, image, format)
+	if err != nil {
+		return err
+	}
 
-	scene, err := scene.LoadFromFile(scenePath)
+	data, err := ioutil.ReadFile(scenePath)
+	if err != nil {
+		return fmt.Errorf("can't open scene: %s", err)
+	}
+	scene, err := scene.LoadFromBytes(data)
 	if err != nil {
 		return fmt.Errorf("can't open scene: %s", err)
 	}
 	scene.Init()
 
-	go func() {
-		renderer(width, height, renderedImages, scene, 42, totalSamples, threads, quiet)
-		close(renderedImages)
-	}()
+	settings := rpc.SampleSettings{
+		Width:         width,
+		Height:        height,
+		SamplesAtOnce: 1,
+		Sequence:      sequenceName,
+		Filter:        filterName,
+		FilterRadius:  filterRadius,
+		Region:        region,
+		Indexed:       true,
+		Seed:          int64(c.Int("seed")),
+	}
+
+	raytracer := rpc.NewConcurrentRaytracer(threads, scene, 42)
 
-	averageImage := hdrimage.New(width, height)
-	averageImage.Divisor = 0
-	for currentImage := range renderedImages {
-		averageImage.Add(currentImage)
-		averageImage.Divisor += currentImage.Divisor
+	checkpoints := getCheckpointer(c, image, data)
+	if c.Bool("resume") {
+		if err := checkpoints.resume(&settings); err != nil {
+			return err
+		}
 	}
 
-	return saveImage(averageImage, image, c.String("format"))
+	var averageImage *hdrimage.Image
+	if tileSize := c.Int("tile-size"); tileSize > 0 {
+		if err := checkTileLimits(limits, checkpoints); err != nil {
+			return err
+		}
+		averageImage = renderTiles(
+			settings, tileSize, limits, quiet, previews,
+			[]*tileSource{{
+				name:     "local raytracer",
+				parallel: threads,
+				samples:  1,
+				sample:   raytracer.SampleTile,
+			}},
+		)
+	} else {
+		averageImage = renderWithLimits(
+			settings, limits, quiet, checkpoints, previews,
+			&localRenderer{raytracer: raytracer},
+		)
+	}
+	if !quiet {
+		log.Printf("rendered %.1f samples per pixel", averageImage.SamplesPerPixel())
+	}
+	if background := c.String("composite"); background != "" {
+		if err := compositeOver(averageImage, background, renderedRegion(&settings)); err != nil {
+			return err
+		}
+	}
+	return saveImage(averageImage, image, format)
 }
@@ -1,37 +1,224 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
 	"image/png"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/DexterLB/traytor/hdrimage"
+	"github.com/DexterLB/traytor/tonemap"
+	"github.com/codegangsta/cli"
 )
 
-func saveImage(image *hdrimage.Image, filename string, format string) (err error) {
-	file, err := os.Create(filename)
-	defer func() {
-		err = file.Close()
-	}()
+// jpegQuality is the quality of saved jpeg images
+const jpegQuality = 95
+
+// outputFormat is the file format in which images are saved
+type outputFormat struct {
+	name  string              // png, jpeg, traytor_hdr, exr, hdr or pfm
+	exr   hdrimage.EXROptions // options of exr images
+	tones tonemap.ToneMapper  // tone mapping of png and jpeg images
+}
+
+// formatExtensions are the output formats of files with known extensions
+var formatExtensions = map[string]string{
+	".png":         "png",
+	".jpg":         "jpeg",
+	".jpeg":        "jpeg",
+	".traytor_hdr": "traytor_hdr",
+	".exr":         "exr",
+	".hdr":         "hdr",
+	".pic":         "hdr",
+	".rgbe":        "hdr",
+	".pfm":         "pfm",
+}
+
+// formatFromExtension returns the output format for the file's extension
+// (png if it's unknown)
+func formatFromExtension(filename string) string {
+	if name, ok := formatExtensions[strings.ToLower(filepath.Ext(filename))]; ok {
+		return name
+	}
+	return "png"
+}
+
+// getOutputFormat returns the output format chosen with the flags, or by the
+// extension of the output file if there's no format flag
+func getOutputFormat(c *cli.Context, filename string) (*outputFormat, error) {
+	name := c.String("format")
+	if name == "" {
+		name = formatFromExtension(filename)
+	}
+	format := &outputFormat{
+		name: name,
+		exr: hdrimage.EXROptions{
+			PixelType:   c.String("exr-pixel-type"),
+			Compression: c.String("exr-compression"),
+		},
+		tones: tonemap.ToneMapper{Exposure: c.Float64("exposure")},
+	}
+
+	var err error
+	format.tones.Operator, err = tonemap.New(c.String("tone-map"))
+	if err != nil {
+		return nil, err
+	}
+	if balance := c.String("white-balance"); balance != "" {
+		format.tones.WhiteBalance, err = tonemap.WhiteBalance(balance)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return format, format.check()
+}
+
+// check returns an error if the format isn't supported
+func (f *outputFormat) check() error {
+	switch f.name {
+	case "png", "jpeg", "traytor_hdr", "hdr", "pfm":
+		return nil
+	case "exr":
+		return f.exr.Check()
+	default:
+		return fmt.Errorf("Unknown format: '%s'", f.name)
+	}
+}
 
+// saveImage writes the image to a file in the given format. If it can't be
+// written completely, the file is removed.
+func saveImage(image *hdrimage.Image, filename string, format *outputFormat) (err error) {
+	file, err := os.Create(filename)
 	if err != nil {
 		return fmt.Errorf("Error when saving image: %s", err)
 	}
+	defer func() {
+		if closeErr := file.Close(); err == nil && closeErr != nil {
+			err = fmt.Errorf("Error when saving image: %s", closeErr)
+		}
+		if err != nil {
+			os.Remove(filename)
+		}
+	}()
 
-	switch format {
+	switch format.name {
 	case "png":
-		err = png.Encode(file, image)
+		err = encodePNG(file, format.tones.Image(image), [][2]string{
+			{"Software", "traytor"},
+			{"Samples", fmt.Sprintf("%.1f", image.SamplesPerPixel())},
+		})
 		if err != nil {
 			return fmt.Errorf("Cannot encode png data: %s", err)
 		}
+	case "jpeg":
+		err = jpeg.Encode(file, format.tones.Image(image), &jpeg.Options{Quality: jpegQuality})
+		if err != nil {
+			return fmt.Errorf("Cannot encode jpeg data: %s", err)
+		}
 	case "traytor_hdr":
 		err = image.Encode(file)
 		if err != nil {
 			return fmt.Errorf("Cannot encode traytor_hdr data: %s", err)
 		}
+	case "exr":
+		options := format.exr
+		options.Attributes = [][2]string{
+			{"software", "traytor"},
+			{"samples", fmt.Sprintf("%.1f", image.SamplesPerPixel())},
+		}
+		if noise := image.NoiseImage(); noise != nil {
+			options.Layers = append(options.Layers, hdrimage.EXRLayer{
+				Name: "noise", Image: noise, Luminance: true,
+			})
+		}
+		err = image.EncodeEXR(file, &options)
+		if err != nil {
+			return fmt.Errorf("Cannot encode exr data: %s", err)
+		}
+	case "hdr":
+		err = image.EncodeRGBE(file)
+		if err != nil {
+			return fmt.Errorf("Cannot encode hdr data: %s", err)
+		}
+	case "pfm":
+		err = image.EncodePFM(file)
+		if err != nil {
+			return fmt.Errorf("Cannot encode pfm data: %s", err)
+		}
 	default:
-		return fmt.Errorf("Unknown format: %s", format)
+		return fmt.Errorf("Unknown format: '%s'", format.name)
 	}
 
 	return nil
 }
+
+// loadImage reads an image in the traytor_hdr, OpenEXR, Radiance or PFM
+// format (which is recognised by its contents). The layer is only used for
+// OpenEXR images.
+func loadImage(filename string, layer string) (*hdrimage.Image, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, []byte{0x76, 0x2f, 0x31, 0x01}) {
+		return hdrimage.DecodeEXRLayer(bytes.NewReader(data), layer)
+	}
+	if layer != "" {
+		return nil, fmt.Errorf("only exr images have layers")
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte("#?")):
+		return hdrimage.DecodeRGBE(bytes.NewReader(data))
+	case len(data) > 3 && (data[0] == 'P' && (data[1] == 'F' || data[1] == 'f')) &&
+		strings.ContainsRune(" \t\r\n", rune(data[2])):
+		return hdrimage.DecodePFM(bytes.NewReader(data))
+	default:
+		return hdrimage.Decode(bytes.NewReader(data))
+	}
+}
+
+// encodePNG writes the image as png, with tEXt chunks containing the given
+// keyword-text pairs right after the header
+func encodePNG(writer io.Writer, im image.Image, text [][2]string) error {
+	buffer := &bytes.Buffer{}
+	err := png.Encode(buffer, im)
+	if err != nil {
+		return err
+	}
+	data := buffer.Bytes()
+
+	// png signature + IHDR chunk (length, type, 13 bytes of data, crc)
+	const headerSize = 8 + 4 + 4 + 13 + 4
+	if _, err = writer.Write(data[:headerSize]); err != nil {
+		return err
+	}
+
+	for _, pair := range text {
+		chunk := append([]byte("tEXt"), pair[0]...)
+		chunk = append(chunk, 0)
+		chunk = append(chunk, pair[1]...)
+
+		err = binary.Write(writer, binary.BigEndian, uint32(len(chunk)-4))
+		if err != nil {
+			return err
+		}
+		if _, err = writer.Write(chunk); err != nil {
+			return err
+		}
+		err = binary.Write(writer, binary.BigEndian, crc32.ChecksumIEEE(chunk))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = writer.Write(data[headerSize:])
+	return err
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/DexterLB/traytor/hdrimage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveImageReportsErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "traytor-save")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	im := hdrimage.New(4, 3)
+
+	err = saveImage(im, filepath.Join(dir, "missing", "image.png"), &outputFormat{name: "png"})
+	if assert.Error(err) {
+		assert.True(strings.Contains(err.Error(), "no such file"), err.Error())
+	}
+
+	// the image can't be encoded, so no file is left behind
+	filename := filepath.Join(dir, "image.exr")
+	err = saveImage(im, filename, &outputFormat{name: "exr", exr: hdrimage.EXROptions{
+		Layers: []hdrimage.EXRLayer{{Name: "noise", Image: hdrimage.New(2, 2)}},
+	}})
+	assert.Error(err)
+	_, err = os.Stat(filename)
+	assert.True(os.IsNotExist(err))
+
+	assert.Nil(saveImage(im, filepath.Join(dir, "image.pfm"), &outputFormat{name: "pfm"}))
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/DexterLB/traytor/rpc"
+	"github.com/codegangsta/cli"
+)
+
+// tokenFlag is the pre-shared token of the workers
+var tokenFlag = cli.StringFlag{
+	Name:   "token",
+	Usage:  "pre-shared token which clients must present to workers",
+	EnvVar: "TRAYTOR_TOKEN",
+}
+
+// apiTokenFlag is the token which must be presented to HTTP APIs
+var apiTokenFlag = cli.StringFlag{
+	Name:   "api-token",
+	Usage:  "token which must be presented to the HTTP API (as a bearer token, or as the password of basic auth)",
+	EnvVar: "TRAYTOR_API_TOKEN",
+}
+
+// apiTLSCertFlag and apiTLSKeyFlag enable HTTPS for the HTTP APIs of the
+// commands which also connect to workers (their --tls-* flags are about
+// those connections)
+var apiTLSCertFlag = cli.StringFlag{
+	Name:  "api-tls-cert",
+	Usage: "certificate (PEM file) of the HTTP API; enables HTTPS",
+}
+var apiTLSKeyFlag = cli.StringFlag{
+	Name:  "api-tls-key",
+	Usage: "private key (PEM file) of the HTTP API's certificate",
+}
+
+// securityFlags configure how the commands which use workers connect to them
+var securityFlags = []cli.Flag{
+	cli.BoolFlag{
+		Name:  "tls",
+		Usage: "connect to workers over TLS (implied by the other --tls-* flags)",
+	},
+	cli.StringFlag{
+		Name:  "tls-ca",
+		Usage: "trust workers with certificates signed by this CA (PEM file) instead of the system's CAs",
+	},
+	cli.StringFlag{
+		Name:  "tls-cert",
+		Usage: "client certificate (PEM file) to present to workers",
+	},
+	cli.StringFlag{
+		Name:  "tls-key",
+		Usage: "private key (PEM file) of the client certificate",
+	},
+	tokenFlag,
+}
+
+// workerSecurityFlags configure which clients a worker accepts
+var workerSecurityFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:  "tls-cert",
+		Usage: "certificate (PEM file) of the worker; enables TLS",
+	},
+	cli.StringFlag{
+		Name:  "tls-key",
+		Usage: "private key (PEM file) of the worker's certificate",
+	},
+	cli.StringFlag{
+		Name:  "tls-ca",
+		Usage: "accept only clients with certificates signed by this CA (PEM file)",
+	},
+	tokenFlag,
+}
+
+// clientSecurity returns the security settings given by securityFlags
+func clientSecurity(c *cli.Context) (*rpc.Security, error) {
+	security := &rpc.Security{Token: c.String("token")}
+	if c.Bool("tls") || c.String("tls-ca") != "" || c.String("tls-cert") != "" {
+		config, err := rpc.ClientTLSConfig(c.String("tls-cert"), c.String("tls-key"), c.String("tls-ca"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid TLS settings: %s", err)
+		}
+		security.TLS = config
+	}
+	if security.Token != "" && security.TLS == nil {
+		return nil, fmt.Errorf("--token needs TLS (see --tls and --tls-ca), or it would be sent in plain text")
+	}
+	return security, nil
+}
+
+// workerTrust decides which workers are presented the token: the ones
+// given with --worker, and any worker with a certificate signed by the CA
+// from --tls-ca. Other workers (discovered ones, or ones added through an
+// HTTP API) could be anyone's, so they're connected to without the token.
+type workerTrust struct {
+	security   *rpc.Security
+	configured map[string]bool
+	verified   bool // workers' certificates are checked against --tls-ca
+}
+
+// clientTrust returns the security settings given by securityFlags, and
+// the workers which are trusted with the token
+func clientTrust(c *cli.Context) (*workerTrust, error) {
+	security, err := clientSecurity(c)
+	if err != nil {
+		return nil, err
+	}
+	trust := &workerTrust{
+		security:   security,
+		configured: make(map[string]bool),
+		verified:   c.String("tls-ca") != "",
+	}
+	for _, address := range c.StringSlice("worker") {
+		trust.configured[address] = true
+	}
+	return trust, nil
+}
+
+// forWorker returns the security settings with which to connect to the
+// worker with the given address
+func (t *workerTrust) forWorker(address string) *rpc.Security {
+	if t.security.Token == "" || t.verified || t.configured[address] {
+		return t.security
+	}
+	untrusted := *t.security
+	untrusted.Token = ""
+	return &untrusted
+}
+
+// workerSecurity returns the security settings given by workerSecurityFlags
+func workerSecurity(c *cli.Context) (*rpc.Security, error) {
+	security := &rpc.Security{Token: c.String("token")}
+	if c.String("tls-cert") != "" {
+		config, err := rpc.ServerTLSConfig(c.String("tls-cert"), c.String("tls-key"), c.String("tls-ca"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid TLS settings: %s", err)
+		}
+		security.TLS = config
+	} else if c.String("tls-ca") != "" {
+		return nil, fmt.Errorf("Invalid TLS settings: --tls-ca needs --tls-cert")
+	}
+	if security.Token != "" && security.TLS == nil {
+		return nil, fmt.Errorf("--token needs --tls-cert, or it would be sent in plain text")
+	}
+
+	if security.TLS == nil && !c.GlobalBool("quiet") {
+		log.Printf("warning: anyone who can reach the worker can use it (see --tls-cert and --token)")
+	}
+	return security, nil
+}
+
+// apiTLS returns the TLS settings of an HTTP API given by apiTLSCertFlag
+// and apiTLSKeyFlag
+// (nil for plain HTTP)
+func apiTLS(c *cli.Context) (*tls.Config, error) {
+	if c.String("api-tls-cert") == "" {
+		if c.String("api-tls-key") != "" {
+			return nil, fmt.Errorf("Invalid TLS settings: --api-tls-key needs --api-tls-cert")
+		}
+		return nil, nil
+	}
+	config, err := rpc.ServerTLSConfig(c.String("api-tls-cert"), c.String("api-tls-key"), "")
+	if err != nil {
+		return nil, fmt.Errorf("Invalid TLS settings: %s", err)
+	}
+	return config, nil
+}
+
+// requireToken returns a handler which serves only the requests presenting
+// the token, either as a bearer token or as the password of basic auth
+// (which browsers ask for). An empty token lets all requests through.
+func requireToken(handler http.Handler, token string) http.Handler {
+	if token == "" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		presented := r.Header.Get("Authorization")
+		if _, password, ok := r.BasicAuth(); ok {
+			presented = "Bearer " + password
+		}
+		if subtle.ConstantTimeCompare([]byte(presented), []byte("Bearer "+token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="traytor"`)
+			http.Error(w, "wrong token", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// checkListenAddress returns an error if an HTTP API would be reachable
+// from other hosts (i.e. the address isn't a loopback one) without a token,
+// or without TLS (which would send the token in plain text)
+func checkListenAddress(address string, token string, config *tls.Config) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("Invalid listen address: '%s'", address)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	if token == "" {
+		return fmt.Errorf("listening on '%s' makes the API reachable from other hosts, which needs an --api-token", address)
+	}
+	if config == nil {
+		return fmt.Errorf("listening on '%s' makes the API reachable from other hosts, which needs TLS, or the --api-token would be sent in plain text", address)
+	}
+	return nil
+}
+
+// serveAPI serves an HTTP API which requires the token (see requireToken),
+// over TLS if config isn't nil
+func serveAPI(address string, handler http.Handler, token string, config *tls.Config) error {
+	server := &http.Server{
+		Addr:      address,
+		Handler:   requireToken(handler, token),
+		TLSConfig: config,
+	}
+	if config == nil {
+		return server.ListenAndServe()
+	}
+	return server.ListenAndServeTLS("", "")
+}
+
+// apiURL returns the URL of an HTTP API served on the address
+func apiURL(address string, config *tls.Config) string {
+	if config == nil {
+		return fmt.Sprintf("http://%s/", address)
+	}
+	return fmt.Sprintf("https://%s/", address)
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRemoteAPIsNeedTokenAndTLS(t *testing.T) {
+	assert := assert.New(t)
+	config := &tls.Config{}
+
+	assert.Nil(checkListenAddress("localhost:8080", "", nil))
+	assert.Nil(checkListenAddress("127.0.0.1:8080", "", nil))
+	assert.Nil(checkListenAddress("[::1]:8080", "", nil))
+
+	assert.NotNil(checkListenAddress(":8080", "", nil))
+	assert.NotNil(checkListenAddress(":8080", "", config))
+	assert.NotNil(checkListenAddress("0.0.0.0:8080", "secret", nil))
+	assert.Nil(checkListenAddress("0.0.0.0:8080", "secret", config))
+
+	assert.NotNil(checkListenAddress("localhost", "secret", config))
+}
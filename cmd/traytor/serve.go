@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DexterLB/traytor/filter"
+	"github.com/DexterLB/traytor/hdrimage"
+	"github.com/DexterLB/traytor/rpc"
+	"github.com/DexterLB/traytor/scene"
+	"github.com/DexterLB/traytor/sequence"
+	"github.com/codegangsta/cli"
+)
+
+// maxSceneSize is the largest scene which can be uploaded to the server (the
+// same as to workers)
+const maxSceneSize = rpc.MaxSceneSize
+
+// maxUploadedScenes and maxUploadedSize bound the scenes kept by the server
+// after they're uploaded: the oldest ones are dropped to make room for new
+// ones
+const (
+	maxUploadedScenes = 16
+	maxUploadedSize   = 2 * maxSceneSize
+)
+
+// maxRenderRequestSize bounds the body of a request to start a render, which
+// names a scene and the workers
+const maxRenderRequestSize = 1 << 20
+
+// errRenderRunning is returned when starting a render while another one
+// is running
+var errRenderRunning = errors.New("a render is already running")
+
+// serveRequest describes a render started through the web interface
+type serveRequest struct {
+	Scene   string   `json:"scene"`
+	Workers []string `json:"workers"` // render locally if empty
+	Width   int      `json:"width"`
+	Height  int      `json:"height"`
+	Samples int      `json:"samples"`
+	Sampler string   `json:"sampler"`
+	Filter  string   `json:"filter"`
+}
+
+// serveStatus describes the running (or last) render
+type serveStatus struct {
+	Running      bool    `json:"running"`
+	Scene        string  `json:"scene"`
+	Workers      int     `json:"workers"`
+	Samples      float64 `json:"samples"`
+	TotalSamples int     `json:"total_samples"`
+	Elapsed      string  `json:"elapsed"`
+	Version      int     `json:"version"` // changes whenever the image changes
+	Error        string  `json:"error,omitempty"`
+}
+
+// server is a web interface for rendering scenes locally or on workers
+type server struct {
+	sceneDir string
+	workers  []string
+	threads  int
+	trust    *workerTrust
+
+	mutex    sync.Mutex
+	uploaded map[string][]byte
+	status   serveStatus
+	started  time.Time
+	stop     chan struct{}
+	image    []byte // the latest image, as png
+
+	// running renders the current render on workers (nil if it's rendered
+	// locally or there isn't one), and runningScene is the scene it renders
+	running      *workerRenderer
+	runningScene []byte
+
+	// uploadOrder contains the names of the uploaded scenes, oldest first
+	uploadOrder []string
+}
+
+func runServe(c *cli.Context) error {
+	s := &server{
+		sceneDir: c.String("scenes"),
+		workers:  c.StringSlice("worker"),
+		threads:  c.Int("max-jobs"),
+		uploaded: make(map[string][]byte),
+	}
+	if s.threads < 1 {
+		s.threads = 1
+	}
+	trust, err := clientTrust(c)
+	if err != nil {
+		return err
+	}
+	s.trust = trust
+
+	if c.Bool("discover") {
+		go watchForWorkers(s.workers, c.String("discovery-group"), s.addWorker, nil, nil)
+	}
+
+	address, token := c.String("listen-address"), c.String("api-token")
+	config, err := apiTLS(c)
+	if err != nil {
+		return err
+	}
+	if err := checkListenAddress(address, token, config); err != nil {
+		return err
+	}
+	if !c.GlobalBool("quiet") {
+		log.Printf("serving the web interface on %s", apiURL(address, config))
+	}
+	if err := serveAPI(address, s.handler(), token, config); err != nil {
+		return fmt.Errorf("Cannot start http server: %s", err)
+	}
+	return nil
+}
+
+// handler returns the http handler for the web interface and its API
+func (s *server) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", s.handlePage)
+	mux.HandleFunc("/api/scenes", s.handleScenes)
+	mux.HandleFunc("/api/workers", s.handleWorkers)
+	mux.HandleFunc("/api/render", s.handleRender)
+	mux.HandleFunc("/api/stop", s.handleStop)
+	mux.HandleFunc("/api/status", s.handleStatus)
+	mux.HandleFunc("/api/image.png", s.handleImage)
+	mux.HandleFunc("/api/events", s.handleEvents)
+	return mux
+}
+
+func (s *server) handlePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	fmt.Fprint(w, servePage)
+}
+
+// handleScenes lists the available scenes (GET), or uploads a scene with
+// the name given in the "name" parameter (POST)
+func (s *server) handleScenes(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		writeJSON(w, s.scenes())
+	case "POST":
+		name := r.URL.Query().Get("name")
+		if name == "" || filepath.Base(name) != name {
+			http.Error(w, fmt.Sprintf("Invalid scene name: '%s'", name), http.StatusBadRequest)
+			return
+		}
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxSceneSize))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("can't read scene: %s", err), http.StatusBadRequest)
+			return
+		}
+		if _, err := scene.LoadFromBytes(data); err != nil {
+			http.Error(w, fmt.Sprintf("can't load scene: %s", err), http.StatusBadRequest)
+			return
+		}
+		s.mutex.Lock()
+		s.keepUpload(name, data)
+		s.mutex.Unlock()
+		writeJSON(w, s.scenes())
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// keepUpload stores an uploaded scene (replacing one with the same name),
+// dropping the oldest ones if there are too many or they're too large. The
+// mutex must be held.
+func (s *server) keepUpload(name string, data []byte) {
+	s.dropUpload(name)
+	for len(s.uploadOrder) > 0 &&
+		(len(s.uploadOrder) >= maxUploadedScenes || s.uploadedSize()+len(data) > maxUploadedSize) {
+		s.dropUpload(s.uploadOrder[0])
+	}
+	s.uploaded[name] = data
+	s.uploadOrder = append(s.uploadOrder, name)
+}
+
+// dropUpload forgets an uploaded scene (a render which uses it keeps its
+// data). The mutex must be held.
+func (s *server) dropUpload(name string) {
+	delete(s.uploaded, name)
+	for i := range s.uploadOrder {
+		if s.uploadOrder[i] == name {
+			s.uploadOrder = append(s.uploadOrder[:i], s.uploadOrder[i+1:]...)
+			break
+		}
+	}
+}
+
+// uploadedSize returns the total size of the uploaded scenes. The mutex must
+// be held.
+func (s *server) uploadedSize() int {
+	size := 0
+	for _, data := range s.uploaded {
+		size += len(data)
+	}
+	return size
+}
+
+// handleWorkers lists the known workers (GET), or adds the worker with the
+// address given in the "address" parameter (POST). A worker added while
+// a render is running on workers joins the render.
+func (s *server) handleWorkers(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "POST":
+		address := r.URL.Query().Get("address")
+		if address == "" {
+			http.Error(w, "missing worker address", http.StatusBadRequest)
+			return
+		}
+		if err := s.addWorker(address); err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mutex.Lock()
+	workers := s.workers
+	s.mutex.Unlock()
+	writeJSON(w, workers)
+}
+
+// handleRender starts a render described by a serveRequest
+func (s *server) handleRender(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	request := &serveRequest{Width: 800, Height: 450, Samples: 100}
+	body := http.MaxBytesReader(w, r.Body, maxRenderRequestSize)
+	if err := json.NewDecoder(body).Decode(request); err != nil {
+		http.Error(w, fmt.Sprintf("can't read request: %s", err), http.StatusBadRequest)
+		return
+	}
+	if err := s.start(request); err == errRenderRunning {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, s.currentStatus())
+}
+
+func (s *server) handleStop(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mutex.Lock()
+	if s.status.Running && s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	s.mutex.Unlock()
+	writeJSON(w, s.currentStatus())
+}
+
+func (s *server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, s.currentStatus())
+}
+
+func (s *server) handleImage(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	image := s.image
+	s.mutex.Unlock()
+
+	if image == nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(image)
+}
+
+// handleEvents sends the status as a server-sent event whenever it changes
+func (s *server) handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	var last []byte
+	for {
+		data, err := json.Marshal(s.currentStatus())
+		if err != nil {
+			return
+		}
+		if !bytes.Equal(data, last) {
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+			last = data
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// addWorker adds a worker to the ones which can be selected, and to the
+// running render (if it's rendered on workers)
+func (s *server) addWorker(address string) error {
+	s.mutex.Lock()
+	known := false
+	for _, worker := range s.workers {
+		known = known || worker == address
+	}
+	if !known {
+		s.workers = append(append([]string(nil), s.workers...), address)
+	}
+	running, data := s.running, s.runningScene
+	s.mutex.Unlock()
+
+	if running == nil || running.has(address) {
+		return nil
+	}
+	w, err := connectWorker(address, data, s.trust, false)
+	if err != nil {
+		return fmt.Errorf("can't add worker to the render: %s", err)
+	}
+	if !running.add(w) {
+		// the render has finished, or the worker has been added meanwhile
+		w.caller.Close()
+		return nil
+	}
+	s.mutex.Lock()
+	s.status.Workers++
+	s.status.Version++
+	s.mutex.Unlock()
+	return nil
+}
+
+// scenes returns the names of the uploaded scenes and the scenes in the
+// scene directory
+func (s *server) scenes() []string {
+	names := make(map[string]bool)
+
+	files, _ := ioutil.ReadDir(s.sceneDir)
+	for _, file := range files {
+		if strings.HasSuffix(file.Name(), ".json.gz") {
+			names[file.Name()] = true
+		}
+	}
+
+	s.mutex.Lock()
+	for name := range s.uploaded {
+		names[name] = true
+	}
+	s.mutex.Unlock()
+
+	result := make([]string, 0, len(names))
+	for name := range names {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// sceneData returns the contents of an uploaded scene or a scene from the
+// scene directory
+func (s *server) sceneData(name string) ([]byte, error) {
+	s.mutex.Lock()
+	data, ok := s.uploaded[name]
+	s.mutex.Unlock()
+	if ok {
+		return data, nil
+	}
+
+	if name == "" || filepath.Base(name) != name {
+		return nil, fmt.Errorf("Invalid scene name: '%s'", name)
+	}
+	return ioutil.ReadFile(filepath.Join(s.sceneDir, name))
+}
+
+// currentStatus returns a copy of the status
+func (s *server) currentStatus() serveStatus {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	status := s.status
+	if !s.started.IsZero() && status.Running {
+		status.Elapsed = time.Since(s.started).String()
+	}
+	return status
+}
+
+// start begins a render in the background, unless one is already running
+func (s *server) start(request *serveRequest) error {
+	if _, err := sequence.New(request.Sampler, 0); err != nil {
+		return err
+	}
+	if _, err := filter.New(request.Filter, 0); err != nil {
+		return err
+	}
+	if err := hdrimage.CheckSize(request.Width, request.Height); err != nil {
+		return err
+	}
+	if request.Samples < 1 {
+		return fmt.Errorf("samples must be positive")
+	}
+	data, err := s.sceneData(request.Scene)
+	if err != nil {
+		return fmt.Errorf("can't open scene: %s", err)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.status.Running {
+		return errRenderRunning
+	}
+
+	s.stop = make(chan struct{})
+	s.started = time.Now()
+	s.status = serveStatus{
+		Running:      true,
+		Scene:        request.Scene,
+		Workers:      len(request.Workers),
+		TotalSamples: request.Samples,
+		Version:      s.status.Version + 1,
+	}
+	go s.render(request, data, s.stop)
+	return nil
+}
+
+// render renders the scene and publishes the image while it's refined
+func (s *server) render(request *serveRequest, data []byte, stop chan struct{}) {
+	renderer, err := s.renderer(request, data)
+	if err != nil {
+		s.finish(nil, fmt.Sprintf("%s", err))
+		return
+	}
+	if workers, ok := renderer.(*workerRenderer); ok {
+		workers.stop = stop
+		s.mutex.Lock()
+		s.running, s.runningScene = workers, data
+		s.mutex.Unlock()
+	}
+
+	settings := rpc.SampleSettings{
+		Width:         request.Width,
+		Height:        request.Height,
+		SamplesAtOnce: 1,
+		Sequence:      request.Sampler,
+		Filter:        request.Filter,
+		Indexed:       true,
+	}
+	limits := &renderLimits{totalSamples: request.Samples, stop: stop}
+	previews := &previewer{interval: time.Second, publish: s.publish}
+
+	image := renderWithLimits(settings, limits, true, nil, previews, renderer)
+	if workers, ok := renderer.(*workerRenderer); ok {
+		workers.close()
+	}
+	s.finish(image, "")
+}
+
+// renderer returns a renderer for the request: on its workers if it has any,
+// otherwise on a local raytracer
+func (s *server) renderer(request *serveRequest, data []byte) (roundRenderer, error) {
+	if len(request.Workers) > 0 {
+		workers, err := connectWorkers(request.Workers, data, s.trust, false)
+		if err != nil {
+			return nil, err
+		}
+		return newWorkerRenderer(workers, false), nil
+	}
+
+	scene, err := scene.LoadFromBytes(data)
+	if err != nil {
+		return nil, fmt.Errorf("can't open scene: %s", err)
+	}
+	scene.Init()
+	return &localRenderer{raytracer: rpc.NewConcurrentRaytracer(s.threads, scene, 42)}, nil
+}
+
+// publish makes the image available to the web interface
+func (s *server) publish(image *hdrimage.Image) {
+	buffer := &bytes.Buffer{}
+	err := encodePNG(buffer, image, [][2]string{
+		{"Software", "traytor"},
+		{"Samples", fmt.Sprintf("%.1f", image.SamplesPerPixel())},
+	})
+	if err != nil {
+		log.Printf("can't encode image: %s", err)
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.image = buffer.Bytes()
+	s.status.Samples = image.SamplesPerPixel()
+	s.status.Version++
+}
+
+// finish marks the render as finished, publishing its final image
+func (s *server) finish(image *hdrimage.Image, message string) {
+	if image != nil && image.Width != 0 && image.Divisor != 0 {
+		s.publish(image)
+	}
+	if message != "" {
+		log.Printf("render failed: %s", message)
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.status.Running = false
+	s.status.Elapsed = time.Since(s.started).String()
+	s.status.Error = message
+	s.status.Version++
+	s.stop = nil
+	s.running, s.runningScene = nil, nil
+}
+
+// writeJSON writes a value as a JSON response
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("can't write response: %s", err)
+	}
+}
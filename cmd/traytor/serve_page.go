@@ -0,0 +1,140 @@
+package main
+
+// servePage is the web interface of the serve command. It uses the JSON API
+// and follows the render through server-sent events.
+const servePage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>traytor</title>
+<style>
+body { font-family: sans-serif; margin: 2em; background: #222; color: #ddd; }
+fieldset { border: 1px solid #555; margin-bottom: 1em; }
+label { display: inline-block; margin-right: 1em; }
+input[type=number] { width: 5em; }
+button { font-size: 1em; padding: 0.3em 1em; }
+#render { font-size: 2em; padding: 0.5em 2em; }
+#image { display: block; margin-top: 1em; max-width: 100%; image-rendering: pixelated; }
+#error { color: #f66; }
+</style>
+</head>
+<body>
+<h1>traytor</h1>
+
+<fieldset>
+<legend>Scene</legend>
+<select id="scene"></select>
+<input type="file" id="upload" accept=".gz">
+</fieldset>
+
+<fieldset>
+<legend>Workers (render locally if none are selected)</legend>
+<div id="workers"></div>
+<label>other: <input type="text" id="extra-workers" placeholder="host:1234, host:1235"></label>
+</fieldset>
+
+<fieldset>
+<legend>Settings</legend>
+<label>width <input type="number" id="width" value="800"></label>
+<label>height <input type="number" id="height" value="450"></label>
+<label>samples <input type="number" id="samples" value="100"></label>
+<label>sampler <select id="sampler">
+  <option>random</option><option>stratified</option><option>halton</option>
+  <option>sobol</option><option>bluenoise</option>
+</select></label>
+<label>filter <select id="filter">
+  <option>box</option><option>tent</option><option>gaussian</option>
+  <option>mitchell</option><option>blackman-harris</option>
+</select></label>
+</fieldset>
+
+<button id="render">RENDER</button>
+<button id="stop">stop</button>
+<span id="status"></span>
+<div id="error"></div>
+<img id="image" alt="">
+
+<script>
+function $(id) { return document.getElementById(id); }
+
+function check(response) {
+  if (!response.ok) {
+    return response.text().then(function(text) { throw new Error(text); });
+  }
+  return response.json();
+}
+
+function showError(err) { $('error').textContent = err ? err.message || err : ''; }
+
+function loadScenes(scenes) {
+  var select = $('scene'), selected = select.value;
+  select.innerHTML = '';
+  scenes.forEach(function(name) {
+    var option = document.createElement('option');
+    option.textContent = name;
+    select.appendChild(option);
+  });
+  if (selected) { select.value = selected; }
+}
+
+fetch('/api/scenes').then(check).then(loadScenes).catch(showError);
+
+fetch('/api/workers').then(check).then(function(workers) {
+  (workers || []).forEach(function(address) {
+    var label = document.createElement('label');
+    label.innerHTML = '<input type="checkbox" class="worker" checked> ';
+    label.firstChild.value = address;
+    label.appendChild(document.createTextNode(address));
+    $('workers').appendChild(label);
+  });
+}).catch(showError);
+
+$('upload').onchange = function() {
+  var file = this.files[0];
+  if (!file) { return; }
+  fetch('/api/scenes?name=' + encodeURIComponent(file.name), {method: 'POST', body: file})
+    .then(check).then(function(scenes) {
+      loadScenes(scenes);
+      $('scene').value = file.name;
+      showError();
+    }).catch(showError);
+};
+
+$('render').onclick = function() {
+  var workers = [];
+  document.querySelectorAll('.worker:checked').forEach(function(box) { workers.push(box.value); });
+  $('extra-workers').value.split(',').forEach(function(address) {
+    address = address.trim();
+    if (address) { workers.push(address); }
+  });
+  fetch('/api/render', {method: 'POST', body: JSON.stringify({
+    scene: $('scene').value,
+    workers: workers,
+    width: +$('width').value,
+    height: +$('height').value,
+    samples: +$('samples').value,
+    sampler: $('sampler').value,
+    filter: $('filter').value
+  })}).then(check).then(function() { showError(); }).catch(showError);
+};
+
+$('stop').onclick = function() {
+  fetch('/api/stop', {method: 'POST'}).then(check).catch(showError);
+};
+
+var imageVersion = -1;
+new EventSource('/api/events').onmessage = function(event) {
+  var status = JSON.parse(event.data);
+  $('status').textContent = (status.running ? 'rendering ' : 'rendered ') +
+    (status.scene || '') + ': ' + status.samples.toFixed(1) + '/' +
+    status.total_samples + ' samples' + (status.elapsed ? ' in ' + status.elapsed : '');
+  if (status.error) { showError(status.error); }
+  if (status.version !== imageVersion && status.samples > 0) {
+    imageVersion = status.version;
+    $('image').src = '/api/image.png?version=' + status.version;
+  }
+};
+</script>
+</body>
+</html>
+`
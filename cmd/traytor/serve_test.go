@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestServerDropsOldestUploads(t *testing.T) {
+	assert := assert.New(t)
+	s := &server{uploaded: make(map[string][]byte)}
+
+	for i := 0; i <= maxUploadedScenes; i++ {
+		s.keepUpload(fmt.Sprintf("scene%d.json.gz", i), []byte{byte(i)})
+	}
+	assert.Equal(maxUploadedScenes, len(s.uploaded))
+	_, kept := s.uploaded["scene0.json.gz"]
+	assert.False(kept)
+
+	// uploading a scene again makes it the newest
+	s.keepUpload("scene1.json.gz", []byte{1})
+	assert.Equal(maxUploadedScenes, len(s.uploaded))
+	assert.Equal("scene2.json.gz", s.uploadOrder[0])
+	assert.Equal("scene1.json.gz", s.uploadOrder[len(s.uploadOrder)-1])
+}
+
+func TestServerRejectsHugeRenderRequests(t *testing.T) {
+	assert := assert.New(t)
+	s := &server{uploaded: make(map[string][]byte)}
+
+	body := `{"scene": "` + strings.Repeat("a", maxRenderRequestSize) + `"}`
+	response := httptest.NewRecorder()
+	s.handleRender(response, httptest.NewRequest("POST", "/api/render", strings.NewReader(body)))
+	assert.Equal(http.StatusBadRequest, response.Code)
+	assert.Contains(response.Body.String(), "can't read request")
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"log"
+	"sync"
+
+	"github.com/DexterLB/mvm/progress"
+	"github.com/DexterLB/traytor/hdrimage"
+	"github.com/DexterLB/traytor/rpc"
+)
+
+// tileSampler renders samples of the tile given in the settings
+type tileSampler func(settings *rpc.SampleSettings) (*hdrimage.Tile, error)
+
+// tileSource is something which renders tiles: a local raytracer or a worker
+type tileSource struct {
+	name     string
+	parallel int // number of tiles rendered at once
+	samples  int // maximum samples per pixel rendered at once
+	sample   tileSampler
+	// fail (if not nil) handles a failed request, and returns true if the
+	// source should keep rendering. Sources without it stop at the first
+	// failure.
+	fail func(err error) bool
+}
+
+// tiles splits a region of an image into square tiles with the given size,
+// ordered from left to right and from top to bottom. The tiles at the right
+// and bottom edges may be smaller.
+func tiles(region image.Rectangle, size int) []image.Rectangle {
+	var result []image.Rectangle
+	for y := region.Min.Y; y < region.Max.Y; y += size {
+		for x := region.Min.X; x < region.Max.X; x += size {
+			result = append(result, image.Rect(x, y, x+size, y+size).Intersect(region))
+		}
+	}
+	return result
+}
+
+// tileQueue hands out samples of tiles, finishing each tile before
+// going on to the next one. Samples which fail are given back, and are
+// handed out again before any others.
+type tileQueue struct {
+	mutex     sync.Mutex
+	changed   *sync.Cond // signalled when samples are finished or given back
+	tiles     []image.Rectangle
+	samples   int // samples per pixel for each tile
+	limits    *renderLimits
+	current   int
+	handedOut int // samples handed out for the current tile
+	rendering int // handed out samples which aren't finished yet
+	returned  []tileSamples
+}
+
+// tileSamples are samples of a tile
+type tileSamples struct {
+	tile    image.Rectangle
+	samples rpc.SampleRange
+}
+
+// newTileQueue returns a queue which gives each of the tiles the given
+// number of samples per pixel
+func newTileQueue(tiles []image.Rectangle, samples int, limits *renderLimits) *tileQueue {
+	q := &tileQueue{tiles: tiles, samples: samples, limits: limits}
+	q.changed = sync.NewCond(&q.mutex)
+	return q
+}
+
+// next returns the tile which should be sampled next, and the samples to
+// render on it (at most maxSamples). Every tile gets the samples with
+// indices from 0. It returns no samples when all tiles are finished or the
+// time limit is reached. While the last samples are being rendered, it
+// waits in case they're given back. Each call which returns samples must
+// be followed by a call of done.
+func (q *tileQueue) next(maxSamples int) (image.Rectangle, rpc.SampleRange) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for {
+		if q.limits.expired() {
+			return image.Rectangle{}, rpc.SampleRange{}
+		}
+		if len(q.returned) > 0 {
+			return q.handOutReturned(maxSamples)
+		}
+
+		if q.handedOut >= q.samples && q.current < len(q.tiles) {
+			q.current++
+			q.handedOut = 0
+		}
+		if q.current < len(q.tiles) {
+			samples := rpc.SampleRange{First: q.handedOut, Count: q.samples - q.handedOut}
+			if samples.Count > maxSamples {
+				samples.Count = maxSamples
+			}
+			q.handedOut += samples.Count
+			q.rendering++
+			return q.tiles[q.current], samples
+		}
+
+		if q.rendering == 0 {
+			return image.Rectangle{}, rpc.SampleRange{}
+		}
+		q.changed.Wait()
+	}
+}
+
+// handOutReturned hands out at most maxSamples of the first samples
+// which have been given back. The mutex must be held.
+func (q *tileQueue) handOutReturned(maxSamples int) (image.Rectangle, rpc.SampleRange) {
+	returned := &q.returned[0]
+	samples := returned.samples
+	if samples.Count > maxSamples {
+		samples.Count = maxSamples
+	}
+	returned.samples.First += samples.Count
+	returned.samples.Count -= samples.Count
+	tile := returned.tile
+	if returned.samples.Count == 0 {
+		q.returned = q.returned[1:]
+	}
+	q.rendering++
+	return tile, samples
+}
+
+// done marks samples returned by next as finished. If they have failed,
+// they're given back, to be handed out again.
+func (q *tileQueue) done(tile image.Rectangle, samples rpc.SampleRange, failed bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.rendering--
+	if failed {
+		q.returned = append(q.returned, tileSamples{tile: tile, samples: samples})
+	}
+	q.changed.Broadcast()
+}
+
+// checkTileLimits returns an error if the limits can't be used when
+// rendering tiles: each tile needs a known number of samples (and since
+// tiles are finished one by one, there's nothing to checkpoint)
+func checkTileLimits(limits *renderLimits, checkpoints *checkpointer) error {
+	if checkpoints != nil {
+		return fmt.Errorf("checkpoints can't be used with tiles")
+	}
+	if limits.noiseThreshold > 0 || limits.adaptiveThreshold > 0 {
+		return fmt.Errorf("noise and adaptive thresholds can't be used with tiles")
+	}
+	if limits.totalSamples <= 0 {
+		return fmt.Errorf("tiles need a limited number of samples")
+	}
+	return nil
+}
+
+// renderTiles splits the image into tiles and renders them one after another
+// on the given sources, stitching them into the frame. The samples of failed
+// requests are rendered again by the sources which are still working. If the
+// time limit is reached (or all sources fail), the unfinished tiles are left
+// black. Previews (if any) count
+// the samples of each tile.
+func renderTiles(
+	settings rpc.SampleSettings,
+	tileSize int,
+	limits *renderLimits,
+	quiet bool,
+	previews *previewer,
+	sources []*tileSource,
+) *hdrimage.Image {
+	frame := hdrimage.New(settings.Width, settings.Height)
+	frame.Divisor = 0
+
+	region := renderedRegion(&settings)
+	queue := newTileQueue(tiles(region, tileSize), limits.totalSamples, limits)
+
+	var bar *progress.ProgressBar
+	if !quiet {
+		bar = progress.StartProgressBar(
+			len(queue.tiles)*limits.totalSamples,
+			fmt.Sprintf("rendering %d tiles ", len(queue.tiles)),
+		)
+	}
+
+	var stitch sync.Mutex
+	pixelSamples := 0
+
+	previews.start(func() *hdrimage.Image {
+		stitch.Lock()
+		defer stitch.Unlock()
+		snapshot := mergeImages(settings.Width, settings.Height, frame)
+		snapshot.Divisor = 1 // the stitched pixels have weights
+		return snapshot
+	})
+
+	wg := sync.WaitGroup{}
+	for _, source := range sources {
+		wg.Add(source.parallel)
+		for i := 0; i < source.parallel; i++ {
+			go func(source *tileSource) {
+				defer wg.Done()
+
+				settings := settings
+				for {
+					bounds, samples := queue.next(source.samples)
+					if samples.Count == 0 {
+						return
+					}
+					settings.Tile = bounds
+					settings.SamplesAtOnce = samples.Count
+					settings.FirstSample = samples.First
+
+					tile, err := source.sample(&settings)
+					queue.done(bounds, samples, err != nil)
+					if err != nil {
+						if source.fail == nil {
+							log.Printf("can't render tile on %s: %s", source.name, err)
+							return
+						}
+						if !source.fail(err) {
+							return
+						}
+						continue
+					}
+
+					stitch.Lock()
+					frame.AddTile(tile)
+					pixelSamples += samples.Count * bounds.Dx() * bounds.Dy()
+					stitch.Unlock()
+
+					if bar != nil {
+						bar.Add(samples.Count)
+					}
+					previews.progress(samples.Count)
+				}
+			}(source)
+		}
+	}
+	wg.Wait()
+	previews.stop()
+
+	if bar != nil {
+		bar.Done()
+	}
+
+	if pixelSamples > 0 {
+		area := region.Dx() * region.Dy()
+		frame.Divisor = (pixelSamples + area - 1) / area
+	}
+	return frame
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"sync"
+	"testing"
+
+	"github.com/DexterLB/traytor/hdrimage"
+	"github.com/DexterLB/traytor/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFailedTilesAreRenderedAgain(t *testing.T) {
+	assert := assert.New(t)
+
+	var mutex sync.Mutex
+	rendered := make(map[image.Rectangle][]int)
+	requests := 0
+	sample := func(settings *rpc.SampleSettings) (*hdrimage.Tile, error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		requests++
+		if requests%3 == 0 {
+			return nil, errors.New("flaky worker")
+		}
+		for i := 0; i < settings.SamplesAtOnce; i++ {
+			rendered[settings.Tile] = append(rendered[settings.Tile], settings.FirstSample+i)
+		}
+		tile := hdrimage.NewTile(settings.Tile)
+		tile.Image.Divisor = settings.SamplesAtOnce
+		return tile, nil
+	}
+	failures := 0
+	sources := []*tileSource{
+		{name: "flaky", parallel: 2, samples: 2, sample: sample, fail: func(err error) bool {
+			mutex.Lock()
+			defer mutex.Unlock()
+			failures++
+			return true
+		}},
+		{name: "broken", parallel: 1, samples: 1, sample: func(*rpc.SampleSettings) (*hdrimage.Tile, error) {
+			return nil, errors.New("broken worker")
+		}},
+	}
+
+	settings := rpc.SampleSettings{Width: 4, Height: 4}
+	limits := &renderLimits{totalSamples: 5}
+	frame := renderTiles(settings, 2, limits, true, nil, sources)
+
+	assert.NotEqual(0, failures)
+	assert.Equal(4, len(rendered))
+	for tile, samples := range rendered {
+		counts := make([]int, limits.totalSamples)
+		for _, sample := range samples {
+			counts[sample]++
+		}
+		assert.Equal([]int{1, 1, 1, 1, 1}, counts, "samples of %s", tile)
+	}
+	assert.Equal(5, frame.Divisor)
+}
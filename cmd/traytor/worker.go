@@ -1,12 +1,16 @@
 package main
 
 import (
+	"crypto/tls"
 	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/DexterLB/traytor/rpc"
 	"github.com/codegangsta/cli"
-	"github.com/valyala/gorpc"
 )
 
 func runWorker(c *cli.Context) error {
@@ -22,6 +26,15 @@ func runWorker(c *cli.Context) error {
 	}
 
 	address := c.String("listen-address")
+	security, err := workerSecurity(c)
+	if err != nil {
+		return err
+	}
+	if metricsAddress := c.String("metrics-address"); metricsAddress != "" {
+		if err := checkMetricsToken(c, metricsAddress, security.TLS); err != nil {
+			return err
+		}
+	}
 
 	rr := rpc.NewRemoteRaytracer(
 		time.Now().Unix(),
@@ -29,15 +42,117 @@ func runWorker(c *cli.Context) error {
 		c.Int("max-requests"),
 		c.Int("multisample"),
 	)
+	rr.Raytracer.Scenes.MaxScenes = c.Int("max-scenes")
+	rr.Raytracer.Scenes.MaxMemory = int64(c.Int("max-scene-memory")) << 20
 
-	w := &gorpc.Server{
-		Addr:    address,
-		Handler: rr.Dispatcher.NewHandlerFunc(),
-	}
+	w := security.NewServer(address, rr.Dispatcher.NewHandlerFunc())
 
-	if err := w.Serve(); err != nil {
+	if err := w.Start(); err != nil {
 		return fmt.Errorf("Cannot start rpc server: %s", err)
 	}
+	defer w.Stop()
+
+	stopExpiring := make(chan struct{})
+	defer close(stopExpiring)
+	go expireAbandoned(rr, quiet, stopExpiring)
+
+	if metricsAddress := c.String("metrics-address"); metricsAddress != "" {
+		go serveMetrics(metricsAddress, rr, c.String("api-token"), security.TLS)
+	}
 
+	stopAnnouncing := make(chan struct{})
+	if c.BoolT("announce") {
+		go func() {
+			err := rpc.Announce(
+				&rpc.Announcement{
+					Address:           address,
+					Threads:           c.Int("max-jobs"),
+					MaxRequestsAtOnce: c.Int("max-requests"),
+					MaxSamplesAtOnce:  c.Int("multisample"),
+				},
+				c.String("discovery-group"),
+				time.Second,
+				stopAnnouncing,
+				func(err error) {
+					log.Printf("can't announce worker (will keep trying): %s", err)
+				},
+			)
+			if err != nil {
+				log.Printf("can't announce worker: %s", err)
+			}
+		}()
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+
+	if !quiet {
+		fmt.Printf("leaving: waiting for clients to collect the stored samples\n")
+	}
+	close(stopAnnouncing)
+	rr.Leave()
+	leave(rr, c.Duration("leave-timeout"), signals)
 	return nil
 }
+
+// checkMetricsToken returns an error if the metrics would be reachable from
+// other hosts without an API token or TLS, or if the API token is the
+// worker's RPC token (which would let anyone who scrapes the metrics render
+// on the worker)
+func checkMetricsToken(c *cli.Context, address string, config *tls.Config) error {
+	token := c.String("api-token")
+	if token != "" && token == c.String("token") {
+		return fmt.Errorf("--api-token must differ from --token, or it would give access to the worker")
+	}
+	return checkListenAddress(address, token, config)
+}
+
+// expireAbandoned drops the samples stored by abandoned renders every
+// minute, until stop is closed
+func expireAbandoned(rr *rpc.RemoteRaytracer, quiet bool, stop <-chan struct{}) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if expired := rr.ExpireAbandoned(); expired > 0 && !quiet {
+			log.Printf("dropped the stored samples of %d abandoned renders", expired)
+		}
+	}
+}
+
+// leaveGrace is the time for which a leaving worker stays idle before it
+// stops, so that clients can find out that it's leaving
+const leaveGrace = 2 * time.Second
+
+// leave waits until the worker has been idle for leaveGrace, the timeout
+// runs out, or another signal arrives
+func leave(rr *rpc.RemoteRaytracer, timeout time.Duration, signals <-chan os.Signal) {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	var idleSince time.Time
+	for {
+		select {
+		case <-signals:
+			return
+		case <-deadline:
+			log.Printf("leaving before all samples have been collected")
+			return
+		case <-ticker.C:
+		}
+
+		if !rr.Idle() {
+			idleSince = time.Time{}
+		} else if idleSince.IsZero() {
+			idleSince = time.Now()
+		} else if time.Since(idleSince) >= leaveGrace {
+			return
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/DexterLB/traytor/rpc"
+	"github.com/codegangsta/cli"
+)
+
+// statsTimeout is the time in which workers must report their statistics
+const statsTimeout = 5 * time.Second
+
+// rateInterval is the time over which the rays per second of workers are
+// measured
+const rateInterval = time.Second
+
+// workerStatus is the status of a worker, or the error when asking for it
+type workerStatus struct {
+	address string
+	stats   *rpc.WorkerStats
+	err     error
+}
+
+func runWorkers(c *cli.Context) error {
+	addresses := c.StringSlice("worker")
+	if c.Bool("discover") {
+		var err error
+		addresses, err = discoverWorkers(
+			addresses,
+			c.String("discovery-group"),
+			c.Duration("discover-timeout"),
+			true,
+		)
+		if err != nil {
+			log.Printf("%s", err)
+		}
+	}
+	if len(addresses) == 0 {
+		showError(c, "give the addresses of the workers (or --discover them)")
+	}
+
+	trust, err := clientTrust(c)
+	if err != nil {
+		return err
+	}
+
+	statuses := make([]workerStatus, len(addresses))
+	var wg sync.WaitGroup
+	for i := range addresses {
+		wg.Add(1)
+		go func(status *workerStatus, address string) {
+			defer wg.Done()
+			status.address = address
+			caller := rpc.NewRemoteRaytracerCaller(address, statsTimeout, trust.forWorker(address))
+			defer caller.Close()
+			status.stats, status.err = caller.Stats()
+			if status.err != nil {
+				return
+			}
+
+			start := time.Now()
+			time.Sleep(rateInterval)
+			stats, err := caller.Stats()
+			if err != nil {
+				status.err = err
+				return
+			}
+			stats.RaysPerSecond = float64(stats.Rays-status.stats.Rays) / time.Since(start).Seconds()
+			status.stats = stats
+		}(&statuses[i], addresses[i])
+	}
+	wg.Wait()
+
+	printWorkers(os.Stdout, statuses)
+	return nil
+}
+
+// printWorkers prints a table of the workers' statuses
+func printWorkers(out io.Writer, statuses []workerStatus) {
+	table := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(table, "ADDRESS\tSTATE\tREQUESTS\tQUEUED\tSAMPLES\tRAYS/S\tSCENES\tUPTIME\tMEMORY\n")
+	for _, status := range statuses {
+		if status.err != nil {
+			fmt.Fprintf(table, "%s\tunreachable\t\t\t\t\t\t\t%s\n", status.address, status.err)
+			continue
+		}
+
+		stats := status.stats
+		state := "idle"
+		switch {
+		case stats.Leaving:
+			state = "leaving"
+		case stats.ActiveRequests > 0:
+			state = "rendering"
+		}
+		scenes := "-"
+		if len(stats.Scenes) > 0 {
+			// the most recently used one, shortened like a git hash
+			scenes = stats.Scenes[0]
+			if len(scenes) > 12 {
+				scenes = scenes[:12]
+			}
+			if len(stats.Scenes) > 1 {
+				scenes += fmt.Sprintf(" (+%d)", len(stats.Scenes)-1)
+			}
+		}
+		fmt.Fprintf(
+			table, "%s\t%s\t%d/%d\t%d\t%d\t%.3g\t%s\t%s\t%d MiB\n",
+			status.address, state,
+			stats.ActiveRequests, stats.MaxRequestsAtOnce, stats.QueuedRequests,
+			stats.Samples, stats.RaysPerSecond, scenes,
+			stats.Uptime/time.Second*time.Second, stats.Memory>>20,
+		)
+	}
+	table.Flush()
+}
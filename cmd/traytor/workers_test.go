@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/DexterLB/traytor/rpc"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintWorkersShortensSceneIDs(t *testing.T) {
+	assert := assert.New(t)
+
+	out := &bytes.Buffer{}
+	printWorkers(out, []workerStatus{
+		{address: "a:1234", stats: &rpc.WorkerStats{Scenes: []string{"0123456789abcdef"}}},
+		{address: "b:1234", stats: &rpc.WorkerStats{Scenes: []string{"short", "other"}}},
+	})
+	assert.True(strings.Contains(out.String(), "0123456789ab "))
+	assert.False(strings.Contains(out.String(), "0123456789abc"))
+	assert.True(strings.Contains(out.String(), "short (+1)"))
+}
+
+func TestFailedStoresAreGivenBackWhenTheWorkerIsEvicted(t *testing.T) {
+	assert := assert.New(t)
+	w := &worker{address: "worker:1234", maxFailures: 1}
+	counter := rpc.NewSampleCounter(0)
+
+	timedOut := &rpc.SampleSettings{FirstSample: 3, SamplesAtOnce: 2}
+	assert.True(w.storeFailed(timedOut, errors.New("timeout")))
+	assert.False(w.storeFailed(timedOut, rpc.ErrLeaving))
+	assert.Equal(0, counter.Dec(10).Count)
+
+	w.fail(errors.New("timeout"), counter)
+	assert.True(w.isEvicted())
+	assert.Equal(rpc.SampleRange{First: 3, Count: 2}, counter.Dec(10))
+	assert.False(w.storeFailed(timedOut, errors.New("timeout")))
+}
@@ -0,0 +1,3 @@
+// Package filter provides pixel reconstruction filters, which weigh the
+// contribution of each sample to the pixels around it
+package filter
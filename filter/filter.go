@@ -0,0 +1,121 @@
+package filter
+
+import (
+	"fmt"
+	"math"
+)
+
+// Filter weighs samples depending on their offset from a pixel's centre
+type Filter interface {
+	// Radius returns the distance (in pixels) beyond which samples
+	// have zero weight
+	Radius() float64
+	// Evaluate returns the weight of a sample which is offset (x, y) pixels
+	// from the pixel's centre
+	Evaluate(x, y float64) float64
+}
+
+// Names contains the names of all available filters, as accepted by New
+var Names = []string{"box", "tent", "gaussian", "mitchell", "blackman-harris"}
+
+// New returns the named filter with the given radius (in pixels). If radius
+// is 0, the filter's default radius is used. New returns nil for a box
+// filter with radius 0.5, in which case each sample should only contribute to
+// the pixel it was taken in.
+func New(name string, radius float64) (Filter, error) {
+	if radius < 0 {
+		return nil, fmt.Errorf("Filter radius must not be negative: %g", radius)
+	}
+
+	switch name {
+	case "", "box":
+		if radius == 0 || radius == 0.5 {
+			return nil, nil
+		}
+		return &separable{radius, box}, nil
+	case "tent":
+		return newSeparable(radius, 1, tent), nil
+	case "gaussian":
+		return newSeparable(radius, 1.5, gaussian), nil
+	case "mitchell":
+		return newSeparable(radius, 2, mitchell), nil
+	case "blackman-harris":
+		return newSeparable(radius, 2, blackmanHarris), nil
+	default:
+		return nil, fmt.Errorf("Unknown filter: '%s'", name)
+	}
+}
+
+// Border returns the number of pixels around a rectangle of pixels which
+// receive samples taken in the rectangle when splatting with the filter
+// (0 for a nil filter)
+func Border(f Filter) int {
+	if f == nil {
+		return 0
+	}
+	return int(math.Max(0, math.Ceil(f.Radius()-0.5)))
+}
+
+// separable is a filter whose weight is the product of the weights of the
+// two offsets. function receives offsets relative to the radius (in [-1, 1]).
+type separable struct {
+	radius   float64
+	function func(x float64) float64
+}
+
+func newSeparable(radius float64, defaultRadius float64, function func(float64) float64) *separable {
+	if radius == 0 {
+		radius = defaultRadius
+	}
+	return &separable{radius: radius, function: function}
+}
+
+// Radius returns the distance beyond which samples have zero weight
+func (f *separable) Radius() float64 {
+	return f.radius
+}
+
+// Evaluate returns the weight of a sample at offset (x, y)
+func (f *separable) Evaluate(x, y float64) float64 {
+	x, y = x/f.radius, y/f.radius
+	if x < -1 || x > 1 || y < -1 || y > 1 {
+		return 0
+	}
+	return f.function(x) * f.function(y)
+}
+
+func box(x float64) float64 {
+	return 1
+}
+
+func tent(x float64) float64 {
+	return 1 - math.Abs(x)
+}
+
+// gaussian has a standard deviation of a third of the radius, and is
+// shifted down so that it reaches zero at the radius
+func gaussian(x float64) float64 {
+	const sigma = 1.0 / 3
+	g := func(x float64) float64 {
+		return math.Exp(-x * x / (2 * sigma * sigma))
+	}
+	return g(x) - g(1)
+}
+
+// mitchell is the Mitchell-Netravali cubic with B = C = 1/3
+func mitchell(x float64) float64 {
+	const b, c = 1.0 / 3, 1.0 / 3
+	x = math.Abs(2 * x)
+	if x > 1 {
+		return ((-b-6*c)*x*x*x + (6*b+30*c)*x*x +
+			(-12*b-48*c)*x + (8*b + 24*c)) / 6
+	}
+	return ((12-9*b-6*c)*x*x*x + (-18+12*b+6*c)*x*x + (6 - 2*b)) / 6
+}
+
+// blackmanHarris is the 4-term Blackman-Harris window
+func blackmanHarris(x float64) float64 {
+	const a0, a1, a2, a3 = 0.35875, 0.48829, 0.14128, 0.01168
+	t := 2 * math.Pi * (x + 1) / 2
+	return a0 - a1*math.Cos(t) + a2*math.Cos(2*t) - a3*math.Cos(3*t)
+}
@@ -0,0 +1,75 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/DexterLB/traytor/maths"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+
+	f, err := New("box", 0.5)
+	assert.Nil(err)
+	assert.Nil(f, "A box filter with radius 0.5 should be nil")
+
+	for _, name := range Names[1:] {
+		f, err = New(name, 0)
+		assert.Nil(err)
+		if assert.NotNil(f, "%s filter shouldn't be nil", name) {
+			assert.True(f.Radius() > 0, "%s filter should have a default radius", name)
+		}
+	}
+
+	f, err = New("gaussian", 3)
+	assert.Nil(err)
+	assert.Equal(3.0, f.Radius())
+
+	_, err = New("foo", 0)
+	assert.NotNil(err, "Unknown filter names should be an error")
+
+	_, err = New("tent", -1)
+	assert.NotNil(err, "Negative radii should be an error")
+}
+
+func TestEvaluate(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, name := range Names {
+		f, _ := New(name, 2)
+		r := f.Radius()
+
+		assert.Equal(0.0, f.Evaluate(r+0.1, 0), "%s filter should be zero outside its radius", name)
+		assert.Equal(0.0, f.Evaluate(0, -r-0.1), "%s filter should be zero outside its radius", name)
+		assert.True(f.Evaluate(0, 0) > 0, "%s filter should be positive in the centre", name)
+		assert.InDelta(f.Evaluate(0.3, 0.7), f.Evaluate(-0.3, -0.7), maths.Epsilon,
+			"%s filter should be symmetric", name)
+		assert.True(f.Evaluate(0, 0) >= f.Evaluate(0.5, 0.5), "%s filter should peak in the centre", name)
+	}
+
+	tent, _ := New("tent", 1)
+	assert.InDelta(0.25, tent.Evaluate(0.5, 0.5), maths.Epsilon)
+
+	gaussian, _ := New("gaussian", 1.5)
+	assert.InDelta(0, gaussian.Evaluate(1.5, 0), maths.Epsilon, "Gaussian should reach zero at its radius")
+
+	mitchell, _ := New("mitchell", 2)
+	assert.InDelta(0, mitchell.Evaluate(2, 0), maths.Epsilon, "Mitchell should reach zero at its radius")
+	assert.True(mitchell.Evaluate(1.5, 0) < 0, "Mitchell should have a negative lobe")
+}
+
+func TestBorder(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Equal(0, Border(nil))
+
+	f, _ := New("box", 1)
+	assert.Equal(1, Border(f))
+
+	f, _ = New("gaussian", 1.5)
+	assert.Equal(1, Border(f))
+
+	f, _ = New("mitchell", 2)
+	assert.Equal(2, Border(f))
+}
@@ -0,0 +1,681 @@
+package hdrimage
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/DexterLB/traytor/hdrcolour"
+)
+
+// Pixel types of OpenEXR images
+const (
+	EXRHalf  = "half"
+	EXRFloat = "float"
+)
+
+// Compressions of OpenEXR images
+const (
+	EXRCompressionNone = "none"
+	EXRCompressionRLE  = "rle"
+	EXRCompressionZIPS = "zips" // zlib, one scanline per block
+	EXRCompressionZIP  = "zip"  // zlib, 16 scanlines per block
+)
+
+// exrMagic is the number at the beginning of every OpenEXR file
+var exrMagic = []byte{0x76, 0x2f, 0x31, 0x01}
+
+// EXROptions describe how an image is written in the OpenEXR format
+type EXROptions struct {
+	PixelType   string // EXRHalf (the default) or EXRFloat
+	Compression string // one of the EXRCompression* constants (zip by default)
+	// Layers are written together with the image, their channels named
+	// after them (e.g. "noise.Y")
+	Layers []EXRLayer
+	// Attributes are name-text pairs written in the header as string
+	// attributes
+	Attributes [][2]string
+}
+
+// EXRLayer is an image written as a layer of an OpenEXR file
+type EXRLayer struct {
+	Name  string
+	Image *Image
+	// Luminance makes the layer have a single Y channel with the intensity
+	// of the pixels, instead of R, G and B
+	Luminance bool
+}
+
+// Check returns an error if the pixel type or the compression isn't supported
+func (options *EXROptions) Check() error {
+	if _, err := exrPixelType(options.PixelType); err != nil {
+		return err
+	}
+	_, err := exrCompression(options.Compression)
+	return err
+}
+
+// exr pixel types and compressions, as they're stored in files
+const (
+	exrUint  = 0
+	exrHalf  = 1
+	exrFloat = 2
+
+	exrNone = 0
+	exrRLE  = 1
+	exrZIPS = 2
+	exrZIP  = 3
+)
+
+func exrPixelType(name string) (int32, error) {
+	switch name {
+	case EXRHalf, "":
+		return exrHalf, nil
+	case EXRFloat:
+		return exrFloat, nil
+	default:
+		return 0, fmt.Errorf("Unknown EXR pixel type: '%s'", name)
+	}
+}
+
+func exrCompression(name string) (byte, error) {
+	switch name {
+	case EXRCompressionZIP, "":
+		return exrZIP, nil
+	case EXRCompressionZIPS:
+		return exrZIPS, nil
+	case EXRCompressionRLE:
+		return exrRLE, nil
+	case EXRCompressionNone:
+		return exrNone, nil
+	default:
+		return 0, fmt.Errorf("Unknown EXR compression: '%s'", name)
+	}
+}
+
+// exrLinesPerBlock returns the number of scanlines compressed together
+func exrLinesPerBlock(compression byte) int {
+	if compression == exrZIP {
+		return 16
+	}
+	return 1
+}
+
+// exrChannel is a channel of an image being written
+type exrChannel struct {
+	name  string
+	value func(colour *hdrcolour.Colour) float32
+	layer int // index of the image whose pixels the channel contains
+}
+
+// exrChannels sorts channels by name, as they're stored in files
+type exrChannels []exrChannel
+
+func (c exrChannels) Len() int           { return len(c) }
+func (c exrChannels) Less(i, j int) bool { return c[i].name < c[j].name }
+func (c exrChannels) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// channels returns the channels in which the layer is written
+func (layer *EXRLayer) channels(index int) exrChannels {
+	prefix := ""
+	if layer.Name != "" {
+		prefix = layer.Name + "."
+	}
+	if layer.Luminance {
+		return exrChannels{{prefix + "Y", func(c *hdrcolour.Colour) float32 { return c.Intensity() }, index}}
+	}
+	return exrChannels{
+		{prefix + "R", func(c *hdrcolour.Colour) float32 { return c.R }, index},
+		{prefix + "G", func(c *hdrcolour.Colour) float32 { return c.G }, index},
+		{prefix + "B", func(c *hdrcolour.Colour) float32 { return c.B }, index},
+	}
+}
+
+// EncodeEXR writes the image (and the layers in the options) as a
+// single-part scanline OpenEXR file. The layers must have the same size as
+// the image.
+func (im *Image) EncodeEXR(writer io.Writer, options *EXROptions) error {
+	pixelType, err := exrPixelType(options.PixelType)
+	if err != nil {
+		return err
+	}
+	compression, err := exrCompression(options.Compression)
+	if err != nil {
+		return err
+	}
+
+	layers := append([]EXRLayer{{Image: im}}, options.Layers...)
+	var channels exrChannels
+	for i := range layers {
+		if layers[i].Image.Width != im.Width || layers[i].Image.Height != im.Height {
+			return fmt.Errorf("layer '%s' has a different size than the image", layers[i].Name)
+		}
+		channels = append(channels, layers[i].channels(i)...)
+	}
+	sort.Sort(channels)
+
+	header := &bytes.Buffer{}
+	header.Write(exrMagic)
+	binary.Write(header, binary.LittleEndian, uint32(2))
+
+	chlist := &bytes.Buffer{}
+	for _, channel := range channels {
+		chlist.WriteString(channel.name)
+		chlist.WriteByte(0)
+		binary.Write(chlist, binary.LittleEndian, pixelType)
+		chlist.Write([]byte{0, 0, 0, 0}) // pLinear and reserved
+		binary.Write(chlist, binary.LittleEndian, [2]int32{1, 1})
+	}
+	chlist.WriteByte(0)
+	window := &bytes.Buffer{}
+	binary.Write(window, binary.LittleEndian, [4]int32{0, 0, int32(im.Width - 1), int32(im.Height - 1)})
+
+	writeEXRAttribute(header, "channels", "chlist", chlist.Bytes())
+	writeEXRAttribute(header, "compression", "compression", []byte{compression})
+	writeEXRAttribute(header, "dataWindow", "box2i", window.Bytes())
+	writeEXRAttribute(header, "displayWindow", "box2i", window.Bytes())
+	writeEXRAttribute(header, "lineOrder", "lineOrder", []byte{0})
+	writeEXRAttribute(header, "pixelAspectRatio", "float", float32Bytes(1))
+	writeEXRAttribute(header, "screenWindowCenter", "v2f", append(float32Bytes(0), float32Bytes(0)...))
+	writeEXRAttribute(header, "screenWindowWidth", "float", float32Bytes(1))
+	for _, attribute := range options.Attributes {
+		writeEXRAttribute(header, attribute[0], "string", []byte(attribute[1]))
+	}
+	header.WriteByte(0)
+
+	linesPerBlock := exrLinesPerBlock(compression)
+	var blocks [][]byte
+	rows := make([][]*hdrcolour.Colour, len(layers))
+	for y := 0; y < im.Height; y += linesPerBlock {
+		raw := []byte{}
+		for line := y; line < y+linesPerBlock && line < im.Height; line++ {
+			for i := range layers {
+				rows[i] = rows[i][:0]
+				for x := 0; x < im.Width; x++ {
+					rows[i] = append(rows[i], layers[i].Image.AtHDR(x, line))
+				}
+			}
+			for _, channel := range channels {
+				for _, colour := range rows[channel.layer] {
+					value := channel.value(colour)
+					if pixelType == exrHalf {
+						raw = appendUint16(raw, toHalf(value))
+					} else {
+						raw = appendFloat32(raw, value)
+					}
+				}
+			}
+		}
+
+		data, err := exrCompress(raw, compression)
+		if err != nil {
+			return err
+		}
+		block := make([]byte, 0, 8+len(data))
+		block = appendUint32(block, uint32(y))
+		block = appendUint32(block, uint32(len(data)))
+		blocks = append(blocks, append(block, data...))
+	}
+
+	offset := uint64(header.Len() + 8*len(blocks))
+	for _, block := range blocks {
+		binary.Write(header, binary.LittleEndian, offset)
+		offset += uint64(len(block))
+	}
+	if _, err := writer.Write(header.Bytes()); err != nil {
+		return err
+	}
+	for _, block := range blocks {
+		if _, err := writer.Write(block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEXRAttribute writes an attribute of an OpenEXR header
+func writeEXRAttribute(header *bytes.Buffer, name, kind string, value []byte) {
+	header.WriteString(name)
+	header.WriteByte(0)
+	header.WriteString(kind)
+	header.WriteByte(0)
+	binary.Write(header, binary.LittleEndian, int32(len(value)))
+	header.Write(value)
+}
+
+func float32Bytes(value float32) []byte {
+	return appendFloat32(nil, value)
+}
+
+// exrCompress compresses a block of scanlines. Blocks which don't get
+// smaller are stored uncompressed.
+func exrCompress(raw []byte, compression byte) ([]byte, error) {
+	var data []byte
+	switch compression {
+	case exrNone:
+		return raw, nil
+	case exrRLE:
+		data = rleCompress(exrPredict(exrInterleave(raw)))
+	case exrZIP, exrZIPS:
+		buffer := &bytes.Buffer{}
+		compressor := zlib.NewWriter(buffer)
+		if _, err := compressor.Write(exrPredict(exrInterleave(raw))); err != nil {
+			return nil, err
+		}
+		if err := compressor.Close(); err != nil {
+			return nil, err
+		}
+		data = buffer.Bytes()
+	}
+	if len(data) >= len(raw) {
+		return raw, nil
+	}
+	return data, nil
+}
+
+// exrDecompress decompresses a block of scanlines with the given
+// uncompressed size
+func exrDecompress(data []byte, compression byte, size int) ([]byte, error) {
+	if len(data) == size {
+		return data, nil
+	}
+	var predicted []byte
+	switch compression {
+	case exrNone:
+		return nil, fmt.Errorf("wrong size of EXR data")
+	case exrRLE:
+		var err error
+		if predicted, err = rleDecompress(data, size); err != nil {
+			return nil, err
+		}
+	case exrZIP, exrZIPS:
+		reader, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("cannot decompress EXR data: %s", err)
+		}
+		// a small block can inflate to any size, so no more than one byte
+		// past the expected size is read
+		limited := io.LimitReader(reader, int64(size)+1)
+		if predicted, err = ioutil.ReadAll(limited); err != nil {
+			return nil, fmt.Errorf("cannot decompress EXR data: %s", err)
+		}
+	default:
+		return nil, fmt.Errorf("Unknown EXR compression: '%d'", compression)
+	}
+	if len(predicted) != size {
+		return nil, fmt.Errorf("wrong size of EXR data")
+	}
+	return exrDeinterleave(exrUnpredict(predicted)), nil
+}
+
+// exrInterleave puts the even bytes of the data before the odd ones, which
+// separates the high and low bytes of the values
+func exrInterleave(data []byte) []byte {
+	result := make([]byte, len(data))
+	half := (len(data) + 1) / 2
+	for i := range data {
+		if i%2 == 0 {
+			result[i/2] = data[i]
+		} else {
+			result[half+i/2] = data[i]
+		}
+	}
+	return result
+}
+
+// exrDeinterleave reverses exrInterleave
+func exrDeinterleave(data []byte) []byte {
+	result := make([]byte, len(data))
+	half := (len(data) + 1) / 2
+	for i := range result {
+		if i%2 == 0 {
+			result[i] = data[i/2]
+		} else {
+			result[i] = data[half+i/2]
+		}
+	}
+	return result
+}
+
+// exrPredict replaces each byte (in place) with its difference from the
+// previous one
+func exrPredict(data []byte) []byte {
+	for i := len(data) - 1; i > 0; i-- {
+		data[i] = data[i] - data[i-1] + 128
+	}
+	return data
+}
+
+// exrUnpredict reverses exrPredict (in place)
+func exrUnpredict(data []byte) []byte {
+	for i := 1; i < len(data); i++ {
+		data[i] = data[i-1] + data[i] - 128
+	}
+	return data
+}
+
+// rleCompress encodes runs of at least 3 equal bytes as a count and the
+// byte, and other bytes as a negative count and the bytes themselves
+func rleCompress(data []byte) []byte {
+	const minRun, maxRun = 3, 127
+	var result []byte
+	for start := 0; start < len(data); {
+		end := start + 1
+		for end < len(data) && data[end] == data[start] && end-start < maxRun+1 {
+			end++
+		}
+		if end-start >= minRun {
+			result = append(result, byte(end-start-1), data[start])
+			start = end
+			continue
+		}
+		for end < len(data) && end-start < maxRun &&
+			(end+2 >= len(data) || data[end] != data[end+1] || data[end+1] != data[end+2]) {
+			end++
+		}
+		result = append(result, byte(int8(start-end)))
+		result = append(result, data[start:end]...)
+		start = end
+	}
+	return result
+}
+
+// rleDecompress reverses rleCompress
+func rleDecompress(data []byte, size int) ([]byte, error) {
+	result := make([]byte, 0, size)
+	for len(data) > 0 {
+		count := int(int8(data[0]))
+		if count < 0 {
+			if len(data) < 1-count {
+				return nil, fmt.Errorf("truncated EXR data")
+			}
+			result = append(result, data[1:1-count]...)
+			data = data[1-count:]
+			continue
+		}
+		if len(data) < 2 {
+			return nil, fmt.Errorf("truncated EXR data")
+		}
+		for i := 0; i <= count; i++ {
+			result = append(result, data[1])
+		}
+		data = data[2:]
+	}
+	return result, nil
+}
+
+// exrHeader is the part of an OpenEXR header needed to read the pixels
+type exrHeader struct {
+	channels      []exrChannelInfo
+	compression   byte
+	dataWindow    [4]int32
+	displayWindow [4]int32
+	hasChannels   bool
+	hasWindows    int
+}
+
+// exrChannelInfo describes a channel of an image being read
+type exrChannelInfo struct {
+	name      string
+	pixelType int32
+}
+
+// size returns the number of bytes of each value of the channel
+func (c *exrChannelInfo) size() int {
+	if c.pixelType == exrHalf {
+		return 2
+	}
+	return 4
+}
+
+// DecodeEXR reads an image from a single-part scanline OpenEXR file. The
+// colours come from its R, G and B channels (or Y, for greyscale images).
+func DecodeEXR(reader io.Reader) (*Image, error) {
+	return DecodeEXRLayer(reader, "")
+}
+
+// DecodeEXRLayer works like DecodeEXR, but reads the channels of the given
+// layer (e.g. "noise" for the channels "noise.R", "noise.G" and so on).
+// The channels of other layers are ignored.
+func DecodeEXRLayer(reader io.Reader, layer string) (*Image, error) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read EXR data: %s", err)
+	}
+	if len(data) < 8 || !bytes.Equal(data[:4], exrMagic) {
+		return nil, fmt.Errorf("not an OpenEXR image")
+	}
+	version := binary.LittleEndian.Uint32(data[4:])
+	if version&0xff != 2 {
+		return nil, fmt.Errorf("unsupported OpenEXR version %d", version&0xff)
+	}
+	if version&0x1a00 != 0 {
+		return nil, fmt.Errorf("only scanline OpenEXR images with a single part are supported")
+	}
+
+	file := data
+	header, table, err := readEXRHeader(data[8:])
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := ""
+	if layer != "" {
+		prefix = layer + "."
+	}
+	components := make([]int, len(header.channels)) // -1 for skipped channels
+	found := false
+	for i, channel := range header.channels {
+		components[i] = -1
+		if !strings.HasPrefix(channel.name, prefix) {
+			continue
+		}
+		switch channel.name[len(prefix):] {
+		case "R":
+			components[i] = 0
+		case "G":
+			components[i] = 1
+		case "B":
+			components[i] = 2
+		case "Y":
+			components[i] = 3
+		default:
+			continue
+		}
+		found = true
+	}
+	if !found {
+		return nil, fmt.Errorf("Unknown EXR layer: '%s'", layer)
+	}
+
+	// the windows are checked before anything is allocated, and each block
+	// of lines takes at least an offset and a position and size
+	display := header.displayWindow
+	displayWidth := int(display[2]) - int(display[0]) + 1
+	displayHeight := int(display[3]) - int(display[1]) + 1
+	if err := checkDecodedSize("EXR", displayWidth, displayHeight); err != nil {
+		return nil, err
+	}
+	window := header.dataWindow
+	width := int(window[2]) - int(window[0]) + 1
+	height := int(window[3]) - int(window[1]) + 1
+	if err := checkDecodedSize("EXR", width, height); err != nil {
+		return nil, err
+	}
+	lineSize := 0
+	for i := range header.channels {
+		lineSize += width * header.channels[i].size()
+	}
+
+	linesPerBlock := exrLinesPerBlock(header.compression)
+	blocks := (height + linesPerBlock - 1) / linesPerBlock
+	if len(table) < 16*blocks {
+		return nil, fmt.Errorf("truncated EXR data")
+	}
+	im := New(displayWidth, displayHeight)
+	for block := 0; block < blocks; block++ {
+		// offsets are from the beginning of the file
+		offset := binary.LittleEndian.Uint64(table[8*block:])
+		start := int(offset)
+		if offset > uint64(len(file)) || start+8 > len(file) {
+			return nil, fmt.Errorf("truncated EXR data")
+		}
+		y := int(int32(binary.LittleEndian.Uint32(file[start:])))
+		size := int(binary.LittleEndian.Uint32(file[start+4:]))
+		if start+8+size > len(file) {
+			return nil, fmt.Errorf("truncated EXR data")
+		}
+		lines := linesPerBlock
+		if remaining := int(window[3]) - y + 1; remaining < lines {
+			lines = remaining
+		}
+		if lines <= 0 || y < int(window[1]) {
+			return nil, fmt.Errorf("wrong position of EXR data")
+		}
+		raw, err := exrDecompress(file[start+8:start+8+size], header.compression, lines*lineSize)
+		if err != nil {
+			return nil, err
+		}
+		for line := 0; line < lines; line++ {
+			im.readEXRLine(raw[line*lineSize:], header, components, width, y+line)
+		}
+	}
+	return im, nil
+}
+
+// readEXRLine reads a scanline into the image. components maps channels to
+// colour components (0-2 for R, G and B, 3 for Y, -1 for none).
+func (im *Image) readEXRLine(data []byte, header *exrHeader, components []int, width int, y int) {
+	imageY := y - int(header.displayWindow[1])
+	for i, channel := range header.channels {
+		size := channel.size()
+		component := components[i]
+		for x := 0; x < width && component >= 0; x++ {
+			imageX := x + int(header.dataWindow[0]-header.displayWindow[0])
+			if imageX < 0 || imageY < 0 || imageX >= im.Width || imageY >= im.Height {
+				continue
+			}
+			var value float32
+			switch channel.pixelType {
+			case exrHalf:
+				value = fromHalf(binary.LittleEndian.Uint16(data[2*x:]))
+			case exrFloat:
+				value = readFloat32(data[4*x:])
+			default:
+				value = float32(binary.LittleEndian.Uint32(data[4*x:]))
+			}
+			pixel := &im.Pixels[imageX][imageY]
+			switch component {
+			case 0:
+				pixel.R = quantize(value)
+			case 1:
+				pixel.G = quantize(value)
+			case 2:
+				pixel.B = quantize(value)
+			default:
+				pixel.SetColour(value, value, value)
+			}
+		}
+		data = data[width*size:]
+	}
+}
+
+// readEXRHeader reads the attributes of an OpenEXR header, and returns the
+// data after it
+func readEXRHeader(data []byte) (*exrHeader, []byte, error) {
+	header := &exrHeader{}
+	for {
+		name, rest, err := readEXRString(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		if name == "" {
+			data = rest
+			break
+		}
+		kind, rest, err := readEXRString(rest)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rest) < 4 {
+			return nil, nil, fmt.Errorf("truncated EXR header")
+		}
+		size := int(binary.LittleEndian.Uint32(rest))
+		if size < 0 || len(rest) < 4+size {
+			return nil, nil, fmt.Errorf("truncated EXR header")
+		}
+		value := rest[4 : 4+size]
+		data = rest[4+size:]
+
+		switch {
+		case name == "channels" && kind == "chlist":
+			if header.channels, err = readEXRChannels(value); err != nil {
+				return nil, nil, err
+			}
+			header.hasChannels = true
+		case name == "compression" && kind == "compression" && size == 1:
+			header.compression = value[0]
+			if header.compression > exrZIP {
+				return nil, nil, fmt.Errorf("unsupported EXR compression %d", header.compression)
+			}
+		case (name == "dataWindow" || name == "displayWindow") && kind == "box2i" && size == 16:
+			var window [4]int32
+			for i := range window {
+				window[i] = int32(binary.LittleEndian.Uint32(value[4*i:]))
+			}
+			if name == "dataWindow" {
+				header.dataWindow = window
+			} else {
+				header.displayWindow = window
+			}
+			header.hasWindows++
+		}
+	}
+	if !header.hasChannels || header.hasWindows != 2 {
+		return nil, nil, fmt.Errorf("EXR header is missing required attributes")
+	}
+	return header, data, nil
+}
+
+// readEXRChannels reads a list of channels
+func readEXRChannels(data []byte) ([]exrChannelInfo, error) {
+	var channels []exrChannelInfo
+	for {
+		name, rest, err := readEXRString(data)
+		if err != nil {
+			return nil, err
+		}
+		if name == "" {
+			return channels, nil
+		}
+		if len(rest) < 16 {
+			return nil, fmt.Errorf("truncated EXR channel list")
+		}
+		channel := exrChannelInfo{
+			name:      name,
+			pixelType: int32(binary.LittleEndian.Uint32(rest)),
+		}
+		if channel.pixelType < exrUint || channel.pixelType > exrFloat {
+			return nil, fmt.Errorf("unknown EXR pixel type %d", channel.pixelType)
+		}
+		if binary.LittleEndian.Uint32(rest[8:]) != 1 || binary.LittleEndian.Uint32(rest[12:]) != 1 {
+			return nil, fmt.Errorf("subsampled EXR channels aren't supported")
+		}
+		channels = append(channels, channel)
+		data = rest[16:]
+	}
+}
+
+// readEXRString reads a null-terminated string
+func readEXRString(data []byte) (string, []byte, error) {
+	end := bytes.IndexByte(data, 0)
+	if end < 0 {
+		return "", nil, fmt.Errorf("truncated EXR header")
+	}
+	return string(data[:end]), data[end+1:], nil
+}
@@ -0,0 +1,238 @@
+package hdrimage
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"io/ioutil"
+	"testing"
+
+	"github.com/DexterLB/traytor/hdrcolour"
+	"github.com/stretchr/testify/assert"
+)
+
+// exrTestImage returns an image with smooth areas (which compress well)
+// and some values which need more precision than half floats have
+func exrTestImage() *Image {
+	im := New(37, 21)
+	for i := 0; i < im.Width; i++ {
+		for j := 0; j < im.Height; j++ {
+			if i < 20 {
+				im.Pixels[i][j].SetColour(0.5, 1, 2)
+			} else {
+				im.Pixels[i][j].SetColour(float32(i)*0.1, float32(j+1)*1000.25, -1)
+			}
+		}
+	}
+	return im
+}
+
+func TestEXRRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	im := exrTestImage()
+
+	for _, compression := range []string{
+		EXRCompressionNone, EXRCompressionRLE, EXRCompressionZIPS, EXRCompressionZIP,
+	} {
+		buffer := &bytes.Buffer{}
+		err := im.EncodeEXR(buffer, &EXROptions{PixelType: EXRFloat, Compression: compression})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := DecodeEXR(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(im, decoded, compression)
+	}
+}
+
+func TestEXRHalf(t *testing.T) {
+	assert := assert.New(t)
+	im := exrTestImage()
+
+	buffer := &bytes.Buffer{}
+	if err := im.EncodeEXR(buffer, &EXROptions{}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeEXR(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < im.Width; i++ {
+		for j := 0; j < im.Height; j++ {
+			expected, actual := im.AtHDR(i, j), decoded.AtHDR(i, j)
+			assert.InEpsilon(expected.G, actual.G, 1e-3)
+			assert.Equal(expected.B, actual.B)
+		}
+	}
+}
+
+func TestEXRHeader(t *testing.T) {
+	assert := assert.New(t)
+
+	buffer := &bytes.Buffer{}
+	err := New(2, 1).EncodeEXR(buffer, &EXROptions{
+		Compression: EXRCompressionNone,
+		Attributes:  [][2]string{{"software", "traytor"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buffer.Bytes()
+
+	assert.Equal([]byte{0x76, 0x2f, 0x31, 0x01, 2, 0, 0, 0}, data[:8])
+	assert.Equal("channels\x00chlist\x00", string(data[8:24]))
+	assert.Contains(string(data), "B\x00\x01\x00\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x01\x00\x00\x00G\x00")
+	assert.Contains(string(data), "software\x00string\x00\x07\x00\x00\x00traytor")
+	// the only scanline: its y, size and 3 channels of 2 half floats
+	assert.Equal([]byte{0, 0, 0, 0, 12, 0, 0, 0}, data[len(data)-20:len(data)-12])
+}
+
+// TestEXRReference reads an image written by another OpenEXR implementation
+// (the test image of CPython's imghdr module: 16x16 uncompressed half
+// floats with an alpha channel), whose pixels are the ones of the PPM
+// image next to it divided by 255
+func TestEXRReference(t *testing.T) {
+	assert := assert.New(t)
+
+	data, err := ioutil.ReadFile("testdata/python.exr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeEXR(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	reference, err := ioutil.ReadFile("testdata/python.ppm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pixels := reference[len("P6\n16 16\n255\n"):]
+
+	assert.Equal(16, decoded.Width)
+	assert.Equal(16, decoded.Height)
+	for j := 0; j < 16; j++ {
+		for i := 0; i < 16; i++ {
+			expected := pixels[3*(16*j+i):]
+			actual := decoded.AtHDR(i, j)
+			assert.InDelta(float32(expected[0])/255, actual.R, 1e-3)
+			assert.InDelta(float32(expected[1])/255, actual.G, 1e-3)
+			assert.InDelta(float32(expected[2])/255, actual.B, 1e-3)
+		}
+	}
+}
+
+// setEXRWindow changes a window in the header of an encoded image
+func setEXRWindow(data []byte, name string, window [4]int32) []byte {
+	data = append([]byte(nil), data...)
+	start := bytes.Index(data, []byte(name+"\x00box2i\x00")) + len(name) + 11
+	for i, value := range window {
+		binary.LittleEndian.PutUint32(data[start+4*i:], uint32(value))
+	}
+	return data
+}
+
+func TestEXRWrongWindows(t *testing.T) {
+	assert := assert.New(t)
+
+	buffer := &bytes.Buffer{}
+	if err := New(4, 3).EncodeEXR(buffer, &EXROptions{}); err != nil {
+		t.Fatal(err)
+	}
+	data := buffer.Bytes()
+	_, err := DecodeEXR(bytes.NewReader(setEXRWindow(data, "displayWindow", [4]int32{0, 0, 3, 2})))
+	assert.Nil(err)
+
+	for _, window := range [][4]int32{
+		{0, 0, 1 << 30, 1 << 30},    // too large
+		{-1 << 31, 0, 1<<31 - 1, 2}, // overflows
+		{0, 0, -5, 2},               // empty
+		{0, 0, maxDecodedSide, 2},   // too wide
+		{0, 0, 1 << 14, 1 << 14},    // too many pixels
+	} {
+		_, err := DecodeEXR(bytes.NewReader(setEXRWindow(data, "displayWindow", window)))
+		assert.Error(err, "%v", window)
+	}
+
+	// each block of lines needs an offset and a position and size in the data
+	_, err = DecodeEXR(bytes.NewReader(setEXRWindow(data, "dataWindow", [4]int32{0, 0, 3, 60000})))
+	assert.Error(err)
+}
+
+func TestEXRLayers(t *testing.T) {
+	assert := assert.New(t)
+	im := exrTestImage()
+	layer := New(im.Width, im.Height)
+	layer.Pixels[3][4].SetColour(1, 2, 3)
+
+	buffer := &bytes.Buffer{}
+	err := im.EncodeEXR(buffer, &EXROptions{
+		PixelType: EXRFloat,
+		Layers: []EXRLayer{
+			{Name: "colour", Image: layer},
+			{Name: "grey", Image: layer, Luminance: true},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := buffer.Bytes()
+
+	decoded, err := DecodeEXRLayer(bytes.NewReader(data), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(im, decoded)
+
+	decoded, err = DecodeEXRLayer(bytes.NewReader(data), "colour")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(layer, decoded)
+
+	decoded, err = DecodeEXRLayer(bytes.NewReader(data), "grey")
+	if err != nil {
+		t.Fatal(err)
+	}
+	intensity := hdrcolour.New(1, 2, 3).Intensity()
+	assert.Equal(hdrcolour.New(intensity, intensity, intensity), decoded.AtHDR(3, 4))
+
+	_, err = DecodeEXRLayer(bytes.NewReader(data), "depth")
+	assert.Error(err)
+}
+
+func TestRLE(t *testing.T) {
+	assert := assert.New(t)
+
+	data := []byte{1, 2, 3, 3, 3, 3, 4, 4, 5}
+	for i := 0; i < 300; i++ {
+		data = append(data, 7)
+	}
+	for i := 0; i < 300; i++ {
+		data = append(data, byte(i))
+	}
+	compressed := rleCompress(data)
+	assert.Equal([]byte{0xfe, 1, 2, 3, 3}, compressed[:5])
+
+	decompressed, err := rleDecompress(compressed, len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(data, decompressed)
+}
+
+func TestEXRZIPBlockSizeIsChecked(t *testing.T) {
+	assert := assert.New(t)
+
+	// a few kilobytes which inflate to 16 MiB
+	buffer := &bytes.Buffer{}
+	writer := zlib.NewWriter(buffer)
+	writer.Write(make([]byte, 16<<20))
+	writer.Close()
+
+	_, err := exrDecompress(buffer.Bytes(), exrZIP, 64)
+	assert.Error(err)
+	_, err = exrDecompress(buffer.Bytes(), exrZIP, 16<<20)
+	assert.Nil(err)
+}
@@ -12,23 +12,65 @@ import (
 
 // Image is a stuct which will display images via its 2D colour array, wich represents the screen
 type Image struct {
-	Pixels        [][]hdrcolour.Colour
+	Pixels        [][]Pixel
 	Width, Height int
 	Divisor       int
+
+	// Weights contains the sum of the filter weights of all samples splatted
+	// into each pixel (rounded like the samples). If it's nil, the weight of
+	// every pixel is the Divisor.
+	Weights [][]float64
+
+	// Statistics describes the samples taken in each pixel. It's nil unless
+	// samples have been recorded with Record.
+	Statistics [][]PixelStatistics
 }
 
 // New will set the screen to the given width and height
 func New(width, height int) *Image {
-	pixels := make([][]hdrcolour.Colour, width)
+	pixels := make([][]Pixel, width)
 	for i := range pixels {
-		pixels[i] = make([]hdrcolour.Colour, height)
-		for j := range pixels[i] {
-			pixels[i][j] = *hdrcolour.New(0, 0, 0)
-		}
+		pixels[i] = make([]Pixel, height)
 	}
 	return &Image{Pixels: pixels, Width: width, Height: height, Divisor: 1}
 }
 
+// maxDecodedSide and maxDecodedPixels bound the size of the images read from
+// files (e.g. 8192x4096), so that a header can't make a decoder allocate
+// unbounded memory (each pixel takes 24 bytes)
+const (
+	maxDecodedSide   = 1 << 16
+	maxDecodedPixels = 1 << 25
+)
+
+// checkDecodedSize returns an error if an image of the given format and size
+// is empty or too large to be decoded
+func checkDecodedSize(format string, width, height int) error {
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("empty %s image", format)
+	}
+	if width > maxDecodedSide || height > maxDecodedSide || width*height > maxDecodedPixels {
+		return fmt.Errorf("%s image is too large: %dx%d", format, width, height)
+	}
+	return nil
+}
+
+// CheckSize returns an error if an image of the given size is empty or larger
+// than the images which can be decoded, e.g. before rendering an image of
+// a size requested over the network
+func CheckSize(width, height int) error {
+	if width <= 0 || height <= 0 {
+		return fmt.Errorf("width and height must be positive")
+	}
+	if width > maxDecodedSide || height > maxDecodedSide || width*height > maxDecodedPixels {
+		return fmt.Errorf(
+			"image is too large: %dx%d (the limit is %d pixels, and %d on each side)",
+			width, height, maxDecodedPixels, maxDecodedSide,
+		)
+	}
+	return nil
+}
+
 // Decode reads data in the simple traytor_hdr format and produces an
 // image.
 func Decode(reader io.Reader) (*Image, error) {
@@ -47,9 +89,7 @@ func Decode(reader io.Reader) (*Image, error) {
 			if err != nil {
 				return nil, fmt.Errorf("cannot read image data: %s", err)
 			}
-			im.Pixels[j][i].R = rgba[0]
-			im.Pixels[j][i].G = rgba[1]
-			im.Pixels[j][i].B = rgba[2]
+			im.Pixels[j][i].SetColour(rgba[0], rgba[1], rgba[2])
 		}
 	}
 
@@ -103,13 +143,91 @@ func (im *Image) String() string {
 	return representation
 }
 
-// Add adds another image to this one
+// Add adds another image to this one (including the weights and
+// statistics, if any)
 func (im *Image) Add(other *Image) {
 	for i := 0; i < im.Width; i++ {
 		for j := 0; j < im.Height; j++ {
 			(&im.Pixels[i][j]).Add(&other.Pixels[i][j])
 		}
 	}
+
+	if other.Statistics != nil {
+		im.initStatistics()
+		for i := 0; i < im.Width; i++ {
+			for j := 0; j < im.Height; j++ {
+				im.Statistics[i][j].Add(&other.Statistics[i][j])
+			}
+		}
+	}
+
+	if im.Weights == nil && other.Weights == nil {
+		return
+	}
+	im.initWeights()
+	for i := 0; i < im.Width; i++ {
+		for j := 0; j < im.Height; j++ {
+			im.Weights[i][j] += other.Weight(i, j)
+		}
+	}
+}
+
+// Splat adds a colour with the given filter weight to the pixel at [x][y]
+// (colour is added to the pixel as it is, so it must be premultiplied by
+// the weight)
+func (im *Image) Splat(x, y int, colour *hdrcolour.Colour, weight float32) {
+	im.initWeights()
+	im.Pixels[x][y].AddColour(colour)
+	im.Weights[x][y] += quantize(weight)
+}
+
+// Weight returns the sum of the filter weights of the pixel at [x][y]
+func (im *Image) Weight(x, y int) float64 {
+	if im.Weights == nil {
+		return float64(im.Divisor)
+	}
+	return im.Weights[x][y]
+}
+
+// initWeights creates the weights array if it doesn't exist, so that every
+// pixel's weight is the divisor
+func (im *Image) initWeights() {
+	if im.Weights != nil {
+		return
+	}
+	im.Weights = make([][]float64, im.Width)
+	for i := range im.Weights {
+		im.Weights[i] = make([]float64, im.Height)
+		for j := range im.Weights[i] {
+			im.Weights[i][j] = float64(im.Divisor)
+		}
+	}
+}
+
+// Composite replaces the pixels outside of region with the pixels of
+// background (which must have the same size), so that a rendered region
+// can be placed over a previously rendered frame. The image gets per-pixel
+// weights.
+func (im *Image) Composite(background *Image, region image.Rectangle) error {
+	if background.Width != im.Width || background.Height != im.Height {
+		return fmt.Errorf(
+			"background size %dx%d doesn't match image size %dx%d",
+			background.Width, background.Height, im.Width, im.Height,
+		)
+	}
+
+	im.initWeights()
+	for i := 0; i < im.Width; i++ {
+		for j := 0; j < im.Height; j++ {
+			if image.Pt(i, j).In(region) {
+				continue
+			}
+			colour := background.AtHDR(i, j)
+			im.Pixels[i][j].SetColour(colour.R, colour.G, colour.B)
+			im.Weights[i][j] = 1
+		}
+	}
+	return nil
 }
 
 // Add returns a new image which is the sum of the given ones
@@ -120,12 +238,19 @@ func Add(a *Image, b *Image) *Image {
 	return sum
 }
 
-// AtHDR returns the Colour of the pixel at [x][y] (scaled by the divisor)
+// AtHDR returns the Colour of the pixel at [x][y] (scaled by the divisor,
+// or by the pixel's weight if the image has weights)
 func (im *Image) AtHDR(x, y int) *hdrcolour.Colour {
 	if im.Divisor == 0 {
 		return hdrcolour.New(1, 1, 1)
 	}
-	return im.Pixels[x][y].Scaled(1 / float32(im.Divisor))
+	if im.Weights != nil {
+		if im.Weights[x][y] == 0 {
+			return hdrcolour.New(0, 0, 0)
+		}
+		return im.Pixels[x][y].Scaled(1 / im.Weights[x][y])
+	}
+	return im.Pixels[x][y].Scaled(1 / float64(im.Divisor))
 }
 
 // At returns the sRGB Colour of the pixel at [x][y (scaled by the divisor)]
@@ -150,7 +275,7 @@ func FromSRGB(im image.Image) *Image {
 	extractedImage := New(width, height)
 	for i := 0; i < width; i++ {
 		for j := 0; j < height; j++ {
-			extractedImage.Pixels[i][j].Add(
+			extractedImage.Pixels[i][j].AddColour(
 				hdrcolour.FromColor(im.At(im.Bounds().Min.X+i, im.Bounds().Min.Y+j)),
 			)
 		}
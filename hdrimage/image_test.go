@@ -2,7 +2,10 @@ package hdrimage
 
 import (
 	"fmt"
+	"image"
 	"image/color"
+
+	"github.com/DexterLB/traytor/hdrcolour"
 )
 
 func ExampleImage_String() {
@@ -77,3 +80,72 @@ func ExampleImage_At() {
 	// [65535, 65535, 0]
 	//
 }
+
+func ExampleImage_Splat() {
+	im := New(2, 1)
+	im.Divisor = 1
+	im.Pixels[1][0].SetColour(2, 2, 2)
+
+	im.Splat(0, 0, hdrcolour.New(1.5, 3, 0), 0.5)
+	im.Splat(1, 0, hdrcolour.New(1, 1, 1), 0.5)
+	fmt.Printf("%s %s\n", im.AtHDR(0, 0), im.AtHDR(1, 0))
+
+	other := New(2, 1)
+	other.Pixels[0][0].SetColour(3, 3, 3)
+	im.Add(other)
+	fmt.Printf("%s %s\n", im.AtHDR(0, 0), im.AtHDR(1, 0))
+
+	// Output:
+	// {1, 2, 0} {2, 2, 2}
+	// {1.8, 2.4, 1.2} {1.2, 1.2, 1.2}
+	//
+}
+
+func ExampleImage_AddTile() {
+	im := New(3, 2)
+	im.Divisor = 1
+
+	tile := NewTile(image.Rect(1, 1, 4, 2))
+	tile.Image.Divisor = 2
+	tile.Image.Pixels[0][0].SetColour(4, 4, 4)
+	tile.Image.Pixels[1][0].SetColour(2, 2, 2)
+	tile.Image.Pixels[2][0].SetColour(8, 8, 8)
+
+	im.AddTile(tile)
+	fmt.Printf("%s\n", tile.Bounds())
+	fmt.Printf("%s %s %s\n", im.AtHDR(0, 1), im.AtHDR(1, 1), im.AtHDR(2, 1))
+
+	// Output:
+	// (1,1)-(4,2)
+	// {0, 0, 0} {1.33, 1.33, 1.33} {0.667, 0.667, 0.667}
+	//
+}
+
+func ExampleImage_Composite() {
+	im := New(3, 1)
+	im.Divisor = 2
+	im.Pixels[1][0].SetColour(4, 4, 4)
+
+	background := New(3, 1)
+	background.Pixels[0][0].SetColour(1, 1, 1)
+	background.Pixels[1][0].SetColour(5, 5, 5)
+	background.Pixels[2][0].SetColour(3, 3, 3)
+
+	im.Composite(background, image.Rect(1, 0, 2, 1))
+	fmt.Printf("%s %s %s\n", im.AtHDR(0, 0), im.AtHDR(1, 0), im.AtHDR(2, 0))
+
+	// Output:
+	// {1, 1, 1} {2, 2, 2} {3, 3, 3}
+	//
+}
+
+func ExampleCheckSize() {
+	fmt.Println(CheckSize(800, 450))
+	fmt.Println(CheckSize(0, 450))
+	fmt.Println(CheckSize(100000, 100000))
+
+	// Output:
+	// <nil>
+	// width and height must be positive
+	// image is too large: 100000x100000 (the limit is 33554432 pixels, and 65536 on each side)
+}
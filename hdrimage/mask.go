@@ -0,0 +1,60 @@
+package hdrimage
+
+import "fmt"
+
+// Mask marks a subset of the pixels of an image
+type Mask struct {
+	Width, Height int
+	Bits          []uint64
+}
+
+// NewMask returns an empty mask with the given size
+func NewMask(width, height int) *Mask {
+	return &Mask{
+		Width:  width,
+		Height: height,
+		Bits:   make([]uint64, (width*height+63)/64),
+	}
+}
+
+// Check returns an error if the mask isn't a valid mask of an image with the
+// given size (e.g. if it was received from a broken client)
+func (m *Mask) Check(width, height int) error {
+	if m.Width != width || m.Height != height {
+		return fmt.Errorf(
+			"mask size %dx%d doesn't match image size %dx%d",
+			m.Width, m.Height, width, height,
+		)
+	}
+	if len(m.Bits) < (width*height+63)/64 {
+		return fmt.Errorf("mask has %d words instead of %d", len(m.Bits), (width*height+63)/64)
+	}
+	return nil
+}
+
+// Set marks or unmarks the pixel at [x][y]
+func (m *Mask) Set(x, y int, value bool) {
+	index := uint(y*m.Width + x)
+	if value {
+		m.Bits[index/64] |= 1 << (index % 64)
+	} else {
+		m.Bits[index/64] &^= 1 << (index % 64)
+	}
+}
+
+// Get returns true if the pixel at [x][y] is marked
+func (m *Mask) Get(x, y int) bool {
+	index := uint(y*m.Width + x)
+	return m.Bits[index/64]&(1<<(index%64)) != 0
+}
+
+// Count returns the number of marked pixels
+func (m *Mask) Count() int {
+	count := 0
+	for _, bits := range m.Bits {
+		for ; bits != 0; bits &= bits - 1 {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,120 @@
+package hdrimage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+)
+
+// EncodePFM writes the image in the Portable Float Map (.pfm) format, as
+// little-endian RGB floats
+func (im *Image) EncodePFM(writer io.Writer) error {
+	buffer := bufio.NewWriter(writer)
+	fmt.Fprintf(buffer, "PF\n%d %d\n-1.0\n", im.Width, im.Height)
+
+	line := make([]byte, 0, 12*im.Width)
+	// scanlines go from the bottom to the top
+	for j := im.Height - 1; j >= 0; j-- {
+		line = line[:0]
+		for i := 0; i < im.Width; i++ {
+			colour := im.AtHDR(i, j)
+			line = appendFloat32(line, colour.R)
+			line = appendFloat32(line, colour.G)
+			line = appendFloat32(line, colour.B)
+		}
+		buffer.Write(line)
+	}
+	return buffer.Flush()
+}
+
+// DecodePFM reads an image in the Portable Float Map format (colour "PF" or
+// greyscale "Pf"). The scale in the header only sets the byte order.
+func DecodePFM(reader io.Reader) (*Image, error) {
+	buffer := bufio.NewReader(reader)
+	var fields [4]string
+	for i := range fields {
+		field, err := readPFMField(buffer)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read PFM header: %s", err)
+		}
+		fields[i] = field
+	}
+
+	var channels int
+	switch fields[0] {
+	case "PF":
+		channels = 3
+	case "Pf":
+		channels = 1
+	default:
+		return nil, fmt.Errorf("not a PFM image")
+	}
+	width, widthErr := strconv.Atoi(fields[1])
+	height, heightErr := strconv.Atoi(fields[2])
+	scale, scaleErr := strconv.ParseFloat(fields[3], 64)
+	if widthErr != nil || heightErr != nil || scaleErr != nil || scale == 0 {
+		return nil, fmt.Errorf("wrong PFM header")
+	}
+	if err := checkDecodedSize("PFM", width, height); err != nil {
+		return nil, err
+	}
+	var order binary.ByteOrder = binary.BigEndian
+	if scale < 0 {
+		order = binary.LittleEndian
+	}
+
+	// the pixels are read before the image is allocated, so that the size
+	// in the header has to match the data
+	lineSize := 4 * channels * width
+	data, err := ioutil.ReadAll(io.LimitReader(buffer, int64(lineSize*height)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read PFM data: %s", err)
+	}
+	if len(data) < lineSize*height {
+		return nil, fmt.Errorf("truncated PFM data")
+	}
+
+	im := New(width, height)
+	var line []byte
+	value := func(i int) float32 {
+		return math.Float32frombits(order.Uint32(line[4*i:]))
+	}
+	for j := height - 1; j >= 0; j-- {
+		line, data = data[:lineSize], data[lineSize:]
+		for i := 0; i < width; i++ {
+			if channels == 1 {
+				grey := value(i)
+				im.Pixels[i][j].SetColour(grey, grey, grey)
+			} else {
+				im.Pixels[i][j].SetColour(value(3*i), value(3*i+1), value(3*i+2))
+			}
+		}
+	}
+	return im, nil
+}
+
+// readPFMField reads a whitespace-separated field of a PFM header, and the
+// single whitespace character after it
+func readPFMField(reader *bufio.Reader) (string, error) {
+	var field []byte
+	for {
+		char, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if char == ' ' || char == '\t' || char == '\r' || char == '\n' {
+			if len(field) == 0 {
+				continue
+			}
+			return string(field), nil
+		}
+		if len(field) > 32 {
+			return "", fmt.Errorf("field too long")
+		}
+		field = append(field, char)
+	}
+}
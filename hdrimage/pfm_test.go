@@ -0,0 +1,63 @@
+package hdrimage
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/DexterLB/traytor/hdrcolour"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPFMRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	im := exrTestImage()
+
+	buffer := &bytes.Buffer{}
+	if err := im.EncodePFM(buffer); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal("PF\n37 21\n-1.0\n", buffer.String()[:14])
+
+	decoded, err := DecodePFM(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(im, decoded)
+}
+
+func TestPFMGreyscale(t *testing.T) {
+	assert := assert.New(t)
+
+	// big-endian, with the bottom scanline first
+	data := []byte("Pf 2\n2 1.0\n")
+	data = append(data, 0x3f, 0x80, 0, 0, 0x40, 0, 0, 0)
+	data = append(data, 0, 0, 0, 0, 0xbf, 0x80, 0, 0)
+
+	im, err := DecodePFM(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(hdrcolour.New(1, 1, 1), im.AtHDR(0, 1))
+	assert.Equal(hdrcolour.New(2, 2, 2), im.AtHDR(1, 1))
+	assert.Equal(hdrcolour.New(-1, -1, -1), im.AtHDR(1, 0))
+
+	_, err = DecodePFM(bytes.NewReader(data[:len(data)-1]))
+	assert.Error(err)
+	_, err = DecodePFM(bytes.NewReader([]byte("P6\n2 2\n255\n")))
+	assert.Error(err)
+}
+
+func TestPFMSizeIsChecked(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, header := range []string{
+		"PF\n100000 1\n-1.0\n",  // too wide
+		"PF\n8192 8192\n-1.0\n", // too many pixels
+		"PF\n4096 4096\n-1.0\n", // more pixels than data
+		"Pf\n0 1\n-1.0\n",       // empty
+	} {
+		data := append([]byte(header), make([]byte, 64)...)
+		_, err := DecodePFM(bytes.NewReader(data))
+		assert.Error(err, header)
+	}
+}
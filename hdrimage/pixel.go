@@ -0,0 +1,54 @@
+package hdrimage
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/DexterLB/traytor/hdrcolour"
+)
+
+// Quantum is the precision to which samples are rounded before they're added
+// to the sums in images. Sums of multiples of Quantum are exact (while they're
+// below 2^33), so they don't depend on the order in which samples are added:
+// the same samples always make the same image, however they're split between
+// threads and workers.
+const Quantum = 1.0 / (1 << 20)
+
+// Pixel is the sum of the colours of the samples of a pixel
+type Pixel struct {
+	R, G, B float64
+}
+
+// quantize rounds a value to a multiple of Quantum
+func quantize(value float32) float64 {
+	return math.Floor(float64(value)/Quantum+0.5) * Quantum
+}
+
+// AddColour adds the colour of a sample to the pixel
+func (p *Pixel) AddColour(colour *hdrcolour.Colour) {
+	p.R += quantize(colour.R)
+	p.G += quantize(colour.G)
+	p.B += quantize(colour.B)
+}
+
+// Add adds the samples of another pixel to this one
+func (p *Pixel) Add(other *Pixel) {
+	p.R += other.R
+	p.G += other.G
+	p.B += other.B
+}
+
+// SetColour sets the sum of the pixel's samples
+func (p *Pixel) SetColour(r, g, b float32) {
+	p.R, p.G, p.B = quantize(r), quantize(g), quantize(b)
+}
+
+// Scaled returns the sum of the pixel's samples multiplied by factor
+func (p *Pixel) Scaled(factor float64) *hdrcolour.Colour {
+	return hdrcolour.New(float32(p.R*factor), float32(p.G*factor), float32(p.B*factor))
+}
+
+// String returns the string representation of the pixel in the form of {r, g, b}
+func (p *Pixel) String() string {
+	return fmt.Sprintf("{%.3g, %.3g, %.3g}", p.R, p.G, p.B)
+}
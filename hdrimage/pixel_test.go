@@ -0,0 +1,36 @@
+package hdrimage
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/DexterLB/traytor/hdrcolour"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPixelSumsDontDependOnOrder(t *testing.T) {
+	assert := assert.New(t)
+
+	random := rand.New(rand.NewSource(42))
+	colours := make([]*hdrcolour.Colour, 1000)
+	for i := range colours {
+		colours[i] = hdrcolour.New(random.Float32()*100, random.Float32(), random.Float32()/1000)
+	}
+
+	var forwards Pixel
+	for _, colour := range colours {
+		forwards.AddColour(colour)
+	}
+
+	// add the colours backwards, in groups which are summed separately
+	var backwards Pixel
+	for start := len(colours); start > 0; start -= 7 {
+		var group Pixel
+		for i := start - 1; i >= 0 && i >= start-7; i-- {
+			group.AddColour(colours[i])
+		}
+		backwards.Add(&group)
+	}
+
+	assert.Equal(forwards, backwards)
+}
@@ -0,0 +1,255 @@
+package hdrimage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// rgbeMinRun is the shortest run of equal bytes written as a run in
+// run-length encoded Radiance scanlines
+const rgbeMinRun = 4
+
+// EncodeRGBE writes the image in Radiance's RGBE (.hdr) format, with run-length
+// encoded scanlines. Negative colour components are written as 0. The number
+// of samples per pixel is recorded in a SAMPLES= line of the header.
+func (im *Image) EncodeRGBE(writer io.Writer) error {
+	buffer := bufio.NewWriter(writer)
+	fmt.Fprintf(buffer, "#?RADIANCE\n# Made with traytor\nFORMAT=32-bit_rle_rgbe\n")
+	fmt.Fprintf(buffer, "SAMPLES=%.1f\n\n", im.SamplesPerPixel())
+	fmt.Fprintf(buffer, "-Y %d +X %d\n", im.Height, im.Width)
+
+	encoded := im.Width >= 8 && im.Width <= 0x7fff
+	line := make([]byte, 4*im.Width)
+	component := make([]byte, im.Width)
+	for j := 0; j < im.Height; j++ {
+		for i := 0; i < im.Width; i++ {
+			rgbe := toRGBE(im.AtHDR(i, j))
+			copy(line[4*i:], rgbe[:])
+		}
+		if !encoded {
+			buffer.Write(line)
+			continue
+		}
+
+		buffer.Write([]byte{2, 2, byte(im.Width >> 8), byte(im.Width)})
+		for c := 0; c < 4; c++ {
+			for i := range component {
+				component[i] = line[4*i+c]
+			}
+			buffer.Write(rgbeCompress(component))
+		}
+	}
+	return buffer.Flush()
+}
+
+// rgbeCompress run-length encodes a component of a scanline: a count above
+// 128 is followed by a byte repeated count - 128 times, and a smaller one by
+// count literal bytes
+func rgbeCompress(data []byte) []byte {
+	var result []byte
+	for i := 0; i < len(data); {
+		// find the next run which is long enough
+		runStart, runLength := i, 0
+		for runStart < len(data) {
+			runLength = 1
+			for runStart+runLength < len(data) && runLength < 127 &&
+				data[runStart+runLength] == data[runStart] {
+				runLength++
+			}
+			if runLength >= rgbeMinRun {
+				break
+			}
+			runStart += runLength
+		}
+
+		for i < runStart {
+			count := runStart - i
+			if count > 128 {
+				count = 128
+			}
+			result = append(result, byte(count))
+			result = append(result, data[i:i+count]...)
+			i += count
+		}
+		if runStart < len(data) {
+			result = append(result, byte(128+runLength), data[runStart])
+			i = runStart + runLength
+		}
+	}
+	return result
+}
+
+// DecodeRGBE reads an image in Radiance's RGBE (.hdr) format. Flat,
+// run-length encoded and old-style run-length encoded scanlines are
+// supported, but only images in the standard orientation (or flipped
+// vertically).
+func DecodeRGBE(reader io.Reader) (*Image, error) {
+	buffer := bufio.NewReader(reader)
+	width, height, flipped, exposure, err := readRGBEHeader(buffer)
+	if err != nil {
+		return nil, err
+	}
+	// each scanline takes at least 4 bytes, so the data is read before the
+	// image is allocated (the size is checked against it)
+	data, err := ioutil.ReadAll(buffer)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read RGBE data: %s", err)
+	}
+	if len(data) < 4*height {
+		return nil, fmt.Errorf("truncated RGBE data")
+	}
+	buffer = bufio.NewReader(bytes.NewReader(data))
+
+	im := New(width, height)
+	line := make([]byte, 4*width)
+	for j := 0; j < height; j++ {
+		if err := readRGBELine(buffer, line); err != nil {
+			return nil, err
+		}
+		y := j
+		if flipped {
+			y = height - j - 1
+		}
+		for i := 0; i < width; i++ {
+			colour := fromRGBE(line[4*i], line[4*i+1], line[4*i+2], line[4*i+3])
+			colour.Scale(float32(1 / exposure))
+			im.Pixels[i][y].SetColour(colour.R, colour.G, colour.B)
+		}
+	}
+	return im, nil
+}
+
+// readRGBEHeader reads the header and the resolution line of a Radiance
+// image. Pixel values are divided by the exposure to get the actual colours.
+func readRGBEHeader(reader *bufio.Reader) (width, height int, flipped bool, exposure float64, err error) {
+	exposure = 1
+	first := true
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return 0, 0, false, 0, fmt.Errorf("cannot read RGBE header: %s", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if first && !strings.HasPrefix(line, "#?") {
+			return 0, 0, false, 0, fmt.Errorf("not a Radiance image")
+		}
+		first = false
+
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, "FORMAT=") && line != "FORMAT=32-bit_rle_rgbe" {
+			return 0, 0, false, 0, fmt.Errorf("Unknown RGBE format: '%s'", line[len("FORMAT="):])
+		}
+		if strings.HasPrefix(line, "EXPOSURE=") {
+			value, err := strconv.ParseFloat(strings.TrimSpace(line[len("EXPOSURE="):]), 64)
+			if err != nil || value <= 0 {
+				return 0, 0, false, 0, fmt.Errorf("wrong RGBE exposure: '%s'", line)
+			}
+			exposure *= value
+		}
+	}
+
+	resolution, err := reader.ReadString('\n')
+	if err != nil {
+		return 0, 0, false, 0, fmt.Errorf("cannot read RGBE resolution: %s", err)
+	}
+	var yDirection, xDirection string
+	_, err = fmt.Sscanf(resolution, "%s %d %s %d", &yDirection, &height, &xDirection, &width)
+	if err != nil || xDirection != "+X" || (yDirection != "-Y" && yDirection != "+Y") {
+		return 0, 0, false, 0, fmt.Errorf("unsupported RGBE resolution: '%s'", strings.TrimSpace(resolution))
+	}
+	if err := checkDecodedSize("RGBE", width, height); err != nil {
+		return 0, 0, false, 0, err
+	}
+	return width, height, yDirection == "+Y", exposure, nil
+}
+
+// readRGBELine reads a scanline of RGBE pixels
+func readRGBELine(reader *bufio.Reader, line []byte) error {
+	width := len(line) / 4
+	start, err := reader.Peek(4)
+	if err != nil {
+		return fmt.Errorf("truncated RGBE data")
+	}
+	if width < 8 || width > 0x7fff || start[0] != 2 || start[1] != 2 || start[2]&0x80 != 0 {
+		return readOldRGBELine(reader, line)
+	}
+	if int(start[2])<<8|int(start[3]) != width {
+		return fmt.Errorf("wrong RGBE scanline width")
+	}
+	reader.Discard(4)
+
+	for c := 0; c < 4; c++ {
+		for i := 0; i < width; {
+			count, err := reader.ReadByte()
+			if err != nil {
+				return fmt.Errorf("truncated RGBE data")
+			}
+			if count > 128 {
+				count -= 128
+				value, err := reader.ReadByte()
+				if err != nil {
+					return fmt.Errorf("truncated RGBE data")
+				}
+				if i+int(count) > width {
+					return fmt.Errorf("wrong RGBE run length")
+				}
+				for ; count > 0; count-- {
+					line[4*i+c] = value
+					i++
+				}
+				continue
+			}
+			if count == 0 || i+int(count) > width {
+				return fmt.Errorf("wrong RGBE run length")
+			}
+			for ; count > 0; count-- {
+				value, err := reader.ReadByte()
+				if err != nil {
+					return fmt.Errorf("truncated RGBE data")
+				}
+				line[4*i+c] = value
+				i++
+			}
+		}
+	}
+	return nil
+}
+
+// readOldRGBELine reads a flat scanline, or one in which a (1, 1, 1, n)
+// pixel repeats the previous one n times (shifted by 8 bits for every
+// consecutive such pixel)
+func readOldRGBELine(reader *bufio.Reader, line []byte) error {
+	shift := uint(0)
+	pixel := make([]byte, 4)
+	for i := 0; i < len(line); {
+		if _, err := io.ReadFull(reader, pixel); err != nil {
+			return fmt.Errorf("truncated RGBE data")
+		}
+		if pixel[0] != 1 || pixel[1] != 1 || pixel[2] != 1 {
+			copy(line[i:], pixel)
+			i += 4
+			shift = 0
+			continue
+		}
+		if i == 0 {
+			return fmt.Errorf("wrong RGBE run at the beginning of a scanline")
+		}
+		count := int(pixel[3]) << shift
+		if i+4*count > len(line) {
+			return fmt.Errorf("wrong RGBE run length")
+		}
+		for ; count > 0; count-- {
+			copy(line[i:], line[i-4:i])
+			i += 4
+		}
+		shift += 8
+	}
+	return nil
+}
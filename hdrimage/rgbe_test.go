@@ -0,0 +1,122 @@
+package hdrimage
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/DexterLB/traytor/hdrcolour"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRGBERoundTrip(t *testing.T) {
+	assert := assert.New(t)
+
+	// wide images have run-length encoded scanlines, narrow ones are flat
+	narrow := New(5, 3)
+	for i := 0; i < narrow.Width; i++ {
+		for j := 0; j < narrow.Height; j++ {
+			narrow.Pixels[i][j].SetColour(float32(i), float32(j+1), 0.5)
+		}
+	}
+	for _, im := range []*Image{exrTestImage(), narrow} {
+		im.Pixels[1][2].SetColour(0.001, 3e5, 2e5)
+
+		buffer := &bytes.Buffer{}
+		if err := im.EncodeRGBE(buffer); err != nil {
+			t.Fatal(err)
+		}
+		data := buffer.Bytes()
+		decoded, err := DecodeRGBE(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(im.Width, decoded.Width)
+		assert.Equal(im.Height, decoded.Height)
+		for i := 0; i < im.Width; i++ {
+			for j := 0; j < im.Height; j++ {
+				expected, actual := im.AtHDR(i, j), decoded.AtHDR(i, j)
+				// the precision is relative to the largest component
+				max := math.Max(float64(expected.R), math.Max(float64(expected.G), float64(expected.B)))
+				assert.InDelta(expected.R, actual.R, max/128)
+				assert.InDelta(expected.G, actual.G, max/128)
+				assert.True(actual.B >= 0)
+			}
+		}
+
+		// decoded images are written back the same way
+		buffer.Reset()
+		if err := decoded.EncodeRGBE(buffer); err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(data, buffer.Bytes())
+	}
+}
+
+func TestRGBESamplesAreRecorded(t *testing.T) {
+	assert := assert.New(t)
+
+	im := New(2, 2)
+	im.Divisor = 12345
+
+	buffer := &bytes.Buffer{}
+	if err := im.EncodeRGBE(buffer); err != nil {
+		t.Fatal(err)
+	}
+	assert.Contains(buffer.String(), "\nSAMPLES=12345.0\n")
+
+	_, err := DecodeRGBE(bytes.NewReader(buffer.Bytes()))
+	assert.Nil(err)
+}
+
+func TestRGBEOldRunLength(t *testing.T) {
+	assert := assert.New(t)
+
+	data := []byte("#?RGBE\nEXPOSURE=2\n\n+Y 2 +X 3\n")
+	data = append(data, 128, 64, 0, 129, 1, 1, 1, 2) // one pixel, repeated twice
+	data = append(data, 0, 0, 0, 0, 0, 0, 0, 0, 128, 128, 128, 128)
+
+	im, err := DecodeRGBE(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first scanline is the bottom one, and the exposure is divided out
+	expected := hdrcolour.New(128.5/256, 64.5/256, 0.5/256)
+	for i := 0; i < 3; i++ {
+		assert.Equal(expected, im.AtHDR(i, 1))
+	}
+	assert.Equal(hdrcolour.New(0, 0, 0), im.AtHDR(0, 0))
+	assert.Equal(hdrcolour.New(128.5/512, 128.5/512, 128.5/512), im.AtHDR(2, 0))
+
+	_, err = DecodeRGBE(bytes.NewReader([]byte("#?RADIANCE\nFORMAT=32-bit_rle_xyze\n\n-Y 1 +X 1\n")))
+	assert.Error(err)
+	_, err = DecodeRGBE(bytes.NewReader([]byte("#?RADIANCE\n\n-Y 1 +X 1\n")))
+	assert.Error(err)
+}
+
+func TestRGBESizeIsChecked(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, resolution := range []string{
+		"-Y 1 +X 100000",  // too wide
+		"-Y 8192 +X 8192", // too many pixels
+		"-Y 4096 +X 4096", // more scanlines than data
+		"-Y 0 +X 1",       // empty
+	} {
+		data := []byte("#?RADIANCE\n\n" + resolution + "\n")
+		data = append(data, make([]byte, 64)...)
+		_, err := DecodeRGBE(bytes.NewReader(data))
+		assert.Error(err, resolution)
+	}
+}
+
+func TestRGBECompress(t *testing.T) {
+	assert := assert.New(t)
+
+	data := []byte{1, 2, 3, 3, 3, 4, 4, 4, 4, 5}
+	for i := 0; i < 200; i++ {
+		data = append(data, 7)
+	}
+	assert.Equal([]byte{5, 1, 2, 3, 3, 3, 0x84, 4, 1, 5, 0xff, 7, 0xc9, 7}, rgbeCompress(data))
+}
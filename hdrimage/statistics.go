@@ -0,0 +1,109 @@
+package hdrimage
+
+import (
+	"math"
+
+	"github.com/DexterLB/traytor/hdrcolour"
+)
+
+// PixelStatistics describes the samples taken in a single pixel, and is used
+// for estimating the pixel's noise
+type PixelStatistics struct {
+	Samples    int
+	Sum        float64 // sum of the intensities of the samples
+	SquaredSum float64 // sum of the squared intensities of the samples
+}
+
+// Add adds the statistics of other samples to these
+func (s *PixelStatistics) Add(other *PixelStatistics) {
+	s.Samples += other.Samples
+	s.Sum += other.Sum
+	s.SquaredSum += other.SquaredSum
+}
+
+// RelativeError returns the standard error of the pixel's mean intensity,
+// relative to the mean itself (so that dark pixels aren't considered
+// converged too early). It's infinite if there are less than 2 samples.
+func (s *PixelStatistics) RelativeError() float64 {
+	if s.Samples < 2 {
+		return math.Inf(1)
+	}
+	n := float64(s.Samples)
+	mean := s.Sum / n
+	variance := math.Max(0, (s.SquaredSum-n*mean*mean)/(n-1))
+	return math.Sqrt(variance/n) / (mean + 1e-3)
+}
+
+// Record adds a sample taken in the pixel at [x][y] to the pixel's
+// statistics (it doesn't change the colour of the pixel). Like the colours
+// of samples, the intensities are rounded to multiples of Quantum.
+func (im *Image) Record(x, y int, colour *hdrcolour.Colour) {
+	im.initStatistics()
+	intensity := colour.Intensity()
+	statistics := &im.Statistics[x][y]
+	statistics.Samples++
+	statistics.Sum += quantize(intensity)
+	statistics.SquaredSum += quantize(intensity * intensity)
+}
+
+// SamplesPerPixel returns the average number of samples taken in each
+// sampled pixel (which is the divisor, unless the pixels have different
+// numbers of samples)
+func (im *Image) SamplesPerPixel() float64 {
+	if im.Statistics == nil {
+		return float64(im.Divisor)
+	}
+	samples, pixels := 0, 0
+	for i := range im.Statistics {
+		for j := range im.Statistics[i] {
+			if im.Statistics[i][j].Samples > 0 {
+				samples += im.Statistics[i][j].Samples
+				pixels++
+			}
+		}
+	}
+	if pixels == 0 {
+		return 0
+	}
+	return float64(samples) / float64(pixels)
+}
+
+// initStatistics creates empty statistics if they don't exist
+func (im *Image) initStatistics() {
+	if im.Statistics != nil {
+		return
+	}
+	im.Statistics = make([][]PixelStatistics, im.Width)
+	for i := range im.Statistics {
+		im.Statistics[i] = make([]PixelStatistics, im.Height)
+	}
+}
+
+// NoisyPixels returns a mask of the pixels whose relative error is above
+// threshold. If the image has no statistics, all pixels are considered noisy.
+func (im *Image) NoisyPixels(threshold float64) *Mask {
+	mask := NewMask(im.Width, im.Height)
+	for i := 0; i < im.Width; i++ {
+		for j := 0; j < im.Height; j++ {
+			mask.Set(i, j, im.Statistics == nil ||
+				im.Statistics[i][j].RelativeError() > threshold)
+		}
+	}
+	return mask
+}
+
+// NoiseImage returns a grey image of the relative error of each pixel (see
+// RelativeError), or nil if the image has no statistics
+func (im *Image) NoiseImage() *Image {
+	if im.Statistics == nil {
+		return nil
+	}
+	noise := New(im.Width, im.Height)
+	for i := 0; i < im.Width; i++ {
+		for j := 0; j < im.Height; j++ {
+			relativeError := float32(im.Statistics[i][j].RelativeError())
+			noise.Pixels[i][j].SetColour(relativeError, relativeError, relativeError)
+		}
+	}
+	return noise
+}
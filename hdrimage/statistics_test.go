@@ -0,0 +1,84 @@
+package hdrimage
+
+import (
+	"math"
+	"testing"
+
+	"github.com/DexterLB/traytor/hdrcolour"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMask(t *testing.T) {
+	assert := assert.New(t)
+
+	mask := NewMask(10, 10)
+	assert.Equal(0, mask.Count())
+
+	mask.Set(3, 4, true)
+	mask.Set(9, 9, true)
+	mask.Set(0, 7, true)
+	mask.Set(0, 7, false)
+
+	assert.True(mask.Get(3, 4))
+	assert.True(mask.Get(9, 9))
+	assert.False(mask.Get(0, 7))
+	assert.False(mask.Get(4, 3))
+	assert.Equal(2, mask.Count())
+}
+
+func TestMaskCheck(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(NewMask(10, 10).Check(10, 10))
+	assert.NotNil(NewMask(10, 10).Check(10, 11))
+	assert.NotNil((&Mask{Width: 10, Height: 10, Bits: make([]uint64, 1)}).Check(10, 10))
+}
+
+func TestRelativeError(t *testing.T) {
+	assert := assert.New(t)
+
+	s := &PixelStatistics{}
+	assert.True(math.IsInf(s.RelativeError(), 1), "Pixels without samples should be infinitely noisy")
+
+	s = &PixelStatistics{Samples: 4, Sum: 4, SquaredSum: 4}
+	assert.Equal(0.0, s.RelativeError(), "Pixels with identical samples should have no noise")
+
+	s = &PixelStatistics{Samples: 4, Sum: 2, SquaredSum: 2}
+	// variance of {0, 0, 1, 1} is 1/3, so the standard error is 1/sqrt(12)
+	assert.InDelta(1/math.Sqrt(12)/0.501, s.RelativeError(), 1e-6)
+}
+
+func TestNoisyPixels(t *testing.T) {
+	assert := assert.New(t)
+
+	im := New(2, 1)
+	assert.Equal(2, im.NoisyPixels(0.1).Count(), "Images without statistics should be entirely noisy")
+
+	for i := 0; i < 16; i++ {
+		im.Record(0, 0, hdrcolour.New(1, 1, 1))
+		im.Record(1, 0, hdrcolour.New(float32(i%2), float32(i%2), float32(i%2)))
+	}
+
+	mask := im.NoisyPixels(0.1)
+	assert.False(mask.Get(0, 0))
+	assert.True(mask.Get(1, 0))
+
+	other := New(2, 1)
+	other.Add(im)
+	assert.Equal(16, other.Statistics[1][0].Samples, "Adding images should add their statistics")
+}
+
+func TestSamplesPerPixel(t *testing.T) {
+	assert := assert.New(t)
+
+	im := New(3, 1)
+	im.Divisor = 5
+	assert.Equal(5.0, im.SamplesPerPixel(), "Images without statistics should use the divisor")
+
+	for i := 0; i < 4; i++ {
+		im.Record(0, 0, hdrcolour.New(1, 1, 1))
+	}
+	im.Record(1, 0, hdrcolour.New(1, 1, 1))
+	im.Record(1, 0, hdrcolour.New(1, 1, 1))
+	assert.Equal(3.0, im.SamplesPerPixel(), "Pixels without samples shouldn't be counted")
+}
@@ -0,0 +1,48 @@
+package hdrimage
+
+import "image"
+
+// Tile is a rectangular part of a larger image (e.g. a frame), whose
+// top-left pixel is at (X, Y) in the larger image
+type Tile struct {
+	Image *Image
+	X, Y  int
+}
+
+// NewTile creates an empty tile which covers the given rectangle
+// of the larger image
+func NewTile(rect image.Rectangle) *Tile {
+	im := New(rect.Dx(), rect.Dy())
+	im.Divisor = 0
+	return &Tile{Image: im, X: rect.Min.X, Y: rect.Min.Y}
+}
+
+// Bounds returns the rectangle which the tile covers in the larger image
+func (t *Tile) Bounds() image.Rectangle {
+	return image.Rect(t.X, t.Y, t.X+t.Image.Width, t.Y+t.Image.Height)
+}
+
+// AddTile adds the tile's pixels (with their weights and statistics) to the
+// corresponding pixels of this image. Parts of the tile which are outside
+// the image are ignored. Since different parts of the image may have
+// different numbers of samples, the image always gets per-pixel weights
+// (and the divisor isn't changed).
+func (im *Image) AddTile(tile *Tile) {
+	bounds := tile.Bounds().Intersect(im.Bounds())
+
+	im.initWeights()
+	if tile.Image.Statistics != nil {
+		im.initStatistics()
+	}
+
+	for i := bounds.Min.X; i < bounds.Max.X; i++ {
+		for j := bounds.Min.Y; j < bounds.Max.Y; j++ {
+			x, y := i-tile.X, j-tile.Y
+			im.Pixels[i][j].Add(&tile.Image.Pixels[x][y])
+			im.Weights[i][j] += tile.Image.Weight(x, y)
+			if tile.Image.Statistics != nil {
+				im.Statistics[i][j].Add(&tile.Image.Statistics[x][y])
+			}
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package hdrimage
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"io/ioutil"
+)
+
+// Compressions of wire images
+const (
+	CompressionNone    = "none"
+	CompressionDeflate = "deflate"
+)
+
+// Compressions contains all supported compressions of wire images, best first
+var Compressions = []string{CompressionDeflate, CompressionNone}
+
+// WireFormat describes how images are encoded for sending over the network
+type WireFormat struct {
+	Encoding    string // pixel encoding (see Encodings)
+	Compression string // compression of the encoded pixels (see Compressions)
+	// Crop makes only the smallest rectangle which contains all non-empty
+	// pixels be sent (e.g. when rendering a region or adaptively)
+	Crop bool
+}
+
+// Check returns an error if the encoding or the compression isn't supported
+func (format *WireFormat) Check() error {
+	if _, err := colourCodecs(format.Encoding); err != nil {
+		return err
+	}
+	switch format.Compression {
+	case CompressionNone, "", CompressionDeflate:
+		return nil
+	default:
+		return fmt.Errorf("Unknown compression: '%s'", format.Compression)
+	}
+}
+
+// WireImage is an image (or a tile) encoded for sending over the network.
+// Only the pixels in Bounds are encoded; all others are empty.
+type WireImage struct {
+	Width, Height int
+	X, Y          int // position of a tile in the larger image
+	Divisor       int
+	Bounds        image.Rectangle
+
+	Format     WireFormat
+	Weights    bool // the data contains per-pixel weights
+	Statistics bool // the data contains per-pixel statistics
+	Data       []byte
+}
+
+// EncodeWire encodes the image in the given format
+func (im *Image) EncodeWire(format *WireFormat) (*WireImage, error) {
+	codec, err := colourCodecs(format.Encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	wire := &WireImage{
+		Width:      im.Width,
+		Height:     im.Height,
+		Divisor:    im.Divisor,
+		Bounds:     im.Bounds(),
+		Format:     *format,
+		Weights:    im.Weights != nil,
+		Statistics: im.Statistics != nil,
+	}
+	if format.Crop {
+		wire.Bounds = im.nonEmptyBounds()
+	}
+
+	var buffer bytes.Buffer
+	var writer io.Writer = &buffer
+	var compressor *flate.Writer
+	switch format.Compression {
+	case CompressionNone, "":
+	case CompressionDeflate:
+		compressor, _ = flate.NewWriter(&buffer, flate.BestSpeed)
+		writer = compressor
+	default:
+		return nil, fmt.Errorf("Unknown compression: '%s'", format.Compression)
+	}
+
+	row := make([]byte, 0, wire.pixelSize(codec)*wire.Bounds.Dx())
+	for j := wire.Bounds.Min.Y; j < wire.Bounds.Max.Y; j++ {
+		row = row[:0]
+		for i := wire.Bounds.Min.X; i < wire.Bounds.Max.X; i++ {
+			if wire.Weights {
+				row = codec.appendFloat(row, im.Weights[i][j])
+			}
+			row = codec.encode(row, &im.Pixels[i][j], im.Weight(i, j))
+			if wire.Statistics {
+				statistics := &im.Statistics[i][j]
+				row = appendUint32(row, uint32(statistics.Samples))
+				row = codec.appendFloat(row, statistics.Sum)
+				row = codec.appendFloat(row, statistics.SquaredSum)
+			}
+		}
+		if _, err := writer.Write(row); err != nil {
+			return nil, err
+		}
+	}
+
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return nil, err
+		}
+	}
+	wire.Data = buffer.Bytes()
+	return wire, nil
+}
+
+// Decode decodes the image
+func (wire *WireImage) Decode() (*Image, error) {
+	codec, err := colourCodecs(wire.Format.Encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	im := New(wire.Width, wire.Height)
+	im.Divisor = wire.Divisor
+	if wire.Weights {
+		im.Weights = make([][]float64, im.Width)
+		for i := range im.Weights {
+			im.Weights[i] = make([]float64, im.Height)
+		}
+	}
+	if wire.Statistics {
+		im.initStatistics()
+	}
+	if wire.Bounds.Empty() {
+		return im, nil
+	}
+	if !wire.Bounds.In(im.Bounds()) {
+		return nil, fmt.Errorf("encoded pixels are outside of the image")
+	}
+
+	var reader io.Reader = bytes.NewReader(wire.Data)
+	switch wire.Format.Compression {
+	case CompressionNone, "":
+	case CompressionDeflate:
+		reader = flate.NewReader(reader)
+	default:
+		return nil, fmt.Errorf("Unknown compression: '%s'", wire.Format.Compression)
+	}
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress image data: %s", err)
+	}
+	if len(data) != wire.pixelSize(codec)*wire.Bounds.Dx()*wire.Bounds.Dy() {
+		return nil, fmt.Errorf("wrong size of image data")
+	}
+
+	for j := wire.Bounds.Min.Y; j < wire.Bounds.Max.Y; j++ {
+		for i := wire.Bounds.Min.X; i < wire.Bounds.Max.X; i++ {
+			if wire.Weights {
+				im.Weights[i][j], data = codec.readFloat(data)
+			}
+			data = codec.decode(data, &im.Pixels[i][j], im.Weight(i, j))
+			if wire.Statistics {
+				statistics := &im.Statistics[i][j]
+				statistics.Samples = int(binary.LittleEndian.Uint32(data))
+				statistics.Sum, data = codec.readFloat(data[4:])
+				statistics.SquaredSum, data = codec.readFloat(data)
+			}
+		}
+	}
+	return im, nil
+}
+
+// EncodeWire encodes the tile in the given format
+func (t *Tile) EncodeWire(format *WireFormat) (*WireImage, error) {
+	wire, err := t.Image.EncodeWire(format)
+	if err != nil {
+		return nil, err
+	}
+	wire.X, wire.Y = t.X, t.Y
+	return wire, nil
+}
+
+// DecodeTile decodes a tile
+func (wire *WireImage) DecodeTile() (*Tile, error) {
+	im, err := wire.Decode()
+	if err != nil {
+		return nil, err
+	}
+	return &Tile{Image: im, X: wire.X, Y: wire.Y}, nil
+}
+
+// pixelSize returns the number of bytes in which each pixel is encoded
+func (wire *WireImage) pixelSize(codec *colourCodec) int {
+	size := codec.size
+	if wire.Weights {
+		size += codec.floatSize()
+	}
+	if wire.Statistics {
+		size += 4 + 2*codec.floatSize()
+	}
+	return size
+}
+
+// nonEmptyBounds returns the smallest rectangle which contains all pixels
+// with samples
+func (im *Image) nonEmptyBounds() image.Rectangle {
+	if im.Weights == nil && im.Statistics == nil {
+		if im.Divisor == 0 {
+			return image.Rectangle{}
+		}
+		return im.Bounds()
+	}
+
+	var bounds image.Rectangle
+	for i := 0; i < im.Width; i++ {
+		for j := 0; j < im.Height; j++ {
+			empty := im.Weight(i, j) == 0 && im.Pixels[i][j] == Pixel{}
+			if im.Statistics != nil && im.Statistics[i][j].Samples != 0 {
+				empty = false
+			}
+			if !empty {
+				bounds = bounds.Union(image.Rect(i, j, i+1, j+1))
+			}
+		}
+	}
+	return bounds
+}
@@ -0,0 +1,264 @@
+package hdrimage
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/DexterLB/traytor/hdrcolour"
+)
+
+// Pixel encodings of wire images
+const (
+	// EncodingFloat64 keeps the pixels exactly as they are
+	EncodingFloat64 = "float64"
+	// EncodingFloat32 stores each component as a single-precision float
+	// (exact only while the sums are small)
+	EncodingFloat32 = "float32"
+	// EncodingFloat16 stores each component as a half-precision float
+	EncodingFloat16 = "float16"
+	// EncodingRGBE stores the components with a shared exponent in four
+	// bytes (negative components become zero)
+	EncodingRGBE = "rgbe"
+)
+
+// Encodings contains all supported pixel encodings of wire images, most
+// precise first
+var Encodings = []string{EncodingFloat64, EncodingFloat32, EncodingFloat16, EncodingRGBE}
+
+// colourCodec encodes the colours of pixels. Lossy codecs encode the
+// colour divided by the pixel's weight (which is sent separately), so that
+// the error doesn't depend on the number of samples.
+type colourCodec struct {
+	size   int  // encoded size of a colour, in bytes
+	wide   bool // weights and statistics are sent as float64 (not float32)
+	encode func(data []byte, pixel *Pixel, weight float64) []byte
+	// decode reads a colour from the beginning of data, and returns the
+	// rest of the data
+	decode func(data []byte, pixel *Pixel, weight float64) []byte
+}
+
+// colourCodecs returns the codec of a pixel encoding
+func colourCodecs(encoding string) (*colourCodec, error) {
+	switch encoding {
+	case EncodingFloat64:
+		return &colourCodec{
+			size: 24,
+			wide: true,
+			encode: func(data []byte, pixel *Pixel, weight float64) []byte {
+				data = appendFloat64(data, pixel.R)
+				data = appendFloat64(data, pixel.G)
+				return appendFloat64(data, pixel.B)
+			},
+			decode: func(data []byte, pixel *Pixel, weight float64) []byte {
+				pixel.R, pixel.G, pixel.B = readFloat64(data), readFloat64(data[8:]), readFloat64(data[16:])
+				return data[24:]
+			},
+		}, nil
+	case EncodingFloat32, "":
+		return &colourCodec{
+			size: 12,
+			encode: func(data []byte, pixel *Pixel, weight float64) []byte {
+				data = appendFloat32(data, float32(pixel.R))
+				data = appendFloat32(data, float32(pixel.G))
+				return appendFloat32(data, float32(pixel.B))
+			},
+			decode: func(data []byte, pixel *Pixel, weight float64) []byte {
+				pixel.SetColour(readFloat32(data), readFloat32(data[4:]), readFloat32(data[8:]))
+				return data[12:]
+			},
+		}, nil
+	case EncodingFloat16:
+		return &colourCodec{
+			size: 6,
+			encode: func(data []byte, pixel *Pixel, weight float64) []byte {
+				average := averageColour(pixel, weight)
+				data = appendUint16(data, toHalf(average.R))
+				data = appendUint16(data, toHalf(average.G))
+				return appendUint16(data, toHalf(average.B))
+			},
+			decode: func(data []byte, pixel *Pixel, weight float64) []byte {
+				sumColour(pixel, hdrcolour.New(
+					fromHalf(binary.LittleEndian.Uint16(data)),
+					fromHalf(binary.LittleEndian.Uint16(data[2:])),
+					fromHalf(binary.LittleEndian.Uint16(data[4:])),
+				), weight)
+				return data[6:]
+			},
+		}, nil
+	case EncodingRGBE:
+		return &colourCodec{
+			size: 4,
+			encode: func(data []byte, pixel *Pixel, weight float64) []byte {
+				rgbe := toRGBE(averageColour(pixel, weight))
+				return append(data, rgbe[:]...)
+			},
+			decode: func(data []byte, pixel *Pixel, weight float64) []byte {
+				sumColour(pixel, fromRGBE(data[0], data[1], data[2], data[3]), weight)
+				return data[4:]
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("Unknown pixel encoding: '%s'", encoding)
+	}
+}
+
+// averageColour returns the colour of a pixel divided by its weight
+func averageColour(pixel *Pixel, weight float64) *hdrcolour.Colour {
+	if weight == 0 {
+		return pixel.Scaled(1)
+	}
+	return pixel.Scaled(1 / weight)
+}
+
+// sumColour sets the pixel to a colour returned by averageColour multiplied
+// by the weight
+func sumColour(pixel *Pixel, colour *hdrcolour.Colour, weight float64) {
+	if weight != 0 {
+		colour.Scale(float32(weight))
+	}
+	pixel.SetColour(colour.R, colour.G, colour.B)
+}
+
+// toHalf converts a float to the nearest half-precision float (values too
+// large for it become the largest one)
+func toHalf(f float32) uint16 {
+	bits := math.Float32bits(f)
+	sign := uint16(bits>>16) & 0x8000
+	exponent := int(bits>>23&0xff) - 127 + 15
+	mantissa := bits & 0x7fffff
+
+	switch {
+	case f != f:
+		return sign | 0x7e00
+	case exponent >= 0x1f:
+		return sign | 0x7bff
+	case exponent <= 0:
+		// subnormal
+		if exponent < -10 {
+			return sign
+		}
+		mantissa |= 0x800000
+		shift := uint(14 - exponent)
+		half := uint16(mantissa >> shift)
+		if mantissa>>(shift-1)&1 != 0 {
+			half++
+		}
+		return sign | half
+	}
+
+	half := uint16(exponent)<<10 | uint16(mantissa>>13)
+	if mantissa&0x1000 != 0 {
+		half++
+	}
+	if half >= 0x7c00 {
+		half = 0x7bff
+	}
+	return sign | half
+}
+
+// fromHalf converts a half-precision float to a float
+func fromHalf(half uint16) float32 {
+	sign := uint32(half&0x8000) << 16
+	exponent := uint32(half>>10) & 0x1f
+	mantissa := uint32(half & 0x3ff)
+
+	switch exponent {
+	case 0:
+		// zero or subnormal
+		value := float32(mantissa) / (1 << 24)
+		if sign != 0 {
+			return -value
+		}
+		return value
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mantissa<<13)
+	}
+	return math.Float32frombits(sign | (exponent-15+127)<<23 | mantissa<<13)
+}
+
+// toRGBE converts a colour to Radiance's shared exponent format
+func toRGBE(colour *hdrcolour.Colour) [4]byte {
+	r, g, b := positive(colour.R), positive(colour.G), positive(colour.B)
+	max := math.Max(r, math.Max(g, b))
+	if max < 1e-32 {
+		return [4]byte{}
+	}
+	fraction, exponent := math.Frexp(max)
+	if exponent > 127 {
+		return [4]byte{255, 255, 255, 255}
+	}
+	scale := fraction * 256 / max
+	return [4]byte{byte(r * scale), byte(g * scale), byte(b * scale), byte(exponent + 128)}
+}
+
+// fromRGBE converts a colour in Radiance's shared exponent format
+func fromRGBE(r, g, b, e byte) *hdrcolour.Colour {
+	if e == 0 {
+		return hdrcolour.New(0, 0, 0)
+	}
+	scale := math.Ldexp(1, int(e)-(128+8))
+	return hdrcolour.New(
+		float32((float64(r)+0.5)*scale),
+		float32((float64(g)+0.5)*scale),
+		float32((float64(b)+0.5)*scale),
+	)
+}
+
+// positive returns the value, or 0 if it's negative
+func positive(value float32) float64 {
+	if value < 0 {
+		return 0
+	}
+	return float64(value)
+}
+
+func appendUint16(data []byte, value uint16) []byte {
+	return append(data, byte(value), byte(value>>8))
+}
+
+func appendUint32(data []byte, value uint32) []byte {
+	return append(data, byte(value), byte(value>>8), byte(value>>16), byte(value>>24))
+}
+
+func appendFloat32(data []byte, value float32) []byte {
+	return appendUint32(data, math.Float32bits(value))
+}
+
+func readFloat32(data []byte) float32 {
+	return math.Float32frombits(binary.LittleEndian.Uint32(data))
+}
+
+func appendFloat64(data []byte, value float64) []byte {
+	bits := math.Float64bits(value)
+	return appendUint32(appendUint32(data, uint32(bits)), uint32(bits>>32))
+}
+
+func readFloat64(data []byte) float64 {
+	return math.Float64frombits(binary.LittleEndian.Uint64(data))
+}
+
+// floatSize returns the encoded size of weights and statistics sums
+func (codec *colourCodec) floatSize() int {
+	if codec.wide {
+		return 8
+	}
+	return 4
+}
+
+// appendFloat encodes a weight or a statistics sum
+func (codec *colourCodec) appendFloat(data []byte, value float64) []byte {
+	if codec.wide {
+		return appendFloat64(data, value)
+	}
+	return appendFloat32(data, float32(value))
+}
+
+// readFloat reads a weight or a statistics sum from the beginning of data,
+// and returns the rest of the data
+func (codec *colourCodec) readFloat(data []byte) (float64, []byte) {
+	if codec.wide {
+		return readFloat64(data), data[8:]
+	}
+	return float64(readFloat32(data)), data[4:]
+}
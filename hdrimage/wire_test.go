@@ -0,0 +1,104 @@
+package hdrimage
+
+import (
+	"image"
+	"testing"
+
+	"github.com/DexterLB/traytor/hdrcolour"
+	"github.com/stretchr/testify/assert"
+)
+
+// wireTestImage returns an image in which only a region has samples
+func wireTestImage() *Image {
+	im := New(8, 6)
+	im.Divisor = 0
+	for i := 2; i < 5; i++ {
+		for j := 1; j < 4; j++ {
+			colour := hdrcolour.New(float32(i)*3.5, float32(j)*0.25, 100)
+			im.Splat(i, j, colour, 2)
+			im.Record(i, j, colour)
+		}
+	}
+	return im
+}
+
+func TestWireImageRoundTrip(t *testing.T) {
+	assert := assert.New(t)
+	im := wireTestImage()
+
+	// float32 is exact too, since the sums in the test image are small
+	for _, encoding := range []string{EncodingFloat64, EncodingFloat32} {
+		for _, compression := range Compressions {
+			wire, err := im.EncodeWire(&WireFormat{
+				Encoding:    encoding,
+				Compression: compression,
+				Crop:        true,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(image.Rect(2, 1, 5, 4), wire.Bounds)
+
+			decoded, err := wire.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(im, decoded, encoding)
+		}
+	}
+}
+
+func TestWireImageLossy(t *testing.T) {
+	assert := assert.New(t)
+	im := wireTestImage()
+
+	for _, encoding := range []string{EncodingFloat16, EncodingRGBE} {
+		wire, err := im.EncodeWire(&WireFormat{Encoding: encoding})
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := wire.Decode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		assert.Equal(im.Weights, decoded.Weights)
+		assert.Equal(im.Statistics, decoded.Statistics)
+		for i := 0; i < im.Width; i++ {
+			for j := 0; j < im.Height; j++ {
+				// each component is within 1% of the brightest one
+				expected, actual := im.Pixels[i][j], decoded.Pixels[i][j]
+				assert.InDelta(expected.R, actual.R, 1, encoding)
+				assert.InDelta(expected.G, actual.G, 1, encoding)
+				assert.InDelta(expected.B, actual.B, 1, encoding)
+			}
+		}
+	}
+}
+
+func TestHalf(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, value := range []float32{0, 1, -2, 0.5, 1024, 65504, 6.103515625e-05, 5.9604645e-08} {
+		assert.Equal(value, fromHalf(toHalf(value)))
+	}
+	assert.Equal(float32(65504), fromHalf(toHalf(1e10)))
+	assert.InDelta(0.1, fromHalf(toHalf(0.1)), 0.0001)
+}
+
+func TestWireTile(t *testing.T) {
+	assert := assert.New(t)
+
+	tile := NewTile(image.Rect(16, 32, 20, 34))
+	wire, err := tile.EncodeWire(&WireFormat{Encoding: EncodingFloat16, Crop: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(wire.Bounds.Empty())
+
+	decoded, err := wire.DecodeTile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(tile, decoded)
+}
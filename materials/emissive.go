@@ -1,7 +1,6 @@
 package materials
 
 import (
-	"github.com/DexterLB/traytor/hdrcolour"
 	"github.com/DexterLB/traytor/ray"
 	"github.com/DexterLB/traytor/sampler"
 )
@@ -12,7 +11,9 @@ type EmissiveMaterial struct {
 	Strength *sampler.AnySampler
 }
 
-// Shade returns the emitted colour after intersecting the material
-func (m *EmissiveMaterial) Shade(intersection *ray.Intersection, raytracer Raytracer) *hdrcolour.Colour {
-	return m.Colour.GetColour(intersection).Scaled(float32(m.Strength.GetFac(intersection)))
+// Shade emits the lamp's colour and absorbs the path
+func (m *EmissiveMaterial) Shade(intersection *ray.Intersection, raytracer Raytracer, sample *Sample) {
+	sample.Emission = *m.Colour.GetColour(intersection)
+	sample.Emission.Scale(float32(m.Strength.GetFac(intersection)))
+	sample.Absorbed = true
 }
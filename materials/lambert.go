@@ -1,10 +1,10 @@
 package materials
 
 import (
-	"github.com/DexterLB/traytor/hdrcolour"
 	"github.com/DexterLB/traytor/maths"
 	"github.com/DexterLB/traytor/ray"
 	"github.com/DexterLB/traytor/sampler"
+	"github.com/DexterLB/traytor/sequence"
 )
 
 // LambertMaterial is a simple diffuse material
@@ -12,12 +12,10 @@ type LambertMaterial struct {
 	Colour *sampler.AnySampler
 }
 
-// Shade returns the emitted colour after intersecting the material
-func (m *LambertMaterial) Shade(intersection *ray.Intersection, raytracer Raytracer) *hdrcolour.Colour {
-	randomRayDir := *raytracer.RandomGen().Vec3HemiCos(intersection.Normal)
-	randomRayStart := *maths.AddVectors(intersection.Point, intersection.Normal.Scaled(maths.Epsilon))
-	ray := &ray.Ray{Start: randomRayStart, Direction: randomRayDir, Depth: intersection.Incoming.Depth + 1}
-	colour := raytracer.Raytrace(ray)
-	colour.MultiplyBy(m.Colour.GetColour(intersection))
-	return colour
+// Shade bounces the path in a cosine-weighed random direction
+func (m *LambertMaterial) Shade(intersection *ray.Intersection, raytracer Raytracer, sample *Sample) {
+	u, v := raytracer.SequenceGen().Get2D()
+	sample.Ray.Direction = *sequence.Vec3HemiCos(intersection.Normal, u, v)
+	sample.Ray.Start = *maths.AddVectors(intersection.Point, intersection.Normal.Scaled(maths.Epsilon))
+	sample.Weight = *m.Colour.GetColour(intersection)
 }
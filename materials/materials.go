@@ -6,19 +6,37 @@ import (
 
 	"github.com/DexterLB/traytor/hdrcolour"
 	"github.com/DexterLB/traytor/jsonutil"
-	"github.com/DexterLB/traytor/random"
 	"github.com/DexterLB/traytor/ray"
+	"github.com/DexterLB/traytor/sequence"
 )
 
 // Raytracer is any possible raytracer
 type Raytracer interface {
-	Raytrace(incoming *ray.Ray) *hdrcolour.Colour
-	RandomGen() *random.Random
+	SequenceGen() sequence.Sequence
+}
+
+// Sample is the result of shading a single intersection (a BSDF sample):
+// the light emitted at the intersection point, and the direction and weight
+// of the path's next bounce
+type Sample struct {
+	Emission hdrcolour.Colour
+	Weight   hdrcolour.Colour
+	Ray      ray.Ray
+	Absorbed bool // the path ends here and Weight and Ray are meaningless
+}
+
+// Reset makes the sample black, with no emission and no bounce
+func (s *Sample) Reset() {
+	s.Emission.MakeZero()
+	s.Weight.MakeZero()
+	s.Absorbed = false
 }
 
 // Material objects are used to shade surfaces
 type Material interface {
-	Shade(intersection *ray.Intersection, raytracer Raytracer) *hdrcolour.Colour
+	// Shade fills sample with the emission at the intersection and the
+	// next bounce of the path
+	Shade(intersection *ray.Intersection, raytracer Raytracer, sample *Sample)
 }
 
 // AnyMaterial implements the Material interface and is deserialiseable from json
@@ -1,7 +1,6 @@
 package materials
 
 import (
-	"github.com/DexterLB/traytor/hdrcolour"
 	"github.com/DexterLB/traytor/ray"
 )
 
@@ -12,10 +11,11 @@ type MixedMaterial struct {
 	Coefficient float64
 }
 
-// Shade returns colour depending on coefficient and random number
-func (m *MixedMaterial) Shade(intersection *ray.Intersection, raytracer Raytracer) *hdrcolour.Colour {
-	if raytracer.RandomGen().Float01() < m.Coefficient {
-		return m.First.Shade(intersection, raytracer)
+// Shade chooses one of the materials depending on coefficient and a random number
+func (m *MixedMaterial) Shade(intersection *ray.Intersection, raytracer Raytracer, sample *Sample) {
+	if raytracer.SequenceGen().Get1D() < m.Coefficient {
+		m.First.Shade(intersection, raytracer, sample)
+		return
 	}
-	return m.Second.Shade(intersection, raytracer)
+	m.Second.Shade(intersection, raytracer, sample)
 }
@@ -1,7 +1,6 @@
 package materials
 
 import (
-	"github.com/DexterLB/traytor/hdrcolour"
 	"github.com/DexterLB/traytor/maths"
 	"github.com/DexterLB/traytor/ray"
 	"github.com/DexterLB/traytor/sampler"
@@ -13,12 +12,10 @@ type ReflectiveMaterial struct {
 	Roughness *sampler.AnySampler
 }
 
-// Shade returns the emitted colour after intersecting the material
-func (m *ReflectiveMaterial) Shade(intersection *ray.Intersection, raytracer Raytracer) *hdrcolour.Colour {
+// Shade bounces the path in the mirror direction
+func (m *ReflectiveMaterial) Shade(intersection *ray.Intersection, raytracer Raytracer, sample *Sample) {
 	incoming := intersection.Incoming
-	colour := m.Colour.GetColour(intersection)
-	reflectedRay := &ray.Ray{Depth: incoming.Depth + 1}
-	reflectedRay.Direction = *incoming.Direction.Reflected(intersection.Normal)
-	reflectedRay.Start = *maths.AddVectors(intersection.Point, intersection.Normal.Scaled(maths.Epsilon))
-	return hdrcolour.MultiplyColours(raytracer.Raytrace(reflectedRay), colour)
+	sample.Ray.Direction = *incoming.Direction.Reflected(intersection.Normal)
+	sample.Ray.Start = *maths.AddVectors(intersection.Point, intersection.Normal.Scaled(maths.Epsilon))
+	sample.Weight = *m.Colour.GetColour(intersection)
 }
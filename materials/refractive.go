@@ -1,7 +1,6 @@
 package materials
 
 import (
-	"github.com/DexterLB/traytor/hdrcolour"
 	"github.com/DexterLB/traytor/maths"
 	"github.com/DexterLB/traytor/ray"
 	"github.com/DexterLB/traytor/sampler"
@@ -14,12 +13,12 @@ type RefractiveMaterial struct {
 	IOR       *sampler.AnySampler
 }
 
-// Shade returns the emitted colour after intersecting the material
-func (m *RefractiveMaterial) Shade(intersection *ray.Intersection, raytracer Raytracer) *hdrcolour.Colour {
+// Shade bounces the path through the surface (or reflects it on total
+// inner reflection)
+func (m *RefractiveMaterial) Shade(intersection *ray.Intersection, raytracer Raytracer, sample *Sample) {
 	incoming := &intersection.Incoming.Direction
 	normal := intersection.Normal
 	ior := m.IOR.GetFac(intersection)
-	colour := m.Colour.GetColour(intersection)
 	refracted := &maths.Vec3{}
 	startPoint := &maths.Vec3{}
 
@@ -44,9 +43,7 @@ func (m *RefractiveMaterial) Shade(intersection *ray.Intersection, raytracer Ray
 		)
 	}
 
-	newRay := &ray.Ray{Depth: intersection.Incoming.Depth + 1}
-	newRay.Start = *startPoint
-	newRay.Direction = *refracted
-	return hdrcolour.MultiplyColours(raytracer.Raytrace(newRay), colour)
-
+	sample.Ray.Start = *startPoint
+	sample.Ray.Direction = *refracted
+	sample.Weight = *m.Colour.GetColour(intersection)
 }
@@ -1,49 +1,187 @@
 package raytracer
 
 import (
+	"context"
+	"image"
+	"math"
+	"sync/atomic"
+
+	"github.com/DexterLB/traytor/filter"
 	"github.com/DexterLB/traytor/hdrcolour"
 	"github.com/DexterLB/traytor/hdrimage"
-	"github.com/DexterLB/traytor/random"
+	"github.com/DexterLB/traytor/materials"
 	"github.com/DexterLB/traytor/ray"
 	"github.com/DexterLB/traytor/scene"
+	"github.com/DexterLB/traytor/sequence"
 )
 
 // Raytracer represents a single rendering unit
 type Raytracer struct {
-	Scene  *scene.Scene
-	Random *random.Random
+	// Rays is the number of rays traced so far, including bounces (accessed
+	// atomically, so that it can be read while rendering; it's first so
+	// that it's aligned on 32-bit platforms)
+	Rays int64
+
+	Scene    *scene.Scene
+	Sequence sequence.Sequence
+	Filter   filter.Filter // if nil, samples only contribute to their own pixel
+
+	// Mask, if not nil, contains the only pixels which will be sampled
+	Mask *hdrimage.Mask
+	// Region, if not empty, is the only rectangle of pixels which will be
+	// sampled (pixels outside of it are left black)
+	Region image.Rectangle
+	// TrackVariance makes the raytracer record the statistics of each sample
+	// into the image (used for adaptive sampling)
+	TrackVariance bool
+
+	// SampleIndex is the index (in the sample sequence) of the next sample
+	SampleIndex int
 }
 
-// RandomGen returns the raytracer's random generator
-func (r *Raytracer) RandomGen() *random.Random {
-	return r.Random
+// SequenceGen returns the raytracer's sample sequence
+func (r *Raytracer) SequenceGen() sequence.Sequence {
+	return r.Sequence
 }
 
-// Raytrace returns the colour obtained by tracing the given ray
+// Raytrace returns the colour obtained by tracing the given ray.
+// The path is followed iteratively: each material hit contributes its
+// emission scaled by the path's throughput (the product of the weights of
+// all previous bounces), and then scales the throughput by its own weight.
 func (r *Raytracer) Raytrace(incoming *ray.Ray) *hdrcolour.Colour {
-	if incoming.Depth > r.Scene.MaxDepth {
-		return hdrcolour.New(0, 0, 0)
-	}
-	intersectionInfo := r.Scene.Mesh.Intersect(incoming)
-	if intersectionInfo == nil {
-		return hdrcolour.New(0, 0, 0)
+	radiance := hdrcolour.New(0, 0, 0)
+	throughput := hdrcolour.Colour{R: 1, G: 1, B: 1}
+	path := *incoming
+	var sample materials.Sample
+	rays := int64(0) // counted here, and added to r.Rays once per sample
+
+	for path.Depth <= r.Scene.MaxDepth {
+		rays++
+		intersectionInfo := r.Scene.Mesh.Intersect(&path)
+		if intersectionInfo == nil {
+			break
+		}
+
+		sample.Reset()
+		r.Scene.Materials[intersectionInfo.Material].Shade(intersectionInfo, r, &sample)
+
+		sample.Emission.MultiplyBy(&throughput)
+		radiance.Add(&sample.Emission)
+
+		if sample.Absorbed {
+			break
+		}
+		throughput.MultiplyBy(&sample.Weight)
+		if throughput.R <= 0 && throughput.G <= 0 && throughput.B <= 0 {
+			break
+		}
+
+		sample.Ray.Depth = path.Depth + 1
+		path = sample.Ray
 	}
-	return r.Scene.Materials[intersectionInfo.Material].Shade(intersectionInfo, r)
+
+	atomic.AddInt64(&r.Rays, rays)
+	return radiance
 }
 
 // Sample adds another sample to the image by changing it.
-func (r *Raytracer) Sample(image *hdrimage.Image) {
+// Each call uses the next sample index of the raytracer's sequence.
+// If the raytracer has a mask or a region, pixels outside of them are left
+// unchanged, so the image gets per-pixel weights.
+// If ctx is cancelled, Sample stops and returns its error, leaving the sample
+// half-rendered in the image (which should be thrown away).
+func (r *Raytracer) Sample(ctx context.Context, image *hdrimage.Image) error {
+	err := r.SampleTile(ctx, &hdrimage.Tile{Image: image}, image.Width, image.Height, image.Bounds())
+	if err != nil {
+		return err
+	}
+	image.Divisor++
+	return nil
+}
+
+// SampleTile adds another sample to the pixels of region, which is given in
+// the coordinates of a frame with the given size. The samples are added to
+// tile, which is a part of the frame (and doesn't need to contain the whole
+// region: only the pixels of the tile change, and when splatting with a
+// filter, the tile should be large enough to contain the filter's radius
+// around the region). Like Sample, SampleTile uses the next sample index of
+// the raytracer's sequence (unless it's cancelled), but doesn't change the
+// tile's divisor.
+func (r *Raytracer) SampleTile(
+	ctx context.Context,
+	tile *hdrimage.Tile,
+	frameWidth, frameHeight int,
+	region image.Rectangle,
+) error {
 	var ray *ray.Ray
 	var colour *hdrcolour.Colour
-	for i := 0; i < image.Width; i++ {
-		for j := 0; j < image.Height; j++ {
+	image := tile.Image
+	if !r.Region.Empty() {
+		region = region.Intersect(r.Region)
+	}
+	for i := region.Min.X; i < region.Max.X; i++ {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+		for j := region.Min.Y; j < region.Max.Y; j++ {
+			if r.Mask != nil && !r.Mask.Get(i, j) {
+				continue
+			}
+			r.Sequence.StartPixelSample(i, j, r.SampleIndex)
+			jitterX, jitterY := r.Sequence.Get2D()
+			x, y := float64(i)+jitterX, float64(j)+jitterY
 			ray = r.Scene.Camera.ShootRay(
-				(float64(i)+r.Random.Float01())/float64(image.Width),
-				(float64(j)+r.Random.Float01())/float64(image.Height),
+				x/float64(frameWidth),
+				y/float64(frameHeight),
 			)
 			colour = r.Raytrace(ray)
-			image.Pixels[i][j].Add(colour)
+
+			if r.Filter != nil {
+				r.splat(tile, x, y, colour)
+			}
+
+			tileX, tileY := i-tile.X, j-tile.Y
+			if tileX < 0 || tileY < 0 || tileX >= image.Width || tileY >= image.Height {
+				continue
+			}
+			if r.TrackVariance {
+				image.Record(tileX, tileY, colour)
+			}
+			switch {
+			case r.Filter != nil:
+			case r.Mask != nil:
+				image.Splat(tileX, tileY, colour, 1)
+			default:
+				image.Pixels[tileX][tileY].AddColour(colour)
+			}
+		}
+	}
+	r.SampleIndex++
+	return nil
+}
+
+// splat adds the colour of a sample taken at (x, y) (in frame pixels) to all
+// pixels of the tile within the filter's radius, weighed by the filter
+func (r *Raytracer) splat(tile *hdrimage.Tile, x, y float64, colour *hdrcolour.Colour) {
+	radius := r.Filter.Radius()
+	bounds := tile.Bounds()
+	minX := int(math.Max(float64(bounds.Min.X), math.Ceil(x-0.5-radius)))
+	maxX := int(math.Min(float64(bounds.Max.X-1), math.Floor(x-0.5+radius)))
+	minY := int(math.Max(float64(bounds.Min.Y), math.Ceil(y-0.5-radius)))
+	maxY := int(math.Min(float64(bounds.Max.Y-1), math.Floor(y-0.5+radius)))
+
+	var weighed hdrcolour.Colour
+	for i := minX; i <= maxX; i++ {
+		for j := minY; j <= maxY; j++ {
+			weight := r.Filter.Evaluate(float64(i)+0.5-x, float64(j)+0.5-y)
+			if weight == 0 {
+				continue
+			}
+			weighed = *colour
+			weighed.Scale(float32(weight))
+			tile.Image.Splat(i-tile.X, j-tile.Y, &weighed, float32(weight))
 		}
 	}
-	image.Divisor++
 }
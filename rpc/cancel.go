@@ -0,0 +1,78 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// ErrCancelled is returned for requests which have been cancelled with Cancel
+var ErrCancelled = errors.New("request was cancelled")
+
+// runningRequest is a request which is being rendered (or waits for a
+// free thread)
+type runningRequest struct {
+	job    string
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// runningRequests keeps the requests which are being rendered, so that
+// they can be cancelled by their job
+type runningRequests struct {
+	mutex    sync.Mutex
+	requests map[*runningRequest]struct{}
+}
+
+func newRunningRequests() *runningRequests {
+	return &runningRequests{requests: make(map[*runningRequest]struct{})}
+}
+
+// start registers a request of the given job
+func (r *runningRequests) start(job string) *runningRequest {
+	request := &runningRequest{job: job}
+	request.ctx, request.cancel = context.WithCancel(context.Background())
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.requests[request] = struct{}{}
+	return request
+}
+
+// finish forgets a request which has finished
+func (r *runningRequests) finish(request *runningRequest) {
+	request.cancel()
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	delete(r.requests, request)
+}
+
+// cancel cancels the requests of the job, and of the jobs under it (whose
+// IDs start with the job's ID and a slash), and returns how many there were
+func (r *runningRequests) cancel(job string) int {
+	if job == "" {
+		return 0
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	cancelled := 0
+	for request := range r.requests {
+		if request.job == job || strings.HasPrefix(request.job, job+"/") {
+			request.cancel()
+			cancelled++
+		}
+	}
+	return cancelled
+}
+
+// requestError returns ErrCancelled instead of the error of a cancelled
+// context, so that clients get a meaningful message
+func requestError(err error) error {
+	if err == context.Canceled {
+		return ErrCancelled
+	}
+	return err
+}
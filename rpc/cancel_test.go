@@ -0,0 +1,87 @@
+package rpc
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancelJobs(t *testing.T) {
+	assert := assert.New(t)
+	running := newRunningRequests()
+
+	first := running.start("render/1")
+	second := running.start("render/2")
+	other := running.start("renderer/1")
+	unnamed := running.start("")
+
+	assert.Equal(1, running.cancel("render/2"))
+	assert.NotNil(second.ctx.Err())
+	assert.Nil(first.ctx.Err())
+
+	assert.Equal(2, running.cancel("render"))
+	assert.NotNil(first.ctx.Err())
+	assert.Nil(other.ctx.Err())
+
+	assert.Equal(0, running.cancel(""))
+	assert.Nil(unnamed.ctx.Err())
+
+	running.finish(first)
+	running.finish(second)
+	assert.Equal(0, running.cancel("render"))
+}
+
+func TestCancelledSamplesArentStored(t *testing.T) {
+	assert := assert.New(t)
+
+	data, err := ioutil.ReadFile("../sample_scenes/01_triangle.json.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr := NewConcurrentRaytracer(1, nil, 42)
+	id, err := cr.Scenes.Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings := &SampleSettings{Scene: id, Width: 8, Height: 6, SamplesAtOnce: 3}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(context.Canceled, cr.StoreSampleContext(ctx, settings))
+	assert.Equal(0, cr.GetImage(settings).Width)
+
+	_, err = cr.SampleContext(ctx, settings)
+	assert.Equal(context.Canceled, err)
+	samples, _ := cr.Rendered()
+	assert.Equal(int64(0), samples)
+}
+
+func TestCancelRunningRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	data, err := ioutil.ReadFile("../sample_scenes/01_triangle.json.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := NewRemoteRaytracer(42, 1, 2, 1000000)
+	id, err := rr.LoadScene(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errs := make(chan error)
+	go func() {
+		errs <- rr.StoreSample(&SampleSettings{
+			Scene: id, Width: 64, Height: 48, SamplesAtOnce: 1000000, Job: "render/1",
+		})
+	}()
+
+	for rr.Cancel("render") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(ErrCancelled, <-errs)
+	assert.False(rr.Raytracer.HasStoredSamples())
+}
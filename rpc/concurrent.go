@@ -1,29 +1,112 @@
 package rpc
 
 import (
+	"context"
 	"fmt"
+	"image"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/DexterLB/traytor/filter"
 	"github.com/DexterLB/traytor/hdrimage"
-	"github.com/DexterLB/traytor/random"
 	"github.com/DexterLB/traytor/raytracer"
 	"github.com/DexterLB/traytor/scene"
+	"github.com/DexterLB/traytor/sequence"
 )
 
 // ConcurrentRaytracer can render image samples on a scene in parallel,
 // and has locks to ensure a maximum number of parallel renders.
 // It can store samples internally, and they can be collected on demand.
+// Besides its own scene, it can render the scenes in its scene cache.
 type ConcurrentRaytracer struct {
+	samples int64 // rendered samples (accessed atomically)
+	// next is the index of the next sample of requests which aren't
+	// indexed (accessed atomically)
+	next int64
+
+	seed            int64 // seed of the sequences of requests which aren't indexed
 	parallelSamples int
 	units           chan *renderUnit
+	allUnits        []*renderUnit
+	// draining is held while all units are taken, so that two callers
+	// which each hold some of them don't wait for each other forever
+	draining sync.Mutex
+
+	storedMutex sync.Mutex
+	stored      map[string]time.Time // when samples were last stored or collected, by storeKey
+	Scenes      *SceneCache
 }
 
 type renderUnit struct {
 	raytracer raytracer.Raytracer
-	image     *hdrimage.Image
+	scene     *scene.Scene               // rendered when the settings name no scene
+	images    map[string]*hdrimage.Image // stored samples, by storeKey
+	seed      int64                      // seed of the sequence
+	sequence  string                     // name of the sequence
+}
+
+// storeKey returns the key under which samples rendered with the settings
+// are stored, so that samples of different sessions, scenes or sizes
+// aren't mixed
+func storeKey(settings *SampleSettings) string {
+	return fmt.Sprintf("%s/%s/%dx%d", settings.Session, settings.Scene, settings.Width, settings.Height)
+}
+
+// configure makes the unit's raytracer use the scene, sample sequence, filter,
+// mask and region from the settings, and continue from the sample with the
+// given index of the sequence with the given seed. The sequence is created
+// anew only if its name or seed has changed.
+func (u *renderUnit) configure(
+	settings *SampleSettings,
+	seed int64,
+	first int,
+	scenes *SceneCache,
+) error {
+	u.raytracer.Scene = u.scene
+	if settings.Scene != "" {
+		u.raytracer.Scene = scenes.Get(settings.Scene)
+		if u.raytracer.Scene == nil {
+			return fmt.Errorf("Unknown scene: '%s'", settings.Scene)
+		}
+	}
+	if u.raytracer.Scene == nil {
+		return fmt.Errorf("N/A scene")
+	}
+
+	mask := settings.Mask
+	if mask != nil {
+		if err := mask.Check(settings.Width, settings.Height); err != nil {
+			return err
+		}
+	}
+	u.raytracer.Mask = mask
+	u.raytracer.Region = settings.Region
+	u.raytracer.TrackVariance = settings.Adaptive
+
+	var err error
+	u.raytracer.Filter, err = filter.New(settings.Filter, settings.FilterRadius)
+	if err != nil {
+		return err
+	}
+
+	u.raytracer.SampleIndex = first
+	if u.raytracer.Sequence != nil && u.sequence == settings.Sequence && u.seed == seed {
+		return nil
+	}
+	sequence, err := sequence.New(settings.Sequence, seed)
+	if err != nil {
+		return err
+	}
+	u.raytracer.Sequence = sequence
+	u.sequence = settings.Sequence
+	u.seed = seed
+	return nil
 }
 
 // NewConcurrentRaytracer creates a concurrent raytracer with parallelSamples
-// allowed number of parallel operations
+// allowed number of parallel operations. The seed is used for the sample
+// sequences of the requests which aren't indexed (see SampleSettings).
 func NewConcurrentRaytracer(
 	parallelSamples int,
 	scene *scene.Scene,
@@ -34,20 +117,20 @@ func NewConcurrentRaytracer(
 	}
 
 	cr := &ConcurrentRaytracer{
+		seed:            seed,
 		parallelSamples: parallelSamples,
 		units:           make(chan *renderUnit, parallelSamples),
+		Scenes:          NewSceneCache(0, 0),
+		stored:          make(map[string]time.Time),
 	}
 
-	randomGen := random.New(seed)
-
 	for i := 0; i < parallelSamples; i++ {
-		cr.units <- &renderUnit{
-			raytracer: raytracer.Raytracer{
-				Scene:  scene,
-				Random: random.New(randomGen.NewSeed()),
-			},
-			image: nil,
+		unit := &renderUnit{
+			scene:  scene,
+			images: make(map[string]*hdrimage.Image),
 		}
+		cr.allUnits = append(cr.allUnits, unit)
+		cr.units <- unit
 	}
 
 	return cr
@@ -58,46 +141,157 @@ func NewConcurrentRaytracer(
 // the merged samples with GetImage(). StoreSample will block if the parallel
 // calls exceed the parallelSamples value, and wait for other samples to finish.
 func (cr *ConcurrentRaytracer) StoreSample(settings *SampleSettings) error {
-	unit := <-cr.units
-	if unit.raytracer.Scene == nil {
-		return fmt.Errorf("N/A scene")
-	}
+	return cr.StoreSampleContext(context.Background(), settings)
+}
 
-	if unit.image == nil {
-		unit.image = hdrimage.New(settings.Width, settings.Height)
-		unit.image.Divisor = 0
+// StoreSampleContext works like StoreSample(), but stops waiting or rendering
+// when ctx is cancelled, returning its error. None of the samples of a
+// cancelled call are stored.
+func (cr *ConcurrentRaytracer) StoreSampleContext(ctx context.Context, settings *SampleSettings) error {
+	unit, err := cr.acquire(ctx, settings)
+	if err != nil {
+		return err
 	}
 
+	image := hdrimage.New(settings.Width, settings.Height)
+	image.Divisor = 0
 	for i := 0; i < settings.SamplesAtOnce; i++ {
-		unit.raytracer.Sample(unit.image)
+		if err := unit.raytracer.Sample(ctx, image); err != nil {
+			cr.units <- unit
+			return err
+		}
 	}
 
-	cr.units <- unit
+	key := storeKey(settings)
+	if stored := unit.images[key]; stored != nil {
+		stored.Add(image)
+		stored.Divisor += image.Divisor
+	} else {
+		unit.images[key] = image
+	}
+	cr.touch(key)
+
+	cr.release(unit, settings.SamplesAtOnce)
 	return nil
 }
 
 // Sample works like StoreSample(), but instead of storing the image internally,
 // returns a new image.
 func (cr *ConcurrentRaytracer) Sample(settings *SampleSettings) (*hdrimage.Image, error) {
-	unit := <-cr.units
+	return cr.SampleContext(context.Background(), settings)
+}
 
-	if unit.raytracer.Scene == nil {
-		return nil, fmt.Errorf("N/A scene")
+// SampleContext works like Sample(), but stops waiting or rendering when ctx
+// is cancelled, returning its error.
+func (cr *ConcurrentRaytracer) SampleContext(ctx context.Context, settings *SampleSettings) (*hdrimage.Image, error) {
+	unit, err := cr.acquire(ctx, settings)
+	if err != nil {
+		return nil, err
 	}
 	image := hdrimage.New(settings.Width, settings.Height)
 	image.Divisor = 0
 
 	for i := 0; i < settings.SamplesAtOnce; i++ {
-		unit.raytracer.Sample(image)
+		if err := unit.raytracer.Sample(ctx, image); err != nil {
+			cr.units <- unit
+			return nil, err
+		}
 	}
 
-	cr.units <- unit
+	cr.release(unit, settings.SamplesAtOnce)
 
 	return image, nil
 }
 
-// getAllUnits empties the units channel and returns the extracted units
+// SampleTile works like Sample(), but renders only the pixels of
+// settings.Tile, returning them (and the pixels around them which
+// receive samples from the reconstruction filter) as a tile of the image.
+// An empty settings.Tile means the whole image.
+func (cr *ConcurrentRaytracer) SampleTile(settings *SampleSettings) (*hdrimage.Tile, error) {
+	return cr.SampleTileContext(context.Background(), settings)
+}
+
+// SampleTileContext works like SampleTile(), but stops waiting or rendering
+// when ctx is cancelled, returning its error.
+func (cr *ConcurrentRaytracer) SampleTileContext(ctx context.Context, settings *SampleSettings) (*hdrimage.Tile, error) {
+	unit, err := cr.acquire(ctx, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	frame := image.Rect(0, 0, settings.Width, settings.Height)
+	region := settings.Tile.Intersect(frame)
+	if settings.Tile.Empty() {
+		region = frame
+	}
+	border := filter.Border(unit.raytracer.Filter)
+	tile := hdrimage.NewTile(region.Inset(-border).Intersect(frame))
+
+	for i := 0; i < settings.SamplesAtOnce; i++ {
+		err := unit.raytracer.SampleTile(ctx, tile, settings.Width, settings.Height, region)
+		if err != nil {
+			cr.units <- unit
+			return nil, err
+		}
+		tile.Image.Divisor++
+	}
+
+	cr.release(unit, settings.SamplesAtOnce)
+
+	return tile, nil
+}
+
+// acquire waits for a free unit (unless ctx is cancelled) and configures it
+// with the settings, if they're valid. Requests which aren't indexed get the
+// next samples of the raytracer's own sequence.
+func (cr *ConcurrentRaytracer) acquire(ctx context.Context, settings *SampleSettings) (*renderUnit, error) {
+	if err := settings.check(); err != nil {
+		return nil, err
+	}
+	var unit *renderUnit
+	select {
+	case unit = <-cr.units:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	seed, first := settings.Seed, settings.FirstSample
+	if !settings.Indexed {
+		samples := int64(settings.SamplesAtOnce)
+		seed, first = cr.seed, int(atomic.AddInt64(&cr.next, samples)-samples)
+	}
+	if err := unit.configure(settings, seed, first, cr.Scenes); err != nil {
+		cr.units <- unit
+		return nil, err
+	}
+	return unit, nil
+}
+
+// release returns a unit which has rendered the given number of samples,
+// counting them
+func (cr *ConcurrentRaytracer) release(unit *renderUnit, samples int) {
+	atomic.AddInt64(&cr.samples, int64(samples))
+	cr.units <- unit
+}
+
+// Rendered returns the number of samples rendered and rays traced so far
+// (including the rays of the samples which are being rendered)
+func (cr *ConcurrentRaytracer) Rendered() (samples int64, rays int64) {
+	for _, unit := range cr.allUnits {
+		rays += atomic.LoadInt64(&unit.raytracer.Rays)
+	}
+	return atomic.LoadInt64(&cr.samples), rays
+}
+
+// Busy returns the number of rendering units which are in use (rendering
+// samples, or having their samples collected)
+func (cr *ConcurrentRaytracer) Busy() int {
+	return cr.parallelSamples - len(cr.units)
+}
+
+// getAllUnits empties the units channel and returns the extracted units.
+// They must be given back with pushAllUnits.
 func (cr *ConcurrentRaytracer) getAllUnits() []*renderUnit {
+	cr.draining.Lock()
 	units := make([]*renderUnit, cr.parallelSamples)
 	for i := range units {
 		unit := <-cr.units
@@ -111,35 +305,75 @@ func (cr *ConcurrentRaytracer) pushAllUnits(units []*renderUnit) {
 	for i := range units {
 		cr.units <- units[i]
 	}
+	cr.draining.Unlock()
 }
 
-// SetScene sets a new scene, resetting the state of the raytracer
+// SetScene sets the scene which is rendered when the settings name no
+// scene, resetting the stored samples
 func (cr *ConcurrentRaytracer) SetScene(scene *scene.Scene) {
 	units := cr.getAllUnits()
 	for _, unit := range units {
-		unit.image = nil
-		unit.raytracer.Scene = scene
+		unit.images = make(map[string]*hdrimage.Image)
+		unit.scene = scene
 	}
+	cr.storedMutex.Lock()
+	cr.stored = make(map[string]time.Time)
+	cr.storedMutex.Unlock()
 	cr.pushAllUnits(units)
 }
 
-// GetImage collects all samples up to this moment (and waits for those that
-// are currently being rendered to finish), and merges them.
-// StoreSample() can be called during calling this function, and will block until
-// it finishes. Next samples will start from zero (e.g. the base image is reset)
-func (cr *ConcurrentRaytracer) GetImage() *hdrimage.Image {
+// touch records that samples have been stored under the key
+func (cr *ConcurrentRaytracer) touch(key string) {
+	cr.storedMutex.Lock()
+	defer cr.storedMutex.Unlock()
+	cr.stored[key] = time.Now()
+}
+
+// ExpireStored drops the stored samples which haven't been stored or
+// collected for longer than maxAge (e.g. because their client has gone
+// away), and returns the number of renders whose samples were dropped
+func (cr *ConcurrentRaytracer) ExpireStored(maxAge time.Duration) int {
+	units := cr.getAllUnits()
+	defer cr.pushAllUnits(units)
+
+	cr.storedMutex.Lock()
+	defer cr.storedMutex.Unlock()
+	expired := 0
+	for key, used := range cr.stored {
+		if time.Since(used) <= maxAge {
+			continue
+		}
+		for _, unit := range units {
+			delete(unit.images, key)
+		}
+		delete(cr.stored, key)
+		expired++
+	}
+	return expired
+}
+
+// GetImage collects all samples stored with the session, scene and size from the settings
+// up to this moment (and waits for those that are currently being rendered to finish),
+// and merges them. StoreSample() can be called during calling this function, and will
+// block until it finishes. Next samples will start from zero (e.g. the base image is reset)
+func (cr *ConcurrentRaytracer) GetImage(settings *SampleSettings) *hdrimage.Image {
+	key := storeKey(settings)
 	var mergedSamples *hdrimage.Image
 
 	units := cr.getAllUnits()
 	for _, unit := range units {
+		image := unit.images[key]
 		if mergedSamples == nil {
-			mergedSamples = unit.image
-		} else if unit.image != nil {
-			mergedSamples.Add(unit.image)
-			mergedSamples.Divisor += unit.image.Divisor
+			mergedSamples = image
+		} else if image != nil {
+			mergedSamples.Add(image)
+			mergedSamples.Divisor += image.Divisor
 		}
-		unit.image = nil
+		delete(unit.images, key)
 	}
+	cr.storedMutex.Lock()
+	delete(cr.stored, key)
+	cr.storedMutex.Unlock()
 	cr.pushAllUnits(units)
 
 	if mergedSamples == nil {
@@ -148,6 +382,49 @@ func (cr *ConcurrentRaytracer) GetImage() *hdrimage.Image {
 	return mergedSamples
 }
 
+// Snapshot works like GetImage(), but returns a copy of the samples without
+// resetting them, so that the image can be previewed while it's being
+// rendered
+func (cr *ConcurrentRaytracer) Snapshot(settings *SampleSettings) *hdrimage.Image {
+	key := storeKey(settings)
+	var snapshot *hdrimage.Image
+
+	units := cr.getAllUnits()
+	for _, unit := range units {
+		image := unit.images[key]
+		if image == nil {
+			continue
+		}
+		if snapshot == nil {
+			snapshot = hdrimage.New(image.Width, image.Height)
+			snapshot.Divisor = 0
+		}
+		snapshot.Add(image)
+		snapshot.Divisor += image.Divisor
+	}
+	if snapshot != nil {
+		cr.touch(key)
+	}
+	cr.pushAllUnits(units)
+
+	if snapshot == nil {
+		return hdrimage.New(0, 0)
+	}
+	return snapshot
+}
+
+// HasStoredSamples returns true if there are samples which haven't been
+// collected with GetImage() (waiting for the ones being rendered)
+func (cr *ConcurrentRaytracer) HasStoredSamples() bool {
+	stored := false
+	units := cr.getAllUnits()
+	for _, unit := range units {
+		stored = stored || len(unit.images) > 0
+	}
+	cr.pushAllUnits(units)
+	return stored
+}
+
 // ParallelSamples returns the number of allowed parallel samples
 func (cr *ConcurrentRaytracer) ParallelSamples() int {
 	return cr.parallelSamples
@@ -0,0 +1,114 @@
+package rpc
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/DexterLB/traytor/hdrimage"
+	"github.com/stretchr/testify/assert"
+)
+
+// deterministicSettings loads a scene with diffuse bounces on the raytracer
+// and returns settings for indexed samples of it
+func deterministicSettings(t *testing.T, cr *ConcurrentRaytracer) *SampleSettings {
+	data, err := ioutil.ReadFile("../sample_scenes/03_pretty_cube.json.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := cr.Scenes.Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &SampleSettings{
+		Scene:    id,
+		Width:    12,
+		Height:   8,
+		Sequence: "random",
+		Filter:   "gaussian",
+		Indexed:  true,
+		Seed:     7,
+	}
+}
+
+func TestRendersDontDependOnSplittingOfSamples(t *testing.T) {
+	assert := assert.New(t)
+	const samples = 12
+
+	single := NewConcurrentRaytracer(1, nil, 1)
+	settings := deterministicSettings(t, single)
+	settings.SamplesAtOnce = samples
+	if err := single.StoreSample(settings); err != nil {
+		t.Fatal(err)
+	}
+	expected := single.GetImage(settings)
+	assert.NotEqual(hdrimage.Pixel{}, expected.Pixels[6][4])
+
+	// stored samples, rendered in parallel in batches of different sizes
+	parallel := NewConcurrentRaytracer(3, nil, 2)
+	settings = deterministicSettings(t, parallel)
+	counter := NewSampleCounter(samples)
+	wg := sync.WaitGroup{}
+	for batchSize := 1; batchSize <= 3; batchSize++ {
+		wg.Add(1)
+		go func(batchSize int) {
+			defer wg.Done()
+			settings := *settings
+			for {
+				taken := counter.Dec(batchSize)
+				if taken.Count == 0 {
+					return
+				}
+				settings.FirstSample, settings.SamplesAtOnce = taken.First, taken.Count
+				assert.Nil(parallel.StoreSample(&settings))
+			}
+		}(batchSize)
+	}
+	wg.Wait()
+	stored := parallel.GetImage(settings)
+	assert.Equal(expected.Divisor, stored.Divisor)
+	assert.Equal(expected.Pixels, stored.Pixels)
+	assert.Equal(expected.Weights, stored.Weights)
+
+	// returned samples, merged in reverse order after a lossless round trip
+	merged := hdrimage.New(settings.Width, settings.Height)
+	merged.Divisor = 0
+	for first := samples - 1; first >= 0; first-- {
+		settings.FirstSample, settings.SamplesAtOnce = first, 1
+		image, err := parallel.Sample(settings)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wire, err := image.EncodeWire(&hdrimage.WireFormat{Encoding: hdrimage.EncodingFloat64})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if image, err = wire.Decode(); err != nil {
+			t.Fatal(err)
+		}
+		merged.Add(image)
+		merged.Divisor += image.Divisor
+	}
+	assert.Equal(expected.Divisor, merged.Divisor)
+	assert.Equal(expected.Pixels, merged.Pixels)
+	assert.Equal(expected.Weights, merged.Weights)
+}
+
+func TestSeedChangesRender(t *testing.T) {
+	assert := assert.New(t)
+
+	cr := NewConcurrentRaytracer(1, nil, 1)
+	settings := deterministicSettings(t, cr)
+	settings.SamplesAtOnce = 2
+
+	first, err := cr.Sample(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.Seed++
+	second, err := cr.Sample(settings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NotEqual(first.Pixels, second.Pixels)
+}
@@ -0,0 +1,128 @@
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+// DiscoveryGroup is the default UDP multicast group on which workers
+// announce themselves
+const DiscoveryGroup = "239.255.84.84:9847"
+
+// discoveryService marks announcements which come from traytor workers
+const discoveryService = "traytor"
+
+// Announcement describes a worker and its capabilities
+type Announcement struct {
+	Service string `json:"service"`
+	// Address is the worker's RPC address. If its host is empty or
+	// unspecified, Discover replaces it with the address of the sender.
+	Address           string `json:"address"`
+	Threads           int    `json:"threads"`
+	MaxRequestsAtOnce int    `json:"max_requests_at_once"`
+	MaxSamplesAtOnce  int    `json:"max_samples_at_once"`
+}
+
+// Announce sends the announcement to the multicast group every interval,
+// until stop is closed. Failing to send it doesn't stop the announcements:
+// failed (if not nil) is called with the error, once until sending succeeds
+// again.
+func Announce(
+	announcement *Announcement,
+	group string,
+	interval time.Duration,
+	stop <-chan struct{},
+	failed func(error),
+) error {
+	groupAddr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return fmt.Errorf("Invalid discovery group: '%s'", group)
+	}
+	conn, err := net.DialUDP("udp", nil, groupAddr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	message := *announcement
+	message.Service = discoveryService
+	data, err := json.Marshal(&message)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	failing := false
+	for {
+		_, err := conn.Write(data)
+		if err != nil && !failing && failed != nil {
+			failed(err)
+		}
+		failing = err != nil
+
+		select {
+		case <-stop:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// Discover listens on the multicast group for the given time, and returns
+// the announcements of all workers heard, one per address
+func Discover(group string, timeout time.Duration) ([]*Announcement, error) {
+	groupAddr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid discovery group: '%s'", group)
+	}
+	conn, err := net.ListenMulticastUDP("udp", nil, groupAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+
+	var found []*Announcement
+	seen := make(map[string]bool)
+	buffer := make([]byte, 4096)
+	for {
+		n, sender, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return found, nil
+			}
+			return found, err
+		}
+
+		announcement := &Announcement{}
+		if json.Unmarshal(buffer[:n], announcement) != nil || announcement.Service != discoveryService {
+			continue
+		}
+		announcement.Address = senderAddress(announcement.Address, sender)
+		if announcement.Address == "" || seen[announcement.Address] {
+			continue
+		}
+		seen[announcement.Address] = true
+		found = append(found, announcement)
+	}
+}
+
+// senderAddress fills in the host of an announced address with the sender's
+// IP, if the host is empty or unspecified (e.g. ":1234" or "0.0.0.0:1234").
+// It returns an empty string if the address is invalid.
+func senderAddress(address string, sender *net.UDPAddr) string {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = sender.IP.String()
+	}
+	return net.JoinHostPort(host, port)
+}
@@ -0,0 +1,19 @@
+package rpc
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSenderAddress(t *testing.T) {
+	assert := assert.New(t)
+	sender := &net.UDPAddr{IP: net.ParseIP("192.168.1.7"), Port: 40000}
+
+	assert.Equal("192.168.1.7:1234", senderAddress(":1234", sender))
+	assert.Equal("192.168.1.7:1234", senderAddress("0.0.0.0:1234", sender))
+	assert.Equal("10.0.0.2:1234", senderAddress("10.0.0.2:1234", sender))
+	assert.Equal("worker.lan:1234", senderAddress("worker.lan:1234", sender))
+	assert.Equal("", senderAddress("1234", sender))
+}
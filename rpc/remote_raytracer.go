@@ -1,8 +1,14 @@
 package rpc
 
 import (
+	"errors"
+	"fmt"
+	"image"
+	"strings"
+	"sync/atomic"
+	"time"
+
 	"github.com/DexterLB/traytor/hdrimage"
-	"github.com/DexterLB/traytor/scene"
 	"github.com/valyala/gorpc"
 )
 
@@ -13,13 +19,88 @@ type RemoteRaytracer struct {
 	Requests   int
 	Dispatcher *gorpc.Dispatcher
 	Samples    int
+
+	leaving int32 // set when the worker doesn't accept new samples
+	active  int32 // number of requests being rendered
+
+	uploads *sceneUploads
+	running *runningRequests
+
+	started       time.Time
+	raysPerSecond rateMeter
+}
+
+// StoreTimeout is the time after which samples stored on the worker are
+// dropped (see ExpireAbandoned) if no samples of their render have been
+// stored or collected, because its client has probably gone away
+const StoreTimeout = 30 * time.Minute
+
+// MaxBatchGrowth limits the samples which a worker renders in one request
+// to this many times the samples it asks for (see MaxSamplesAtOnce)
+const MaxBatchGrowth = 32
+
+// ErrLeaving is returned for samples requested from a worker which is leaving
+var ErrLeaving = errors.New("worker is leaving")
+
+// IsLeaving returns true if the error (also as received through RPC) means
+// that the worker refused the request because it's leaving
+func IsLeaving(err error) bool {
+	return err != nil && strings.Contains(err.Error(), ErrLeaving.Error())
 }
 
 // SampleSettings contains parameters for making a sample
 type SampleSettings struct {
+	// Scene is the ID of the scene to render (see LoadScene)
+	Scene         string
 	Width         int
 	Height        int
 	SamplesAtOnce int
+	Sequence      string  // name of the sample sequence (see sequence.New)
+	Filter        string  // name of the reconstruction filter (see filter.New)
+	FilterRadius  float64 // radius of the filter (0 for the filter's default)
+
+	// Adaptive makes the worker record per-pixel statistics, and Mask (if
+	// not nil) limits the sampled pixels to the ones which are still noisy
+	Adaptive bool
+	Mask     *hdrimage.Mask
+
+	// Tile is the part of the image rendered by SampleTile
+	Tile image.Rectangle
+	// Region, if not empty, limits all rendering to these pixels
+	Region image.Rectangle
+
+	// Wire is the format of the images returned by the *Wire calls
+	// (float32 pixels if it's nil)
+	Wire *hdrimage.WireFormat
+
+	// Indexed makes the worker render the samples with indices from
+	// FirstSample of the sample sequence with the given Seed, so that the
+	// same samples always make the same image, whichever workers render
+	// them. Otherwise the worker renders samples of its own sequence which
+	// it hasn't rendered yet.
+	Indexed     bool
+	Seed        int64
+	FirstSample int
+
+	// Job is chosen by the client to identify the request, so that it can
+	// be cancelled (see Cancel)
+	Job string
+	// Session is chosen by the client to identify its render, so that the
+	// samples stored by different renders of the same scene and size
+	// aren't mixed
+	Session string
+}
+
+// check returns an error if an image can't be rendered with the settings
+// (e.g. ones received from a broken client) instead of letting it panic
+func (s *SampleSettings) check() error {
+	if err := hdrimage.CheckSize(s.Width, s.Height); err != nil {
+		return err
+	}
+	if s.SamplesAtOnce < 1 {
+		return fmt.Errorf("must render at least one sample at once")
+	}
+	return nil
 }
 
 // NewRemoteRaytracer initialises the remote raytracer object
@@ -34,6 +115,9 @@ func NewRemoteRaytracer(
 		Raytracer:  NewConcurrentRaytracer(threads, nil, randomSeed),
 		Dispatcher: gorpc.NewDispatcher(),
 		Requests:   maxRequestsAtOnce,
+		uploads:    newSceneUploads(),
+		running:    newRunningRequests(),
+		started:    time.Now(),
 	}
 
 	rr.registerFunctions()
@@ -55,30 +139,98 @@ func NewDispatcher() *gorpc.Dispatcher {
 
 func (rr *RemoteRaytracer) registerFunctions() {
 	rr.Dispatcher.AddFunc("LoadScene", rr.LoadScene)
+	rr.Dispatcher.AddFunc("UnloadScene", rr.UnloadScene)
+	rr.Dispatcher.AddFunc("HasScene", rr.HasScene)
+	rr.Dispatcher.AddFunc("BeginSceneUpload", rr.BeginSceneUpload)
+	rr.Dispatcher.AddFunc("UploadSceneChunk", rr.UploadSceneChunk)
+	rr.Dispatcher.AddFunc("FinishSceneUpload", rr.FinishSceneUpload)
 	rr.Dispatcher.AddFunc("Sample", rr.Sample)
 	rr.Dispatcher.AddFunc("MaxRequestsAtOnce", rr.MaxRequestsAtOnce)
 	rr.Dispatcher.AddFunc("MaxSamplesAtOnce", rr.MaxSamplesAtOnce)
 	rr.Dispatcher.AddFunc("StoreSample", rr.StoreSample)
 	rr.Dispatcher.AddFunc("GetImage", rr.GetImage)
+	rr.Dispatcher.AddFunc("SampleTile", rr.SampleTile)
+	rr.Dispatcher.AddFunc("Snapshot", rr.Snapshot)
+	rr.Dispatcher.AddFunc("Leaving", rr.Leaving)
+	rr.Dispatcher.AddFunc("Capabilities", rr.Capabilities)
+	rr.Dispatcher.AddFunc("Stats", rr.Stats)
+	rr.Dispatcher.AddFunc("Cancel", rr.Cancel)
+	rr.Dispatcher.AddFunc("SampleWire", rr.SampleWire)
+	rr.Dispatcher.AddFunc("GetImageWire", rr.GetImageWire)
+	rr.Dispatcher.AddFunc("SnapshotWire", rr.SnapshotWire)
+	rr.Dispatcher.AddFunc("SampleTileWire", rr.SampleTileWire)
 	gorpc.RegisterType(&hdrimage.Image{})
+	gorpc.RegisterType(&hdrimage.Tile{})
 	gorpc.RegisterType(&SampleSettings{})
+	gorpc.RegisterType(&hdrimage.WireImage{})
+	gorpc.RegisterType(&Capabilities{})
+	gorpc.RegisterType(&SceneChunk{})
+	gorpc.RegisterType(&WorkerStats{})
 }
 
-// LoadScene loads a scene
-func (rr *RemoteRaytracer) LoadScene(data []byte) error {
-	var err error
-	scene, err := scene.LoadFromBytes(data)
-	if err != nil {
-		return err
+// LoadScene loads a scene (unless it's already loaded), and returns its ID,
+// which names it in the sample settings. The least recently used scenes are
+// unloaded if there are too many. Scenes larger than MaxSceneSize, or than
+// the memory of the scene cache, are refused.
+func (rr *RemoteRaytracer) LoadScene(data []byte) (string, error) {
+	return rr.Raytracer.Scenes.Load(data)
+}
+
+// UnloadScene unloads the scene with the given ID
+func (rr *RemoteRaytracer) UnloadScene(id string) error {
+	if !rr.Raytracer.Scenes.Unload(id) {
+		return fmt.Errorf("Unknown scene: '%s'", id)
 	}
-	scene.Init()
-	rr.Raytracer.SetScene(scene)
 	return nil
 }
 
+// HasScene returns true if the scene with the given ID is loaded
+func (rr *RemoteRaytracer) HasScene(id string) bool {
+	return rr.Raytracer.Scenes.Get(id) != nil
+}
+
+// BeginSceneUpload starts uploading a scene of the given size (in bytes) in
+// chunks, and returns the ID of the upload. Scenes larger than MaxSceneSize,
+// or than the memory of the scene cache, are refused.
+func (rr *RemoteRaytracer) BeginSceneUpload(size int) (string, error) {
+	return rr.uploads.begin(size, int(rr.Raytracer.Scenes.MaxSceneSize()))
+}
+
+// UploadSceneChunk receives the next chunk of an upload
+func (rr *RemoteRaytracer) UploadSceneChunk(chunk *SceneChunk) error {
+	return rr.uploads.add(chunk)
+}
+
+// FinishSceneUpload loads an uploaded scene like LoadScene, and returns
+// its ID
+func (rr *RemoteRaytracer) FinishSceneUpload(upload string) (string, error) {
+	data, err := rr.uploads.finish(upload)
+	if err != nil {
+		return "", err
+	}
+	return rr.LoadScene(data)
+}
+
 // Sample samples an image and returns it
 func (rr *RemoteRaytracer) Sample(settings *SampleSettings) (*hdrimage.Image, error) {
-	return rr.Raytracer.Sample(settings)
+	request, err := rr.begin(settings)
+	if err != nil {
+		return nil, err
+	}
+	defer rr.end(request)
+	image, err := rr.Raytracer.SampleContext(request.ctx, settings)
+	return image, requestError(err)
+}
+
+// SampleTile samples a tile of the image and returns it
+func (rr *RemoteRaytracer) SampleTile(settings *SampleSettings) (*hdrimage.Tile, error) {
+	request, err := rr.begin(settings)
+	if err != nil {
+		return nil, err
+	}
+	defer rr.end(request)
+	tile, err := rr.Raytracer.SampleTileContext(request.ctx, settings)
+	return tile, requestError(err)
 }
 
 // MaxRequestsAtOnce returns the maximum number of requests allowed to the worker
@@ -95,10 +247,115 @@ func (rr *RemoteRaytracer) MaxSamplesAtOnce() (int, error) {
 // StoreSample stores samples an image without returning it, to be used
 // with a later call of GetImage()
 func (rr *RemoteRaytracer) StoreSample(settings *SampleSettings) error {
-	return rr.Raytracer.StoreSample(settings)
+	request, err := rr.begin(settings)
+	if err != nil {
+		return err
+	}
+	defer rr.end(request)
+	return requestError(rr.Raytracer.StoreSampleContext(request.ctx, settings))
+}
+
+// Cancel stops rendering the requests of the job given in their settings
+// (and of the jobs under it, whose IDs start with the job's ID and a slash),
+// making them fail with ErrCancelled. The samples of cancelled requests
+// aren't stored. It returns the number of cancelled requests.
+func (rr *RemoteRaytracer) Cancel(job string) int {
+	return rr.running.cancel(job)
 }
 
 // GetImage returns the combined result of any previously stored samples
-func (rr *RemoteRaytracer) GetImage() *hdrimage.Image {
-	return rr.Raytracer.GetImage()
+// of the session, scene and size in the settings
+func (rr *RemoteRaytracer) GetImage(settings *SampleSettings) *hdrimage.Image {
+	return rr.Raytracer.GetImage(settings)
+}
+
+// Snapshot returns the combined result of any previously stored samples
+// of the session, scene and size in the settings without resetting it
+func (rr *RemoteRaytracer) Snapshot(settings *SampleSettings) *hdrimage.Image {
+	return rr.Raytracer.Snapshot(settings)
+}
+
+// Capabilities returns the optional features supported by the worker
+func (rr *RemoteRaytracer) Capabilities() *Capabilities {
+	return workerCapabilities
+}
+
+// SampleWire works like Sample, but returns the image in the wire format
+// from the settings
+func (rr *RemoteRaytracer) SampleWire(settings *SampleSettings) (*hdrimage.WireImage, error) {
+	image, err := rr.Sample(settings)
+	if err != nil {
+		return nil, err
+	}
+	return image.EncodeWire(wireFormat(settings))
+}
+
+// SampleTileWire works like SampleTile, but returns the tile in the wire
+// format from the settings
+func (rr *RemoteRaytracer) SampleTileWire(settings *SampleSettings) (*hdrimage.WireImage, error) {
+	tile, err := rr.SampleTile(settings)
+	if err != nil {
+		return nil, err
+	}
+	return tile.EncodeWire(wireFormat(settings))
+}
+
+// GetImageWire works like GetImage, but returns the image in the wire
+// format from the settings
+func (rr *RemoteRaytracer) GetImageWire(settings *SampleSettings) (*hdrimage.WireImage, error) {
+	return rr.GetImage(settings).EncodeWire(wireFormat(settings))
+}
+
+// SnapshotWire works like Snapshot, but returns the image in the wire
+// format from the settings
+func (rr *RemoteRaytracer) SnapshotWire(settings *SampleSettings) (*hdrimage.WireImage, error) {
+	return rr.Snapshot(settings).EncodeWire(wireFormat(settings))
+}
+
+// Leave makes the worker refuse new samples, so that it can be stopped
+// once the clients have collected the samples stored on it
+func (rr *RemoteRaytracer) Leave() {
+	atomic.StoreInt32(&rr.leaving, 1)
+}
+
+// Leaving returns true if the worker refuses new samples because it's leaving
+func (rr *RemoteRaytracer) Leaving() bool {
+	return atomic.LoadInt32(&rr.leaving) != 0
+}
+
+// ExpireAbandoned drops the samples stored by renders which have been
+// abandoned (see StoreTimeout), and returns the number of such renders.
+// Scene uploads which haven't received a chunk for a while are dropped too.
+// It should be called periodically.
+func (rr *RemoteRaytracer) ExpireAbandoned() int {
+	rr.uploads.expire(uploadTimeout)
+	return rr.Raytracer.ExpireStored(StoreTimeout)
+}
+
+// Idle returns true if no samples are being rendered or stored on the worker
+func (rr *RemoteRaytracer) Idle() bool {
+	return atomic.LoadInt32(&rr.active) == 0 && !rr.Raytracer.HasStoredSamples()
+}
+
+// begin marks the start of rendering a request, unless the worker is leaving
+// or the request asks for more samples than it renders at once
+func (rr *RemoteRaytracer) begin(settings *SampleSettings) (*runningRequest, error) {
+	if settings.SamplesAtOnce > MaxBatchGrowth*rr.Samples {
+		return nil, fmt.Errorf(
+			"too many samples at once: %d (the limit is %d)",
+			settings.SamplesAtOnce, MaxBatchGrowth*rr.Samples,
+		)
+	}
+	atomic.AddInt32(&rr.active, 1)
+	if rr.Leaving() {
+		atomic.AddInt32(&rr.active, -1)
+		return nil, ErrLeaving
+	}
+	return rr.running.start(settings.Job), nil
+}
+
+// end marks the end of rendering a request
+func (rr *RemoteRaytracer) end(request *runningRequest) {
+	rr.running.finish(request)
+	atomic.AddInt32(&rr.active, -1)
 }
@@ -1,6 +1,8 @@
 package rpc
 
 import (
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/DexterLB/traytor/hdrimage"
@@ -13,13 +15,20 @@ type RemoteRaytracerCaller struct {
 	client     *gorpc.Client
 	funcClient *gorpc.DispatcherClient
 	timeout    time.Duration
+	closing    *sync.Once // shared by the callers which use the same connection
 }
 
 // NewRemoteRaytracerCaller initializes the wrapper, connecting to a worker
-func NewRemoteRaytracerCaller(address string, timeout time.Duration) *RemoteRaytracerCaller {
+// as required by the security settings (nil for a plain connection)
+func NewRemoteRaytracerCaller(
+	address string,
+	timeout time.Duration,
+	security *Security,
+) *RemoteRaytracerCaller {
 	rrc := &RemoteRaytracerCaller{
-		client:  &gorpc.Client{Addr: address},
+		client:  security.NewClient(address),
 		timeout: timeout,
+		closing: &sync.Once{},
 	}
 	rrc.client.Start()
 	rrc.funcClient = NewDispatcher().NewFuncClient(rrc.client)
@@ -27,12 +36,90 @@ func NewRemoteRaytracerCaller(address string, timeout time.Duration) *RemoteRayt
 	return rrc
 }
 
-// LoadScene sends a scene to the worker
-func (rrc *RemoteRaytracerCaller) LoadScene(data []byte) error {
-	_, err := rrc.funcClient.CallTimeout("LoadScene", data, rrc.timeout)
+// WithTimeout returns a caller which uses the same connection, but waits
+// for calls to return for the given time
+func (rrc *RemoteRaytracerCaller) WithTimeout(timeout time.Duration) *RemoteRaytracerCaller {
+	caller := *rrc
+	caller.timeout = timeout
+	return &caller
+}
+
+// Close disconnects from the worker (also closing the callers returned by
+// WithTimeout), and stops reconnecting to it. Calls made after it fail.
+// Closing a caller more than once does nothing.
+func (rrc *RemoteRaytracerCaller) Close() {
+	rrc.closing.Do(rrc.client.Stop)
+}
+
+// LoadScene sends a scene to the worker, and returns its ID
+func (rrc *RemoteRaytracerCaller) LoadScene(data []byte) (string, error) {
+	id, err := rrc.funcClient.CallTimeout("LoadScene", data, rrc.timeout)
+	if err != nil {
+		return "", err
+	}
+	return id.(string), nil
+}
+
+// UnloadScene makes the worker unload the scene with the given ID
+func (rrc *RemoteRaytracerCaller) UnloadScene(id string) error {
+	_, err := rrc.funcClient.CallTimeout("UnloadScene", id, rrc.timeout)
 	return err
 }
 
+// HasScene asks the worker whether the scene with the given ID is loaded
+func (rrc *RemoteRaytracerCaller) HasScene(id string) (bool, error) {
+	has, err := rrc.funcClient.CallTimeout("HasScene", id, rrc.timeout)
+	if err != nil {
+		return false, err
+	}
+	return has.(bool), nil
+}
+
+// UploadScene loads a scene on the worker unless it already has it, and
+// returns its ID. If chunked is set, large scenes are sent in chunks of
+// SceneChunkSize, and progress (if not nil) is called with the size of each
+// chunk after it's sent.
+func (rrc *RemoteRaytracerCaller) UploadScene(
+	data []byte,
+	chunked bool,
+	progress func(int),
+) (string, error) {
+	id := SceneID(data)
+	if has, err := rrc.HasScene(id); err == nil && has {
+		return id, nil
+	}
+	if !chunked || len(data) <= SceneChunkSize {
+		return rrc.LoadScene(data)
+	}
+
+	upload, err := rrc.funcClient.CallTimeout("BeginSceneUpload", len(data), rrc.timeout)
+	if err != nil {
+		return "", err
+	}
+	for offset := 0; offset < len(data); offset += SceneChunkSize {
+		end := offset + SceneChunkSize
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := &SceneChunk{Upload: upload.(string), Offset: offset, Data: data[offset:end]}
+		if _, err := rrc.funcClient.CallTimeout("UploadSceneChunk", chunk, rrc.timeout); err != nil {
+			return "", err
+		}
+		if progress != nil {
+			progress(end - offset)
+		}
+	}
+
+	loaded, err := rrc.funcClient.CallTimeout("FinishSceneUpload", upload, rrc.timeout)
+	if err != nil {
+		return "", err
+	}
+	if loaded.(string) != id {
+		return "", fmt.Errorf("the scene was corrupted while uploading")
+	}
+	return id, nil
+}
+
 // MaxSamplesAtOnce gets the worker's desired samples to request at once
 func (rrc *RemoteRaytracerCaller) MaxSamplesAtOnce() (int, error) {
 	samples, err := rrc.funcClient.CallTimeout("MaxSamplesAtOnce", nil, rrc.timeout)
@@ -53,11 +140,7 @@ func (rrc *RemoteRaytracerCaller) MaxRequestsAtOnce() (int, error) {
 
 // Sample waits for the worker to sample an image, retreives it and returns it
 func (rrc *RemoteRaytracerCaller) Sample(settings *SampleSettings) (*hdrimage.Image, error) {
-	image, err := rrc.funcClient.CallTimeout("Sample", settings, rrc.timeout)
-	if err != nil {
-		return nil, err
-	}
-	return image.(*hdrimage.Image), nil
+	return rrc.callImage("Sample", settings)
 }
 
 // StoreSample waits for the worker to sample an image, storing it worker-side
@@ -67,10 +150,86 @@ func (rrc *RemoteRaytracerCaller) StoreSample(settings *SampleSettings) error {
 }
 
 // GetImage retreives the combined result of any previously stored samples
-func (rrc *RemoteRaytracerCaller) GetImage() (*hdrimage.Image, error) {
-	image, err := rrc.funcClient.CallTimeout("GetImage", nil, rrc.timeout)
+// of the scene and size in the settings
+func (rrc *RemoteRaytracerCaller) GetImage(settings *SampleSettings) (*hdrimage.Image, error) {
+	return rrc.callImage("GetImage", settings)
+}
+
+// SampleTile waits for the worker to sample a tile of the image, retreives it
+// and returns it
+func (rrc *RemoteRaytracerCaller) SampleTile(settings *SampleSettings) (*hdrimage.Tile, error) {
+	if settings.Wire != nil {
+		wire, err := rrc.funcClient.CallTimeout("SampleTileWire", settings, rrc.timeout)
+		if err != nil {
+			return nil, err
+		}
+		return wire.(*hdrimage.WireImage).DecodeTile()
+	}
+
+	tile, err := rrc.funcClient.CallTimeout("SampleTile", settings, rrc.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return tile.(*hdrimage.Tile), nil
+}
+
+// Snapshot retreives the combined result of any previously stored samples
+// of the scene and size in the settings, without resetting them on the worker
+func (rrc *RemoteRaytracerCaller) Snapshot(settings *SampleSettings) (*hdrimage.Image, error) {
+	return rrc.callImage("Snapshot", settings)
+}
+
+// callImage calls a function which returns an image. If the settings have
+// a wire format, the function's *Wire version is called instead.
+func (rrc *RemoteRaytracerCaller) callImage(function string, settings *SampleSettings) (*hdrimage.Image, error) {
+	if settings.Wire != nil {
+		wire, err := rrc.funcClient.CallTimeout(function+"Wire", settings, rrc.timeout)
+		if err != nil {
+			return nil, err
+		}
+		return wire.(*hdrimage.WireImage).Decode()
+	}
+
+	image, err := rrc.funcClient.CallTimeout(function, settings, rrc.timeout)
 	if err != nil {
 		return nil, err
 	}
 	return image.(*hdrimage.Image), nil
 }
+
+// Capabilities asks the worker which optional features it supports
+func (rrc *RemoteRaytracerCaller) Capabilities() (*Capabilities, error) {
+	capabilities, err := rrc.funcClient.CallTimeout("Capabilities", nil, rrc.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return capabilities.(*Capabilities), nil
+}
+
+// Stats asks the worker what it's doing
+func (rrc *RemoteRaytracerCaller) Stats() (*WorkerStats, error) {
+	stats, err := rrc.funcClient.CallTimeout("Stats", nil, rrc.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return stats.(*WorkerStats), nil
+}
+
+// Cancel makes the worker stop rendering the requests of the job (and of
+// the jobs under it), and returns how many there were
+func (rrc *RemoteRaytracerCaller) Cancel(job string) (int, error) {
+	cancelled, err := rrc.funcClient.CallTimeout("Cancel", job, rrc.timeout)
+	if err != nil {
+		return 0, err
+	}
+	return cancelled.(int), nil
+}
+
+// Leaving asks the worker whether it refuses new samples because it's leaving
+func (rrc *RemoteRaytracerCaller) Leaving() (bool, error) {
+	leaving, err := rrc.funcClient.CallTimeout("Leaving", nil, rrc.timeout)
+	if err != nil {
+		return false, err
+	}
+	return leaving.(bool), nil
+}
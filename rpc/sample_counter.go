@@ -1,34 +1,127 @@
 package rpc
 
-import "sync/atomic"
+import (
+	"sync"
+	"time"
+)
 
-// SampleCounter is a thread-safe  decreasing counter
+// SampleRange is a range of indices of samples in the sample sequence
+type SampleRange struct {
+	First int // index of the first sample
+	Count int // number of samples
+}
+
+// Counter hands out samples to rendering loops until some limit is reached.
+// Each sample has an index in the sample sequence, and is handed out once
+// (unless it's given back), so that however the samples are split between
+// rendering loops, the same samples are rendered.
+type Counter interface {
+	// Dec takes up to value samples from the counter, and returns the
+	// range of the samples actually taken (empty if there are none left)
+	Dec(value int) SampleRange
+	// Inc gives back samples which were taken, but couldn't be rendered
+	Inc(samples SampleRange)
+}
+
+// SampleCounter is a thread-safe counter which hands out a number of
+// consecutive samples
 type SampleCounter struct {
-	Counter int64
+	mutex    sync.Mutex
+	next     int           // index of the next sample which hasn't been handed out
+	left     int           // samples which haven't been handed out
+	returned []SampleRange // samples which were given back
 }
 
-// NewSampleCounter initializes the counter with a value
+// NewSampleCounter initializes the counter with a value, handing out the
+// samples with indices from 0
 func NewSampleCounter(value int) *SampleCounter {
-	return &SampleCounter{Counter: int64(value)}
+	return NewSampleCounterFrom(0, value)
+}
+
+// NewSampleCounterFrom initializes the counter with a value, handing out
+// the samples with indices from first
+func NewSampleCounterFrom(first int, value int) *SampleCounter {
+	return &SampleCounter{next: first, left: value}
 }
 
-// Dec decreases the counter by value, but doesn't go below zero (if
-// value > sc.value, the counter's value will become 0). Returns the
-// actual amount decremented (so the return value is 0 if the counter
-// has already been 0)
-func (sc *SampleCounter) Dec(value int) int {
-	difference := int64(value)
-	newValue := atomic.AddInt64(&sc.Counter, -difference)
+// Dec takes up to value samples, but not more than there are left. Samples
+// which have been given back are handed out before new ones. Returns the
+// range of the samples taken (which is empty if the counter has already
+// been 0)
+func (sc *SampleCounter) Dec(value int) SampleRange {
+	if value <= 0 {
+		return SampleRange{}
+	}
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	if len(sc.returned) > 0 {
+		taken := sc.returned[0]
+		if taken.Count > value {
+			taken.Count = value
+			sc.returned[0].First += value
+			sc.returned[0].Count -= value
+		} else {
+			sc.returned = sc.returned[1:]
+		}
+		return taken
+	}
+
+	if value > sc.left {
+		value = sc.left
+	}
+	taken := SampleRange{First: sc.next, Count: value}
+	sc.next += value
+	sc.left -= value
+	return taken
+}
 
-	if newValue >= 0 {
-		return int(difference)
+// Inc gives back samples, which are handed out again
+func (sc *SampleCounter) Inc(samples SampleRange) {
+	if samples.Count <= 0 {
+		return
 	}
+	sc.mutex.Lock()
+	sc.returned = append(sc.returned, samples)
+	sc.mutex.Unlock()
+}
+
+// Next returns the index of the first sample which hasn't been handed out
+func (sc *SampleCounter) Next() int {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return sc.next
+}
 
-	atomic.StoreInt64(&sc.Counter, 0)
+// Returned returns the samples which were given back, but haven't been
+// handed out again
+func (sc *SampleCounter) Returned() []SampleRange {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	return append([]SampleRange(nil), sc.returned...)
+}
 
-	if -newValue < difference {
-		return int(difference + newValue)
-	} else {
-		return 0
+// DeadlineCounter hands out samples from another counter until a deadline
+type DeadlineCounter struct {
+	Counter  Counter
+	Deadline time.Time
+}
+
+// NewDeadlineCounter wraps counter so that it runs out of samples at deadline
+func NewDeadlineCounter(counter Counter, deadline time.Time) *DeadlineCounter {
+	return &DeadlineCounter{Counter: counter, Deadline: deadline}
+}
+
+// Dec works like the wrapped counter's Dec, but returns no samples after
+// the deadline
+func (dc *DeadlineCounter) Dec(value int) SampleRange {
+	if !time.Now().Before(dc.Deadline) {
+		return SampleRange{}
 	}
+	return dc.Counter.Dec(value)
+}
+
+// Inc gives the samples back to the wrapped counter, even after the deadline
+func (dc *DeadlineCounter) Inc(samples SampleRange) {
+	dc.Counter.Inc(samples)
 }
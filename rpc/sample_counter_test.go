@@ -0,0 +1,50 @@
+package rpc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSampleCounterHandsOutRanges(t *testing.T) {
+	assert := assert.New(t)
+	counter := NewSampleCounterFrom(10, 5)
+
+	assert.Equal(SampleRange{First: 10, Count: 2}, counter.Dec(2))
+	assert.Equal(SampleRange{First: 12, Count: 3}, counter.Dec(4))
+	assert.Equal(SampleRange{First: 15, Count: 0}, counter.Dec(1))
+	assert.Equal(15, counter.Next())
+}
+
+func TestSampleCounterHandsOutReturnedSamplesFirst(t *testing.T) {
+	assert := assert.New(t)
+	counter := NewSampleCounter(10)
+
+	taken := counter.Dec(4)
+	counter.Inc(taken)
+	assert.Equal(SampleRange{First: 0, Count: 3}, counter.Dec(3))
+	assert.Equal(SampleRange{First: 3, Count: 1}, counter.Dec(3))
+	assert.Equal(SampleRange{First: 4, Count: 3}, counter.Dec(3))
+}
+
+func TestSampleCounterReturned(t *testing.T) {
+	assert := assert.New(t)
+	counter := NewSampleCounter(10)
+
+	taken := counter.Dec(4)
+	assert.Equal(0, len(counter.Returned()))
+	counter.Inc(taken)
+	counter.Dec(1)
+	assert.Equal([]SampleRange{{First: 1, Count: 3}}, counter.Returned())
+}
+
+func TestDeadlineCounter(t *testing.T) {
+	assert := assert.New(t)
+	counter := NewSampleCounter(10)
+	expired := NewDeadlineCounter(counter, time.Now().Add(-time.Second))
+
+	assert.Equal(0, expired.Dec(3).Count)
+	expired.Inc(SampleRange{First: 20, Count: 2})
+	assert.Equal(SampleRange{First: 20, Count: 2}, counter.Dec(5))
+}
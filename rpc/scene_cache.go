@@ -0,0 +1,159 @@
+package rpc
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"sync"
+
+	"github.com/DexterLB/traytor/scene"
+)
+
+// SceneID returns the ID of a scene on workers: the hash of its data
+func SceneID(data []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(data))
+}
+
+// SceneCache holds loaded scenes by ID. When there are too many of them, or
+// they take too much memory, the least recently used ones are unloaded.
+type SceneCache struct {
+	MaxScenes int   // maximum number of scenes (0 for no limit)
+	MaxMemory int64 // maximum total size of the scenes in bytes (0 for no limit)
+
+	mutex  sync.Mutex
+	scenes map[string]*list.Element
+	lru    *list.List // most recently used first
+	memory int64
+}
+
+// cachedScene is a scene in a SceneCache. Its size is the size of its
+// uncompressed data, which is roughly the memory it takes.
+type cachedScene struct {
+	id    string
+	scene *scene.Scene
+	size  int64
+}
+
+// NewSceneCache returns an empty cache with the given limits (0 for no limit)
+func NewSceneCache(maxScenes int, maxMemory int64) *SceneCache {
+	return &SceneCache{
+		MaxScenes: maxScenes,
+		MaxMemory: maxMemory,
+		scenes:    make(map[string]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+// MaxSceneSize returns the size of the largest scene which can be loaded:
+// MaxSceneSize, or MaxMemory if it's less. The limit applies to both the
+// gzipped and the uncompressed data.
+func (sc *SceneCache) MaxSceneSize() int64 {
+	maxSize := int64(MaxSceneSize)
+	if sc.MaxMemory > 0 && sc.MaxMemory < maxSize {
+		maxSize = sc.MaxMemory
+	}
+	return maxSize
+}
+
+// Load loads a scene from gzipped json data (unless it's already loaded),
+// and returns its ID. Scenes larger than MaxSceneSize are refused.
+func (sc *SceneCache) Load(data []byte) (string, error) {
+	id := SceneID(data)
+	if sc.Get(id) != nil {
+		return id, nil
+	}
+
+	maxSize := sc.MaxSceneSize()
+	if int64(len(data)) > maxSize {
+		return "", fmt.Errorf("scene too large: %d bytes (at most %d are allowed)", len(data), maxSize)
+	}
+	loaded, err := scene.LoadLimited(bytes.NewReader(data), maxSize)
+	if err != nil {
+		return "", err
+	}
+	loaded.Init()
+
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+	if _, ok := sc.scenes[id]; ok {
+		return id, nil
+	}
+	cached := &cachedScene{id: id, scene: loaded, size: uncompressedSize(data)}
+	sc.scenes[id] = sc.lru.PushFront(cached)
+	sc.memory += cached.size
+	sc.evict()
+	return id, nil
+}
+
+// Get returns the scene with the given ID, or nil if it isn't loaded
+func (sc *SceneCache) Get(id string) *scene.Scene {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	element, ok := sc.scenes[id]
+	if !ok {
+		return nil
+	}
+	sc.lru.MoveToFront(element)
+	return element.Value.(*cachedScene).scene
+}
+
+// Unload removes the scene with the given ID, and returns false if it
+// wasn't loaded. Samples of the scene which are being rendered aren't
+// affected.
+func (sc *SceneCache) Unload(id string) bool {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	element, ok := sc.scenes[id]
+	if !ok {
+		return false
+	}
+	sc.remove(element)
+	return true
+}
+
+// IDs returns the IDs of the loaded scenes, most recently used first
+func (sc *SceneCache) IDs() []string {
+	sc.mutex.Lock()
+	defer sc.mutex.Unlock()
+
+	ids := make([]string, 0, sc.lru.Len())
+	for element := sc.lru.Front(); element != nil; element = element.Next() {
+		ids = append(ids, element.Value.(*cachedScene).id)
+	}
+	return ids
+}
+
+// evict unloads the least recently used scenes until the cache fits in
+// its limits, but always keeps the most recently used one. The mutex must
+// be held.
+func (sc *SceneCache) evict() {
+	for sc.lru.Len() > 1 {
+		tooMany := sc.MaxScenes > 0 && sc.lru.Len() > sc.MaxScenes
+		tooLarge := sc.MaxMemory > 0 && sc.memory > sc.MaxMemory
+		if !tooMany && !tooLarge {
+			return
+		}
+		sc.remove(sc.lru.Back())
+	}
+}
+
+// remove removes a scene from the cache. The mutex must be held.
+func (sc *SceneCache) remove(element *list.Element) {
+	cached := element.Value.(*cachedScene)
+	sc.lru.Remove(element)
+	delete(sc.scenes, cached.id)
+	sc.memory -= cached.size
+}
+
+// uncompressedSize returns the size of gzipped data when it's uncompressed,
+// as recorded at the end of the data (modulo 4GiB)
+func uncompressedSize(data []byte) int64 {
+	if len(data) < 4 {
+		return int64(len(data))
+	}
+	return int64(binary.LittleEndian.Uint32(data[len(data)-4:]))
+}
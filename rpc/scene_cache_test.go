@@ -0,0 +1,39 @@
+package rpc
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSceneCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	assert := assert.New(t)
+
+	var ids []string
+	cache := NewSceneCache(2, 0)
+	for _, name := range []string{"00_white", "01_triangle", "02_two_triangles"} {
+		data, err := ioutil.ReadFile("../sample_scenes/" + name + ".json.gz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := cache.Load(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(SceneID(data), id)
+		ids = append(ids, id)
+
+		if name == "01_triangle" {
+			// the first scene becomes the most recently used
+			assert.NotNil(cache.Get(ids[0]))
+		}
+	}
+
+	assert.Equal([]string{ids[2], ids[0]}, cache.IDs())
+	assert.Nil(cache.Get(ids[1]))
+
+	assert.True(cache.Unload(ids[0]))
+	assert.False(cache.Unload(ids[0]))
+	assert.Equal([]string{ids[2]}, cache.IDs())
+}
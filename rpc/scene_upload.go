@@ -0,0 +1,117 @@
+package rpc
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SceneChunkSize is the size of the chunks in which large scenes are uploaded
+const SceneChunkSize = 1 << 20
+
+// MaxSceneSize is the largest scene which can be uploaded in chunks (unless
+// the worker's scene memory is limited to less)
+const MaxSceneSize = 256 << 20
+
+// uploadTimeout is the time after which unfinished uploads are dropped if
+// no chunks are received
+const uploadTimeout = 10 * time.Minute
+
+// SceneChunk is a part of a scene which is uploaded in chunks
+type SceneChunk struct {
+	Upload string // ID returned by BeginSceneUpload
+	Offset int    // position of the chunk in the scene data
+	Data   []byte
+}
+
+// sceneUploads holds the scenes which are being uploaded
+type sceneUploads struct {
+	mutex   sync.Mutex
+	last    int
+	uploads map[string]*sceneUpload
+}
+
+// sceneUpload is a scene which is being uploaded
+type sceneUpload struct {
+	data    []byte
+	size    int
+	updated time.Time
+}
+
+func newSceneUploads() *sceneUploads {
+	return &sceneUploads{uploads: make(map[string]*sceneUpload)}
+}
+
+// begin starts an upload of a scene with the given size, which must be at
+// most maxSize, and returns its ID. The data is allocated as the chunks
+// arrive, so that the size claimed by a client doesn't take memory.
+func (su *sceneUploads) begin(size int, maxSize int) (string, error) {
+	if size <= 0 {
+		return "", fmt.Errorf("Invalid scene size: %d", size)
+	}
+	if size > maxSize {
+		return "", fmt.Errorf("scene too large: %d bytes (at most %d are allowed)", size, maxSize)
+	}
+
+	su.mutex.Lock()
+	defer su.mutex.Unlock()
+	su.last++
+	id := strconv.Itoa(su.last)
+	su.uploads[id] = &sceneUpload{
+		size:    size,
+		updated: time.Now(),
+	}
+	return id, nil
+}
+
+// expire drops the uploads which haven't received a chunk for longer than
+// timeout, and returns their number
+func (su *sceneUploads) expire(timeout time.Duration) int {
+	su.mutex.Lock()
+	defer su.mutex.Unlock()
+	expired := 0
+	for id, upload := range su.uploads {
+		if time.Since(upload.updated) > timeout {
+			delete(su.uploads, id)
+			expired++
+		}
+	}
+	return expired
+}
+
+// add adds a chunk to its upload. Chunks must be added in order.
+func (su *sceneUploads) add(chunk *SceneChunk) error {
+	su.mutex.Lock()
+	defer su.mutex.Unlock()
+
+	upload, ok := su.uploads[chunk.Upload]
+	if !ok {
+		return fmt.Errorf("Unknown upload: '%s'", chunk.Upload)
+	}
+	if chunk.Offset != len(upload.data) {
+		return fmt.Errorf("expected chunk at %d, got one at %d", len(upload.data), chunk.Offset)
+	}
+	if len(upload.data)+len(chunk.Data) > upload.size {
+		return fmt.Errorf("chunk goes past the end of the scene")
+	}
+	upload.data = append(upload.data, chunk.Data...)
+	upload.updated = time.Now()
+	return nil
+}
+
+// finish removes a complete upload and returns its data
+func (su *sceneUploads) finish(id string) ([]byte, error) {
+	su.mutex.Lock()
+	defer su.mutex.Unlock()
+
+	upload, ok := su.uploads[id]
+	if !ok {
+		return nil, fmt.Errorf("Unknown upload: '%s'", id)
+	}
+	delete(su.uploads, id)
+	if len(upload.data) != upload.size {
+		return nil, fmt.Errorf("upload is incomplete: got %d of %d bytes", len(upload.data), upload.size)
+	}
+	return upload.data, nil
+}
@@ -0,0 +1,89 @@
+package rpc
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSceneUploads(t *testing.T) {
+	assert := assert.New(t)
+	uploads := newSceneUploads()
+
+	id, err := uploads.begin(5, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Nil(uploads.add(&SceneChunk{Upload: id, Offset: 0, Data: []byte("abc")}))
+	assert.NotNil(uploads.add(&SceneChunk{Upload: id, Offset: 0, Data: []byte("abc")}))
+	assert.NotNil(uploads.add(&SceneChunk{Upload: id, Offset: 3, Data: []byte("def")}))
+	assert.Nil(uploads.add(&SceneChunk{Upload: id, Offset: 3, Data: []byte("de")}))
+
+	data, err := uploads.finish(id)
+	assert.Nil(err)
+	assert.Equal([]byte("abcde"), data)
+
+	_, err = uploads.finish(id)
+	assert.NotNil(err)
+
+	incomplete, _ := uploads.begin(5, 10)
+	assert.Nil(uploads.add(&SceneChunk{Upload: incomplete, Offset: 0, Data: []byte("ab")}))
+	_, err = uploads.finish(incomplete)
+	assert.NotNil(err)
+
+	_, err = uploads.begin(0, 10)
+	assert.NotNil(err)
+	_, err = uploads.begin(11, 10)
+	assert.NotNil(err)
+}
+
+func TestStaleSceneUploadsExpire(t *testing.T) {
+	assert := assert.New(t)
+	uploads := newSceneUploads()
+
+	stale, _ := uploads.begin(5, 10)
+	time.Sleep(10 * time.Millisecond)
+	fresh, _ := uploads.begin(5, 10)
+	assert.Equal(1, uploads.expire(5*time.Millisecond))
+
+	assert.NotNil(uploads.add(&SceneChunk{Upload: stale, Offset: 0, Data: []byte("ab")}))
+	assert.Nil(uploads.add(&SceneChunk{Upload: fresh, Offset: 0, Data: []byte("ab")}))
+}
+
+func TestLargeSceneUploadsAreRefused(t *testing.T) {
+	assert := assert.New(t)
+	rr := NewRemoteRaytracer(42, 1, 1, 1)
+
+	_, err := rr.BeginSceneUpload(MaxSceneSize + 1)
+	assert.NotNil(err)
+	_, err = rr.BeginSceneUpload(1 << 20)
+	assert.Nil(err)
+
+	rr.Raytracer.Scenes.MaxMemory = 1 << 10
+	_, err = rr.BeginSceneUpload(1 << 20)
+	assert.NotNil(err)
+}
+
+func TestLargeScenesAreNotLoaded(t *testing.T) {
+	assert := assert.New(t)
+	rr := NewRemoteRaytracer(42, 1, 1, 1)
+	data, err := ioutil.ReadFile("../sample_scenes/01_triangle.json.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the uncompressed scene is larger than the limit, the gzipped one isn't
+	rr.Raytracer.Scenes.MaxMemory = int64(len(data)) + 1
+	_, err = rr.LoadScene(data)
+	assert.NotNil(err)
+
+	rr.Raytracer.Scenes.MaxMemory = int64(len(data)) - 1
+	_, err = rr.LoadScene(data)
+	assert.NotNil(err)
+
+	rr.Raytracer.Scenes.MaxMemory = 0
+	_, err = rr.LoadScene(data)
+	assert.Nil(err)
+}
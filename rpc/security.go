@@ -0,0 +1,184 @@
+package rpc
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/valyala/gorpc"
+)
+
+// tokenTimeout is the time in which a client must present its token
+const tokenTimeout = 10 * time.Second
+
+// maxTokenLength is the maximum length of a token
+const maxTokenLength = 1024
+
+// ErrBadToken is returned to clients whose token is rejected by the worker
+var ErrBadToken = errors.New("the worker rejected the token")
+
+// Security describes how connections between clients and workers are
+// secured. The zero value (and nil) means plain connections which anyone
+// can make.
+type Security struct {
+	TLS   *tls.Config // encrypts the connections (nil for no encryption)
+	Token string      // pre-shared token which clients present ("" for none)
+}
+
+// ServerTLSConfig returns the TLS configuration of a worker with the given
+// certificate. If caFile is given, clients must present certificates
+// signed by it.
+func ServerTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't load certificate: %s", err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if caFile != "" {
+		if config.ClientCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientTLSConfig returns the TLS configuration of a client, which trusts
+// workers with certificates signed by caFile (or by the system's
+// authorities if it's empty), and presents the given certificate (if any)
+func ClientTLSConfig(certFile string, keyFile string, caFile string) (*tls.Config, error) {
+	config := &tls.Config{}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("can't load certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if caFile != "" {
+		var err error
+		if config.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// loadCertPool reads PEM certificates of authorities from a file
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("can't load CA certificate: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in '%s'", caFile)
+	}
+	return pool, nil
+}
+
+// NewServer returns an RPC server for a worker which accepts only the
+// connections allowed by the security settings
+func (s *Security) NewServer(address string, handler gorpc.HandlerFunc) *gorpc.Server {
+	if s == nil {
+		return gorpc.NewTCPServer(address, handler)
+	}
+
+	var server *gorpc.Server
+	if s.TLS != nil {
+		server = gorpc.NewTLSServer(address, handler, s.TLS)
+	} else {
+		server = gorpc.NewTCPServer(address, handler)
+	}
+	if s.Token != "" {
+		token := s.Token
+		server.OnConnect = func(remoteAddr string, rwc io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+			if err := checkToken(rwc, token); err != nil {
+				return nil, fmt.Errorf("rejected connection from %s: %s", remoteAddr, err)
+			}
+			return rwc, nil
+		}
+	}
+	return server
+}
+
+// NewClient returns an RPC client which connects to a worker as required
+// by the security settings
+func (s *Security) NewClient(address string) *gorpc.Client {
+	if s == nil {
+		return gorpc.NewTCPClient(address)
+	}
+
+	var client *gorpc.Client
+	if s.TLS != nil {
+		client = gorpc.NewTLSClient(address, s.TLS)
+	} else {
+		client = gorpc.NewTCPClient(address)
+	}
+	if s.Token != "" {
+		token := s.Token
+		client.OnConnect = func(remoteAddr string, rwc io.ReadWriteCloser) (io.ReadWriteCloser, error) {
+			if err := sendToken(rwc, token); err != nil {
+				return nil, err
+			}
+			return rwc, nil
+		}
+	}
+	return client
+}
+
+// sendToken presents the token to the worker, and waits for it to be
+// accepted
+func sendToken(rwc io.ReadWriter, token string) error {
+	message := make([]byte, 2+len(token))
+	binary.BigEndian.PutUint16(message, uint16(len(token)))
+	copy(message[2:], token)
+	if _, err := rwc.Write(message); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 1)
+	if _, err := io.ReadFull(rwc, reply); err != nil {
+		return err
+	}
+	if reply[0] != 1 {
+		return ErrBadToken
+	}
+	return nil
+}
+
+// checkToken reads the token presented by a client, and tells the client
+// whether it's accepted
+func checkToken(rwc io.ReadWriter, token string) error {
+	if conn, ok := rwc.(net.Conn); ok {
+		conn.SetReadDeadline(time.Now().Add(tokenTimeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(rwc, header); err != nil {
+		return fmt.Errorf("can't read token: %s", err)
+	}
+	length := int(binary.BigEndian.Uint16(header))
+	if length > maxTokenLength {
+		return fmt.Errorf("token too long")
+	}
+	presented := make([]byte, length)
+	if _, err := io.ReadFull(rwc, presented); err != nil {
+		return fmt.Errorf("can't read token: %s", err)
+	}
+
+	if subtle.ConstantTimeCompare(presented, []byte(token)) != 1 {
+		rwc.Write([]byte{0})
+		return fmt.Errorf("wrong token")
+	}
+	_, err := rwc.Write([]byte{1})
+	return err
+}
@@ -0,0 +1,39 @@
+package rpc
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// handshake presents a token to a worker which expects another one, and
+// returns the errors of both sides
+func handshake(presented string, expected string) (error, error) {
+	client, worker := net.Pipe()
+	defer client.Close()
+	defer worker.Close()
+
+	workerErr := make(chan error)
+	go func() {
+		workerErr <- checkToken(worker, expected)
+	}()
+	clientErr := sendToken(client, presented)
+	return clientErr, <-workerErr
+}
+
+func TestTokenHandshake(t *testing.T) {
+	assert := assert.New(t)
+
+	clientErr, workerErr := handshake("secret", "secret")
+	assert.Nil(clientErr)
+	assert.Nil(workerErr)
+
+	clientErr, workerErr = handshake("guess", "secret")
+	assert.Equal(ErrBadToken, clientErr)
+	assert.NotNil(workerErr)
+
+	clientErr, workerErr = handshake("", "secret")
+	assert.Equal(ErrBadToken, clientErr)
+	assert.NotNil(workerErr)
+}
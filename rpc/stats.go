@@ -0,0 +1,82 @@
+package rpc
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// minRateInterval is the shortest interval over which the rays per second
+// are measured (requests for the stats within it get the previous rate)
+const minRateInterval = time.Second
+
+// WorkerStats describes what a worker is doing
+type WorkerStats struct {
+	Scenes            []string // IDs of the loaded scenes, most recently used first
+	Samples           int64    // samples rendered since the worker started
+	Rays              int64    // rays traced since the worker started
+	RaysPerSecond     float64  // rays traced per second since the stats were last measured
+	Threads           int
+	ActiveRequests    int // requests which are being rendered
+	QueuedRequests    int // requests which wait for a free thread
+	MaxRequestsAtOnce int
+	Uptime            time.Duration
+	Memory            uint64 // bytes obtained from the OS
+	Leaving           bool
+}
+
+// rateMeter measures the rate at which a counter grows
+type rateMeter struct {
+	mutex sync.Mutex
+	time  time.Time // time of the last measurement
+	count int64     // value of the counter at the last measurement
+	rate  float64
+}
+
+// measure returns the rate at which the counter has grown since the last
+// measurement (or the previous rate, if the last measurement is too recent)
+func (m *rateMeter) measure(count int64) float64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(m.time)
+	if elapsed < minRateInterval {
+		return m.rate
+	}
+	if !m.time.IsZero() {
+		m.rate = float64(count-m.count) / elapsed.Seconds()
+	}
+	m.time, m.count = now, count
+	return m.rate
+}
+
+// Stats returns the worker's statistics
+func (rr *RemoteRaytracer) Stats() *WorkerStats {
+	samples, rays := rr.Raytracer.Rendered()
+
+	var memory runtime.MemStats
+	runtime.ReadMemStats(&memory)
+
+	stats := &WorkerStats{
+		Scenes:            rr.Raytracer.Scenes.IDs(),
+		Samples:           samples,
+		Rays:              rays,
+		RaysPerSecond:     rr.raysPerSecond.measure(rays),
+		Threads:           rr.Raytracer.ParallelSamples(),
+		MaxRequestsAtOnce: rr.Requests,
+		Uptime:            time.Since(rr.started),
+		Memory:            memory.Sys,
+		Leaving:           rr.Leaving(),
+	}
+
+	active := int(atomic.LoadInt32(&rr.active))
+	stats.ActiveRequests = rr.Raytracer.Busy()
+	if stats.ActiveRequests > active {
+		// units are also busy while samples are collected
+		stats.ActiveRequests = active
+	}
+	stats.QueuedRequests = active - stats.ActiveRequests
+	return stats
+}
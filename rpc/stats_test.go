@@ -0,0 +1,57 @@
+package rpc
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStatsCountSamples(t *testing.T) {
+	assert := assert.New(t)
+
+	data, err := ioutil.ReadFile("../sample_scenes/01_triangle.json.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := NewRemoteRaytracer(42, 2, 4, 1)
+	id, err := rr.LoadScene(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	settings := &SampleSettings{Scene: id, Width: 8, Height: 6, SamplesAtOnce: 3}
+	if _, err := rr.Sample(settings); err != nil {
+		t.Fatal(err)
+	}
+	if err := rr.StoreSample(settings); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := rr.Stats()
+	assert.Equal(int64(6), stats.Samples)
+	// at least one ray for each pixel of each sample
+	assert.True(stats.Rays >= 6*8*6)
+	assert.Equal([]string{id}, stats.Scenes)
+	assert.Equal(2, stats.Threads)
+	assert.Equal(4, stats.MaxRequestsAtOnce)
+	assert.Equal(0, stats.ActiveRequests)
+	assert.Equal(0, stats.QueuedRequests)
+	assert.False(stats.Leaving)
+}
+
+func TestLeavingWorkerRefusesSamples(t *testing.T) {
+	assert := assert.New(t)
+
+	rr := NewRemoteRaytracer(42, 2, 4, 1)
+	rr.Leave()
+	_, err := rr.Sample(&SampleSettings{Width: 8, Height: 6, SamplesAtOnce: 1})
+	assert.True(IsLeaving(err))
+	assert.True(rr.Stats().Leaving)
+
+	// errors received through RPC only keep the message
+	assert.True(IsLeaving(fmt.Errorf("gorpc.Client: [worker:1234]. Server error: [%s]", err)))
+	assert.False(IsLeaving(fmt.Errorf("timeout")))
+	assert.False(IsLeaving(nil))
+}
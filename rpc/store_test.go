@@ -0,0 +1,127 @@
+package rpc
+
+import (
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DexterLB/traytor/hdrimage"
+	"github.com/stretchr/testify/assert"
+)
+
+// loadTestScene returns a raytracer with the given number of units, and the
+// ID of a small scene loaded on it
+func loadTestScene(t *testing.T, units int) (*ConcurrentRaytracer, string) {
+	data, err := ioutil.ReadFile("../sample_scenes/01_triangle.json.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr := NewConcurrentRaytracer(units, nil, 42)
+	id, err := cr.Scenes.Load(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cr, id
+}
+
+func TestStoredSamplesAreKeptBySession(t *testing.T) {
+	assert := assert.New(t)
+	cr, id := loadTestScene(t, 2)
+
+	first := &SampleSettings{Scene: id, Width: 8, Height: 6, SamplesAtOnce: 2, Session: "a"}
+	second := *first
+	second.Session = "b"
+	second.SamplesAtOnce = 3
+	assert.Nil(cr.StoreSample(first))
+	assert.Nil(cr.StoreSample(&second))
+
+	assert.Equal(2, cr.Snapshot(first).Divisor)
+	assert.Equal(3, cr.GetImage(&second).Divisor)
+	assert.Equal(2, cr.GetImage(first).Divisor)
+	assert.False(cr.HasStoredSamples())
+}
+
+func TestAbandonedSamplesExpire(t *testing.T) {
+	assert := assert.New(t)
+	rr := NewRemoteRaytracer(42, 2, 4, 1)
+	data, err := ioutil.ReadFile("../sample_scenes/01_triangle.json.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := rr.LoadScene(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	abandoned := &SampleSettings{Scene: id, Width: 8, Height: 6, SamplesAtOnce: 1, Session: "a"}
+	assert.Nil(rr.StoreSample(abandoned))
+	assert.False(rr.Idle())
+	assert.Equal(0, rr.ExpireAbandoned())
+
+	time.Sleep(10 * time.Millisecond)
+	active := *abandoned
+	active.Session = "b"
+	assert.Nil(rr.StoreSample(&active))
+	assert.Equal(1, rr.Raytracer.ExpireStored(5*time.Millisecond))
+	assert.Equal(0, rr.GetImage(abandoned).Width)
+	assert.False(rr.Idle())
+
+	assert.Equal(1, rr.GetImage(&active).Divisor)
+	assert.True(rr.Idle())
+}
+
+func TestConcurrentCollectsFinish(t *testing.T) {
+	cr, id := loadTestScene(t, 4)
+	settings := &SampleSettings{Scene: id, Width: 8, Height: 6, SamplesAtOnce: 1}
+
+	finished := make(chan struct{})
+	go func() {
+		wg := &sync.WaitGroup{}
+		for i := 0; i < 20; i++ {
+			wg.Add(3)
+			go func() {
+				cr.StoreSample(settings)
+				wg.Done()
+			}()
+			go func() {
+				cr.Snapshot(settings)
+				wg.Done()
+			}()
+			go func() {
+				cr.GetImage(settings)
+				wg.Done()
+			}()
+		}
+		wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(30 * time.Second):
+		t.Fatal("collecting samples at once deadlocked")
+	}
+}
+
+func TestInvalidSettingsAreRefused(t *testing.T) {
+	assert := assert.New(t)
+	cr, id := loadTestScene(t, 1)
+	rr := &RemoteRaytracer{Raytracer: cr, Samples: 2, running: newRunningRequests()}
+
+	for _, settings := range []*SampleSettings{
+		{Scene: id, Width: 0, Height: 6, SamplesAtOnce: 1},
+		{Scene: id, Width: 1 << 20, Height: 1 << 20, SamplesAtOnce: 1},
+		{Scene: id, Width: 8, Height: 6, SamplesAtOnce: 0},
+		{Scene: id, Width: 8, Height: 6, SamplesAtOnce: -1},
+		{Scene: id, Width: 8, Height: 6, SamplesAtOnce: 2*MaxBatchGrowth + 1},
+		{Scene: id, Width: 8, Height: 6, SamplesAtOnce: 1, Mask: hdrimage.NewMask(6, 8)},
+		{Scene: id, Width: 8, Height: 6, SamplesAtOnce: 1, Mask: &hdrimage.Mask{Width: 8, Height: 6}},
+	} {
+		assert.NotNil(rr.StoreSample(settings))
+		_, err := rr.Sample(settings)
+		assert.NotNil(err)
+	}
+	assert.Nil(rr.StoreSample(&SampleSettings{Scene: id, Width: 8, Height: 6, SamplesAtOnce: 2}))
+	assert.Equal(0, cr.Busy())
+}
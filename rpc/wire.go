@@ -0,0 +1,59 @@
+package rpc
+
+import "github.com/DexterLB/traytor/hdrimage"
+
+// Capabilities describes the optional features supported by a worker
+type Capabilities struct {
+	Encodings    []string // pixel encodings of wire images
+	Compressions []string // compressions of wire images
+	Crop         bool     // whether wire images can be cropped to their samples
+	// ChunkedUpload means that scenes can be uploaded in chunks
+	ChunkedUpload bool
+	// Cancel means that requests can be cancelled by their job
+	Cancel bool
+}
+
+// workerCapabilities are the capabilities of this version of the worker
+var workerCapabilities = &Capabilities{
+	Encodings:     hdrimage.Encodings,
+	Compressions:  hdrimage.Compressions,
+	Crop:          true,
+	ChunkedUpload: true,
+	Cancel:        true,
+}
+
+// Negotiate returns the wire format closest to the preferred one which is
+// supported by the worker (the encoding and compression fall back to
+// float32 pixels without compression)
+func (c *Capabilities) Negotiate(preferred *hdrimage.WireFormat) *hdrimage.WireFormat {
+	format := &hdrimage.WireFormat{
+		Encoding:    hdrimage.EncodingFloat32,
+		Compression: hdrimage.CompressionNone,
+		Crop:        preferred.Crop && c.Crop,
+	}
+	if contains(c.Encodings, preferred.Encoding) {
+		format.Encoding = preferred.Encoding
+	}
+	if contains(c.Compressions, preferred.Compression) {
+		format.Compression = preferred.Compression
+	}
+	return format
+}
+
+func contains(values []string, value string) bool {
+	for i := range values {
+		if values[i] == value {
+			return true
+		}
+	}
+	return false
+}
+
+// wireFormat returns the wire format from the settings (float32 pixels if
+// they don't have one)
+func wireFormat(settings *SampleSettings) *hdrimage.WireFormat {
+	if settings.Wire == nil {
+		return &hdrimage.WireFormat{Encoding: hdrimage.EncodingFloat32}
+	}
+	return settings.Wire
+}
@@ -88,6 +88,21 @@ func (i *ImageTexture) UnmarshalJSON(data []byte) error {
 		if err != nil {
 			return err
 		}
+	case "exr", "open_exr": // as Blender calls it
+		i.Image, err = hdrimage.DecodeEXR(reader)
+		if err != nil {
+			return err
+		}
+	case "hdr", "radiance_hdr":
+		i.Image, err = hdrimage.DecodeRGBE(reader)
+		if err != nil {
+			return err
+		}
+	case "pfm":
+		i.Image, err = hdrimage.DecodePFM(reader)
+		if err != nil {
+			return err
+		}
 	default:
 		return fmt.Errorf(
 			"Unknown format for image texture: %s\n",
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 
@@ -40,15 +41,27 @@ func LoadFromBytes(data []byte) (*Scene, error) {
 
 // Load loads the scene from a reader which outputs gzipped json data
 func Load(reader io.Reader) (scene *Scene, err error) {
+	return LoadLimited(reader, 0)
+}
+
+// LoadLimited loads the scene like Load, but fails if the uncompressed data
+// is larger than maxSize bytes (0 for no limit)
+func LoadLimited(reader io.Reader, maxSize int64) (scene *Scene, err error) {
 	gzReader, err := gzip.NewReader(reader)
 	if err != nil {
 		return nil, err
 	}
 	defer func() {
-		err = gzReader.Close()
+		if closeErr := gzReader.Close(); err == nil {
+			err = closeErr
+		}
 	}()
 
-	decoder := json.NewDecoder(gzReader)
+	var data io.Reader = gzReader
+	if maxSize > 0 {
+		data = &limitedReader{reader: gzReader, left: maxSize, size: maxSize}
+	}
+	decoder := json.NewDecoder(data)
 
 	scene = &Scene{}
 	err = decoder.Decode(&scene)
@@ -58,6 +71,30 @@ func Load(reader io.Reader) (scene *Scene, err error) {
 	return scene, nil
 }
 
+// limitedReader reads from another reader, but fails if it has more than
+// left bytes
+type limitedReader struct {
+	reader io.Reader
+	left   int64
+	size   int64 // the limit, for the error message
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.left <= 0 {
+		// the data may end right at the limit
+		if n, err := l.reader.Read(make([]byte, 1)); n == 0 && err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("scene is larger than %d bytes when uncompressed", l.size)
+	}
+	if int64(len(p)) > l.left {
+		p = p[:l.left]
+	}
+	n, err := l.reader.Read(p)
+	l.left -= int64(n)
+	return n, err
+}
+
 // Init performs all necessary preprocessing on the scene
 func (s *Scene) Init() {
 	s.Mesh.Init()
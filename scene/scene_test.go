@@ -1,6 +1,8 @@
 package scene
 
 import (
+	"bytes"
+	"compress/gzip"
 	"io/ioutil"
 	"testing"
 )
@@ -29,3 +31,27 @@ func TestLoadFromBytes(t *testing.T) {
 		t.Errorf("scene's faces should be 1, not %d", len(scene.Mesh.Faces))
 	}
 }
+
+func TestLoadLimited(t *testing.T) {
+	data, err := ioutil.ReadFile("../sample_scenes/01_triangle.json.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gzReader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	uncompressed, err := ioutil.ReadAll(gzReader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(uncompressed))
+
+	if _, err := LoadLimited(bytes.NewReader(data), size); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadLimited(bytes.NewReader(data), size/2); err == nil {
+		t.Errorf("scene of %d bytes shouldn't be loaded with a limit of %d", size, size/2)
+	}
+}
@@ -0,0 +1,183 @@
+package sequence
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+)
+
+// blueNoiseSize is the side of the tiled blue noise mask
+const blueNoiseSize = 64
+
+var (
+	blueNoiseOnce sync.Once
+	blueNoiseMask []float64
+)
+
+// BlueNoise distributes the error of a Sobol sequence as blue noise in
+// screen space (Georgiev & Fajardo 2016): all pixels share the same
+// scrambled Sobol points, which are toroidally shifted by the values of a
+// tiled blue noise mask, offset differently for each dimension.
+type BlueNoise struct {
+	pixelSample
+	seed uint64
+	mask []float64
+}
+
+// NewBlueNoise returns a blue noise sequence with the given seed. The blue
+// noise mask is generated on first use.
+func NewBlueNoise(seed int64) *BlueNoise {
+	blueNoiseOnce.Do(func() {
+		blueNoiseMask = voidAndCluster(blueNoiseSize, 1.9)
+	})
+	return &BlueNoise{seed: uint64(seed), mask: blueNoiseMask}
+}
+
+// shift returns the mask value for the current pixel, with the mask
+// offset by a random amount chosen by h
+func (s *BlueNoise) shift(h uint64) float64 {
+	x := (s.x + int(h%blueNoiseSize)) % blueNoiseSize
+	y := (s.y + int((h>>32)%blueNoiseSize)) % blueNoiseSize
+	return s.mask[y*blueNoiseSize+x]
+}
+
+// Get1D returns the value for the next dimension
+func (s *BlueNoise) Get1D() float64 {
+	dimension := s.nextDimensions(1)
+	x, _ := scrambledSobol(uint32(s.index), uint32(hash(s.seed, dimension)))
+	return rotate(x, s.shift(hash(s.seed, dimension, 0)))
+}
+
+// Get2D returns the values for the next two dimensions
+func (s *BlueNoise) Get2D() (float64, float64) {
+	dimension := s.nextDimensions(2)
+	x, y := scrambledSobol(uint32(s.index), uint32(hash(s.seed, dimension)))
+	return rotate(x, s.shift(hash(s.seed, dimension, 0))),
+		rotate(y, s.shift(hash(s.seed, dimension, 1)))
+}
+
+// rotate adds shift to x modulo 1
+func rotate(x, shift float64) float64 {
+	x += shift
+	if x >= 1 {
+		x--
+	}
+	return x
+}
+
+// voidAndCluster generates a size×size blue noise mask with Ulichney's
+// void-and-cluster method. The mask contains every value (rank + 0.5) / size²
+// exactly once, and is the same on every call.
+func voidAndCluster(size int, sigma float64) []float64 {
+	n := size * size
+
+	// gaussian energy of a point, indexed by the toroidal offset to it
+	kernel := make([]float64, n)
+	for dy := 0; dy < size; dy++ {
+		for dx := 0; dx < size; dx++ {
+			x := math.Min(float64(dx), float64(size-dx))
+			y := math.Min(float64(dy), float64(size-dy))
+			kernel[dy*size+dx] = math.Exp(-(x*x + y*y) / (2 * sigma * sigma))
+		}
+	}
+
+	splat := func(energy []float64, point int, sign float64) {
+		px, py := point%size, point/size
+		for y := 0; y < size; y++ {
+			row := ((y - py + size) % size) * size
+			for x := 0; x < size; x++ {
+				energy[y*size+x] += sign * kernel[row+(x-px+size)%size]
+			}
+		}
+	}
+
+	// extreme returns the point with the highest (or lowest) energy among
+	// the points whose pattern value is set
+	extreme := func(energy []float64, pattern []bool, set bool, highest bool) int {
+		best := -1
+		for i := range energy {
+			if pattern[i] != set {
+				continue
+			}
+			if best == -1 || (highest && energy[i] > energy[best]) ||
+				(!highest && energy[i] < energy[best]) {
+				best = i
+			}
+		}
+		return best
+	}
+
+	// initial binary pattern: random points, relaxed until the tightest
+	// cluster is also the largest void
+	random := rand.New(rand.NewSource(42))
+	initial := make([]bool, n)
+	initialEnergy := make([]float64, n)
+	ones := 0
+	for ones < n/10 {
+		point := random.Intn(n)
+		if !initial[point] {
+			initial[point] = true
+			splat(initialEnergy, point, 1)
+			ones++
+		}
+	}
+	for {
+		cluster := extreme(initialEnergy, initial, true, true)
+		initial[cluster] = false
+		splat(initialEnergy, cluster, -1)
+
+		void := extreme(initialEnergy, initial, false, false)
+		initial[void] = true
+		splat(initialEnergy, void, 1)
+
+		if void == cluster {
+			break
+		}
+	}
+
+	ranks := make([]int, n)
+
+	// phase 1: remove the tightest clusters of the initial pattern
+	pattern := append([]bool(nil), initial...)
+	energy := append([]float64(nil), initialEnergy...)
+	for rank := ones - 1; rank >= 0; rank-- {
+		cluster := extreme(energy, pattern, true, true)
+		pattern[cluster] = false
+		splat(energy, cluster, -1)
+		ranks[cluster] = rank
+	}
+
+	// phase 2: fill the largest voids up to half of the points
+	pattern = append(pattern[:0], initial...)
+	energy = append(energy[:0], initialEnergy...)
+	rank := ones
+	for ; rank < n/2; rank++ {
+		void := extreme(energy, pattern, false, false)
+		pattern[void] = true
+		splat(energy, void, 1)
+		ranks[void] = rank
+	}
+
+	// phase 3: the remaining empty points are now the minority, so fill the
+	// tightest clusters of empty points
+	for i := range energy {
+		energy[i] = 0
+	}
+	for i := range pattern {
+		if !pattern[i] {
+			splat(energy, i, 1)
+		}
+	}
+	for ; rank < n; rank++ {
+		cluster := extreme(energy, pattern, false, true)
+		pattern[cluster] = true
+		splat(energy, cluster, -1)
+		ranks[cluster] = rank
+	}
+
+	mask := make([]float64, n)
+	for i := range ranks {
+		mask[i] = (float64(ranks[i]) + 0.5) / float64(n)
+	}
+	return mask
+}
@@ -0,0 +1,4 @@
+// Package sequence provides generators of per-pixel, per-dimension sample
+// values (random, stratified, low discrepancy and blue noise), which are used
+// for pixel jitter and for choosing bounce directions
+package sequence
@@ -0,0 +1,55 @@
+package sequence
+
+// haltonPrimes are the bases of the Halton sequence's dimensions
+var haltonPrimes = []int{
+	2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47, 53,
+	59, 61, 67, 71, 73, 79, 83, 89, 97, 101, 103, 107, 109, 113, 127, 131,
+}
+
+// Halton is the Halton low discrepancy sequence, decorrelated between pixels
+// with a random toroidal shift (Cranley-Patterson rotation) per pixel and
+// dimension. Dimensions beyond the available bases fall back to independent
+// random values.
+type Halton struct {
+	pixelSample
+	seed uint64
+}
+
+// NewHalton returns a Halton sequence with the given seed
+func NewHalton(seed int64) *Halton {
+	return &Halton{seed: uint64(seed)}
+}
+
+// Get1D returns the value for the next dimension
+func (s *Halton) Get1D() float64 {
+	dimension := s.nextDimensions(1)
+	shift := hashFloat(hash(s.seed, uint64(s.x), uint64(s.y), dimension))
+	if dimension >= uint64(len(haltonPrimes)) {
+		return hashFloat(hash(s.seed, uint64(s.x), uint64(s.y), uint64(s.index), dimension))
+	}
+
+	value := radicalInverse(haltonPrimes[dimension], s.index) + shift
+	if value >= 1 {
+		value--
+	}
+	return value
+}
+
+// Get2D returns the values for the next two dimensions
+func (s *Halton) Get2D() (float64, float64) {
+	return s.Get1D(), s.Get1D()
+}
+
+// radicalInverse mirrors the digits of index in the given base around the
+// decimal point
+func radicalInverse(base int, index int) float64 {
+	inverseBase := 1 / float64(base)
+	factor := inverseBase
+	result := 0.0
+	for index > 0 {
+		result += float64(index%base) * factor
+		index /= base
+		factor *= inverseBase
+	}
+	return result
+}
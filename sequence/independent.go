@@ -0,0 +1,25 @@
+package sequence
+
+// Independent is a plain Monte Carlo sequence: every value is independent
+// and uniformly distributed
+type Independent struct {
+	pixelSample
+	seed uint64
+}
+
+// NewIndependent returns an independent sequence with the given seed
+func NewIndependent(seed int64) *Independent {
+	return &Independent{seed: uint64(seed)}
+}
+
+// Get1D returns the value for the next dimension
+func (s *Independent) Get1D() float64 {
+	return hashFloat(hash(
+		s.seed, uint64(s.x), uint64(s.y), uint64(s.index), s.nextDimensions(1),
+	))
+}
+
+// Get2D returns the values for the next two dimensions
+func (s *Independent) Get2D() (float64, float64) {
+	return s.Get1D(), s.Get1D()
+}
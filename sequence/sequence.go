@@ -0,0 +1,88 @@
+package sequence
+
+import "fmt"
+
+// Sequence generates sample values in [0, 1) for a single sample of a single
+// pixel, one dimension at a time. Each sample of the path (pixel jitter,
+// bounce direction etc) consumes the next dimension(s).
+// Sequences are not safe for concurrent use.
+type Sequence interface {
+	// StartPixelSample makes the sequence start generating values for the
+	// index-th sample of the pixel at (x, y), beginning from the first dimension
+	StartPixelSample(x, y int, index int)
+	// Get1D returns the value for the next dimension
+	Get1D() float64
+	// Get2D returns the values for the next two dimensions
+	Get2D() (float64, float64)
+}
+
+// Names contains the names of all available sequences, as accepted by New
+var Names = []string{"random", "stratified", "halton", "sobol", "bluenoise"}
+
+// New returns the sequence with the given name, initialised with the given
+// seed. The same name and seed always produce the same values.
+func New(name string, seed int64) (Sequence, error) {
+	switch name {
+	case "", "random":
+		return NewIndependent(seed), nil
+	case "stratified":
+		return NewStratified(seed, DefaultStrata), nil
+	case "halton":
+		return NewHalton(seed), nil
+	case "sobol":
+		return NewSobol(seed), nil
+	case "bluenoise":
+		return NewBlueNoise(seed), nil
+	default:
+		return nil, fmt.Errorf("Unknown sample sequence: '%s'", name)
+	}
+}
+
+// pixelSample keeps track of the current pixel, sample and dimension
+type pixelSample struct {
+	x, y      int
+	index     int
+	dimension int
+}
+
+// StartPixelSample resets the dimension and sets the current pixel and sample
+func (p *pixelSample) StartPixelSample(x, y int, index int) {
+	p.x, p.y, p.index = x, y, index
+	p.dimension = 0
+}
+
+// nextDimensions returns the current dimension and skips n dimensions ahead
+func (p *pixelSample) nextDimensions(n int) uint64 {
+	dimension := p.dimension
+	p.dimension += n
+	return uint64(dimension)
+}
+
+// mix is the splitmix64 finaliser: a cheap bijection with good avalanche
+func mix(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+// hash combines the given values into a single pseudorandom number
+func hash(values ...uint64) uint64 {
+	h := uint64(0x9e3779b97f4a7c15)
+	for _, value := range values {
+		h = mix(h^value) + 0x9e3779b97f4a7c15
+	}
+	return h
+}
+
+// hashFloat returns a float in [0, 1) obtained from a 64-bit hash
+func hashFloat(h uint64) float64 {
+	return float64(h>>11) / (1 << 53)
+}
+
+// uint32Float returns a float in [0, 1) obtained from the bits of x
+func uint32Float(x uint32) float64 {
+	return float64(x) / (1 << 32)
+}
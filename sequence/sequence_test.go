@@ -0,0 +1,185 @@
+package sequence
+
+import (
+	"math"
+	"testing"
+
+	"github.com/DexterLB/traytor/maths"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRange(t *testing.T) {
+	for _, name := range Names {
+		sequence, err := New(name, 42)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for index := 0; index < 64; index++ {
+			sequence.StartPixelSample(3, 5, index)
+			for dimension := 0; dimension < 50; dimension++ {
+				x := sequence.Get1D()
+				y, z := sequence.Get2D()
+				for _, value := range []float64{x, y, z} {
+					if value < 0 || value >= 1 {
+						t.Errorf("%s: value %g should be in [0..1)", name, value)
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestUnknown(t *testing.T) {
+	_, err := New("foo", 42)
+	if err == nil {
+		t.Error("Unknown sequence names should be an error")
+	}
+}
+
+func TestSeed(t *testing.T) {
+	for _, name := range Names {
+		first, _ := New(name, 42)
+		second, _ := New(name, 42)
+		third, _ := New(name, 56)
+
+		first.StartPixelSample(1, 2, 3)
+		second.StartPixelSample(1, 2, 3)
+		third.StartPixelSample(1, 2, 3)
+		first.Get1D()
+		second.Get1D()
+		third.Get1D()
+
+		x1, y1 := first.Get2D()
+		x2, y2 := second.Get2D()
+		x3, y3 := third.Get2D()
+		if x1 != x2 || y1 != y2 {
+			t.Errorf("%s: values obtained with the same seed must be the same", name)
+		}
+		if x1 == x3 && y1 == y3 {
+			t.Errorf("%s: values obtained with different seeds are very unlikely to be the same", name)
+		}
+
+		first.StartPixelSample(1, 2, 3)
+		first.Get1D()
+		x4, y4 := first.Get2D()
+		if x1 != x4 || y1 != y4 {
+			t.Errorf("%s: restarting the same sample must give the same values", name)
+		}
+	}
+}
+
+// cells counts the points falling in each cell of a columns×rows grid
+func cells(points [][2]float64, columns, rows int) []int {
+	counts := make([]int, columns*rows)
+	for _, p := range points {
+		counts[int(p[1]*float64(rows))*columns+int(p[0]*float64(columns))]++
+	}
+	return counts
+}
+
+func points2D(sequence Sequence, first, n int) [][2]float64 {
+	points := make([][2]float64, n)
+	for i := range points {
+		sequence.StartPixelSample(7, 11, first+i)
+		sequence.Get1D()
+		points[i][0], points[i][1] = sequence.Get2D()
+	}
+	return points
+}
+
+func TestStratified(t *testing.T) {
+	sequence := NewStratified(42, 4)
+
+	for block := 0; block < 3; block++ {
+		points := points2D(sequence, block*16, 16)
+		for _, grid := range [][2]int{{4, 4}, {16, 1}, {1, 16}} {
+			for _, count := range cells(points, grid[0], grid[1]) {
+				if count != 1 {
+					t.Fatalf("every %dx%d cell should have exactly one point: %v", grid[0], grid[1], points)
+				}
+			}
+		}
+
+		strata := make([]int, 16)
+		for i := 0; i < 16; i++ {
+			sequence.StartPixelSample(7, 11, block*16+i)
+			strata[int(sequence.Get1D()*16)]++
+		}
+		for _, count := range strata {
+			if count != 1 {
+				t.Fatalf("every 1D stratum should have exactly one value: %v", strata)
+			}
+		}
+	}
+}
+
+func TestSobolNet(t *testing.T) {
+	sequence := NewSobol(42)
+
+	points := points2D(sequence, 64, 64)
+	for _, grid := range [][2]int{{64, 1}, {32, 2}, {16, 4}, {8, 8}, {4, 16}, {2, 32}, {1, 64}} {
+		for _, count := range cells(points, grid[0], grid[1]) {
+			if count != 1 {
+				t.Fatalf("every %dx%d elementary interval should have exactly one point", grid[0], grid[1])
+			}
+		}
+	}
+}
+
+func TestHalton(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.InDelta(0.5, radicalInverse(2, 1), maths.Epsilon)
+	assert.InDelta(0.25, radicalInverse(2, 2), maths.Epsilon)
+	assert.InDelta(0.75, radicalInverse(2, 3), maths.Epsilon)
+	assert.InDelta(1.0/3+1.0/9, radicalInverse(3, 4), maths.Epsilon)
+}
+
+func TestBlueNoiseMask(t *testing.T) {
+	mask := voidAndCluster(16, 1.9)
+
+	seen := make(map[float64]bool)
+	for _, value := range mask {
+		if seen[value] {
+			t.Fatalf("blue noise mask values must be unique")
+		}
+		seen[value] = true
+	}
+	if len(seen) != 16*16 {
+		t.Errorf("blue noise mask should have 256 values, not %d", len(seen))
+	}
+}
+
+func TestPermute(t *testing.T) {
+	for _, l := range []uint32{1, 5, 16, 100} {
+		seen := make([]bool, l)
+		for i := uint32(0); i < l; i++ {
+			seen[permute(i, l, 0xdeadbeef)] = true
+		}
+		for i := range seen {
+			if !seen[i] {
+				t.Errorf("permute(_, %d) should be a permutation", l)
+			}
+		}
+	}
+}
+
+func TestVec3HemiCos(t *testing.T) {
+	assert := assert.New(t)
+	normal := maths.NewVec3(0, 0, 1)
+
+	sequence := NewSobol(42)
+	for i := 0; i < 32; i++ {
+		sequence.StartPixelSample(0, 0, i)
+		u, v := sequence.Get2D()
+		vec := Vec3HemiCos(normal, u, v)
+		assert.InDelta(1, vec.Length(), 1e-6, "Cosine-weighed hemi vector's length should be 1")
+		if maths.DotProduct(vec, normal) < 0 {
+			t.Error("Cosine-weighed hemi vector is in the wrong hemisphere")
+		}
+	}
+
+	vec := Vec3HemiCos(normal, 0, 0.3)
+	assert.InDelta(1, vec.Z, maths.Epsilon, "u = 0 should map to the normal")
+	assert.InDelta(0, math.Abs(vec.X)+math.Abs(vec.Y), maths.Epsilon)
+}
@@ -0,0 +1,92 @@
+package sequence
+
+// sobolDirections are the direction numbers of the first two Sobol dimensions
+var sobolDirections [2][32]uint32
+
+func init() {
+	for bit := uint(0); bit < 32; bit++ {
+		sobolDirections[0][bit] = 1 << (31 - bit)
+	}
+	// primitive polynomial x + 1
+	sobolDirections[1][0] = 1 << 31
+	for bit := 1; bit < 32; bit++ {
+		previous := sobolDirections[1][bit-1]
+		sobolDirections[1][bit] = previous ^ (previous >> 1)
+	}
+}
+
+// Sobol is the 2D Sobol sequence with Owen scrambling, padded to any number
+// of dimensions by shuffling the sample index for each pair of dimensions
+// (Burley 2020). Every power-of-two block of samples of a pixel is a
+// (0, m, 2)-net in each pair of dimensions.
+type Sobol struct {
+	pixelSample
+	seed uint64
+}
+
+// NewSobol returns an Owen-scrambled Sobol sequence with the given seed
+func NewSobol(seed int64) *Sobol {
+	return &Sobol{seed: uint64(seed)}
+}
+
+// Get1D returns the value for the next dimension
+func (s *Sobol) Get1D() float64 {
+	seed := uint32(hash(s.seed, uint64(s.x), uint64(s.y), s.nextDimensions(1)))
+	x, _ := scrambledSobol(uint32(s.index), seed)
+	return x
+}
+
+// Get2D returns the values for the next two dimensions
+func (s *Sobol) Get2D() (float64, float64) {
+	seed := uint32(hash(s.seed, uint64(s.x), uint64(s.y), s.nextDimensions(2)))
+	return scrambledSobol(uint32(s.index), seed)
+}
+
+// scrambledSobol returns the index-th point of the Owen-scrambled, shuffled
+// 2D Sobol sequence chosen by seed
+func scrambledSobol(index uint32, seed uint32) (float64, float64) {
+	index = nestedUniformScramble(index, seed)
+	x := nestedUniformScramble(sobol(index, 0), uint32(hash(uint64(seed), 0)))
+	y := nestedUniformScramble(sobol(index, 1), uint32(hash(uint64(seed), 1)))
+	return uint32Float(x), uint32Float(y)
+}
+
+// sobol returns the index-th value of the given Sobol dimension
+func sobol(index uint32, dimension int) uint32 {
+	var result uint32
+	for bit := 0; index != 0; bit++ {
+		if index&1 != 0 {
+			result ^= sobolDirections[dimension][bit]
+		}
+		index >>= 1
+	}
+	return result
+}
+
+// nestedUniformScramble performs Owen scrambling on the bits of x
+func nestedUniformScramble(x uint32, seed uint32) uint32 {
+	x = reverseBits(x)
+	x = laineKarrasPermutation(x, seed)
+	return reverseBits(x)
+}
+
+// laineKarrasPermutation is a hash in which each bit of the output only
+// depends on the same and less significant bits of the input
+func laineKarrasPermutation(x uint32, seed uint32) uint32 {
+	x += seed
+	x ^= x * 0x6c50b47c
+	x ^= x * 0xb82f1e52
+	x ^= x * 0xc7afe638
+	x ^= x * 0x8d22f6e6
+	return x
+}
+
+// reverseBits reverses the order of the bits of x
+func reverseBits(x uint32) uint32 {
+	x = (x << 16) | (x >> 16)
+	x = ((x & 0x00ff00ff) << 8) | ((x & 0xff00ff00) >> 8)
+	x = ((x & 0x0f0f0f0f) << 4) | ((x & 0xf0f0f0f0) >> 4)
+	x = ((x & 0x33333333) << 2) | ((x & 0xcccccccc) >> 2)
+	x = ((x & 0x55555555) << 1) | ((x & 0xaaaaaaaa) >> 1)
+	return x
+}
@@ -0,0 +1,109 @@
+package sequence
+
+// DefaultStrata is the number of strata per axis used by New("stratified")
+const DefaultStrata = 4
+
+// Stratified is a correlated multi-jittered sequence (Kensler 2013).
+// Consecutive samples of a pixel are grouped into blocks of strata*strata
+// samples. Within each block, 2D values fall in distinct cells of a
+// strata×strata grid (and in distinct rows and columns of the finer
+// strata²×strata² grid), and 1D values fall in distinct strata.
+type Stratified struct {
+	pixelSample
+	seed   uint64
+	strata int
+}
+
+// NewStratified returns a stratified sequence with the given seed
+// and number of strata per axis
+func NewStratified(seed int64, strata int) *Stratified {
+	if strata < 1 {
+		strata = 1
+	}
+	return &Stratified{seed: uint64(seed), strata: strata}
+}
+
+// pattern returns the permutation seed for the current block and the given
+// dimension, and the index of the sample within the block
+func (s *Stratified) pattern(dimension uint64) (uint32, uint32) {
+	blockSize := s.strata * s.strata
+	block, index := s.index/blockSize, s.index%blockSize
+	p := uint32(hash(s.seed, uint64(s.x), uint64(s.y), uint64(block), dimension))
+	return p, uint32(index)
+}
+
+// Get1D returns the value for the next dimension
+func (s *Stratified) Get1D() float64 {
+	p, index := s.pattern(s.nextDimensions(1))
+	n := uint32(s.strata * s.strata)
+
+	stratum := permute(index, n, p*0x68bc21eb)
+	jitter := randFloat(index, p*0x967a889b)
+	return (float64(stratum) + jitter) / float64(n)
+}
+
+// Get2D returns the values for the next two dimensions
+func (s *Stratified) Get2D() (float64, float64) {
+	p, index := s.pattern(s.nextDimensions(2))
+	m := uint32(s.strata)
+
+	index = permute(index, m*m, p*0x51633e2d)
+	sx := permute(index%m, m, p*0xa511e9b3)
+	sy := permute(index/m, m, p*0x63d83595)
+	jx := randFloat(index, p*0xa399d265)
+	jy := randFloat(index, p*0x711ad6a5)
+
+	return (float64(index%m) + (float64(sy)+jx)/float64(m)) / float64(m),
+		(float64(index/m) + (float64(sx)+jy)/float64(m)) / float64(m)
+}
+
+// permute returns the i-th element of a pseudorandom permutation of [0, l)
+// chosen by p, without storing the permutation (Kensler 2013)
+func permute(i, l, p uint32) uint32 {
+	w := l - 1
+	w |= w >> 1
+	w |= w >> 2
+	w |= w >> 4
+	w |= w >> 8
+	w |= w >> 16
+	for {
+		i ^= p
+		i *= 0xe170893d
+		i ^= p >> 16
+		i ^= (i & w) >> 4
+		i ^= p >> 8
+		i *= 0x0929eb3f
+		i ^= p >> 23
+		i ^= (i & w) >> 1
+		i *= 1 | p>>27
+		i *= 0x6935fa69
+		i ^= (i & w) >> 11
+		i *= 0x74dcb303
+		i ^= (i & w) >> 2
+		i *= 0x9e501cc3
+		i ^= (i & w) >> 2
+		i *= 0xc860a3df
+		i &= w
+		i ^= i >> 5
+		if i < l {
+			break
+		}
+	}
+	return (i + p) % l
+}
+
+// randFloat returns a pseudorandom float in [0, 1) determined by i and p
+// (Kensler 2013)
+func randFloat(i, p uint32) float64 {
+	i ^= p
+	i ^= i >> 17
+	i ^= i >> 10
+	i *= 0xb36534e5
+	i ^= i >> 12
+	i ^= i >> 21
+	i *= 0x93fc4795
+	i ^= 0xdf6e307f
+	i ^= i >> 17
+	i *= 1 | p>>18
+	return uint32Float(i)
+}
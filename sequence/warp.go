@@ -0,0 +1,29 @@
+package sequence
+
+import (
+	"math"
+
+	"github.com/DexterLB/traytor/maths"
+)
+
+// Vec3HemiCos maps the sample (u, v) from the unit square to a unit vector
+// on the cosine-weighed hemisphere defined by normal
+func Vec3HemiCos(normal *maths.Vec3, u, v float64) *maths.Vec3 {
+	ox := maths.CrossProduct(maths.NewVec3(42, 56, -15), normal)
+	if ox.Length() < maths.Epsilon {
+		ox = maths.CrossProduct(maths.NewVec3(1, 0, 0), normal)
+	}
+
+	oy := maths.CrossProduct(ox, normal)
+	ox.Normalise()
+	oy.Normalise()
+
+	radius := math.Sqrt(u)
+	theta := 2 * math.Pi * v
+
+	vec := normal.Scaled(math.Sqrt(math.Max(0, 1-u)))
+	vec.Add(ox.Scaled(radius * math.Cos(theta)))
+	vec.Add(oy.Scaled(radius * math.Sin(theta)))
+
+	return vec
+}
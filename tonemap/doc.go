@@ -0,0 +1,3 @@
+// Package tonemap provides exposure, white balance and tone mapping
+// operators, which prepare linear HDR colours for low dynamic range images
+package tonemap
@@ -0,0 +1,215 @@
+package tonemap
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/DexterLB/traytor/hdrcolour"
+	"github.com/DexterLB/traytor/hdrimage"
+)
+
+// Operator maps a linear colour of any intensity to a linear colour whose
+// components are (mostly) in [0, 1], anything beyond that is clamped
+type Operator func(colour *hdrcolour.Colour) *hdrcolour.Colour
+
+// Names contains the names of all available operators, as accepted by New
+var Names = []string{"clamp", "reinhard", "filmic", "aces", "agx"}
+
+// New returns the named operator. The clamp operator is nil, since the
+// colours are clamped anyway.
+func New(name string) (Operator, error) {
+	switch name {
+	case "", "clamp":
+		return nil, nil
+	case "reinhard":
+		return reinhard, nil
+	case "filmic":
+		return filmic, nil
+	case "aces":
+		return aces, nil
+	case "agx":
+		return agx, nil
+	default:
+		return nil, fmt.Errorf("Unknown tone mapping operator: '%s'", name)
+	}
+}
+
+// ToneMapper applies exposure, white balance and a tone mapping operator
+// to colours. Its zero value leaves them as they are.
+type ToneMapper struct {
+	Exposure     float64           // in stops
+	WhiteBalance *hdrcolour.Colour // multipliers of the components (nil for none)
+	Operator     Operator          // nil for clamping
+}
+
+// Map returns the tone mapped colour
+func (t *ToneMapper) Map(colour *hdrcolour.Colour) *hdrcolour.Colour {
+	mapped := colour.Scaled(float32(math.Exp2(t.Exposure)))
+	if t.WhiteBalance != nil {
+		mapped.MultiplyBy(t.WhiteBalance)
+	}
+	if t.Operator != nil {
+		mapped = t.Operator(mapped)
+	}
+	return mapped
+}
+
+// Image returns the image as an sRGB image, with its colours tone mapped
+func (t *ToneMapper) Image(im *hdrimage.Image) image.Image {
+	return &mappedImage{Image: im, mapper: t}
+}
+
+// mappedImage is an image whose colours are tone mapped
+type mappedImage struct {
+	*hdrimage.Image
+	mapper *ToneMapper
+}
+
+// At returns the sRGB colour of the pixel at [x][y]
+func (m *mappedImage) At(x, y int) color.Color {
+	return m.mapper.Map(m.AtHDR(x, y)).To32Bit()
+}
+
+// WhiteBalance returns the multipliers which make light of the given colour
+// look white. The colour is either a temperature in kelvins (e.g. 3200K) or
+// r,g,b components. The multipliers keep the luminance, and the white
+// balance of a 6504K temperature (close to the sRGB white point) is neutral.
+func WhiteBalance(value string) (*hdrcolour.Colour, error) {
+	var white [3]float64
+	if components := strings.Split(value, ","); len(components) == 3 {
+		for i := range white {
+			component, err := strconv.ParseFloat(strings.TrimSpace(components[i]), 64)
+			if err != nil || component <= 0 {
+				return nil, fmt.Errorf("Invalid white balance: '%s'", value)
+			}
+			white[i] = component
+		}
+	} else {
+		temperature, err := strconv.ParseFloat(strings.TrimRight(value, "Kk"), 64)
+		if err != nil || temperature < 1667 || temperature > 25000 {
+			return nil, fmt.Errorf("Invalid white balance (temperatures are from 1667K to 25000K): '%s'", value)
+		}
+		light, reference := blackbody(temperature), blackbody(6504)
+		for i := range white {
+			white[i] = light[i] / reference[i]
+		}
+	}
+
+	scale := luminance(white[0], white[1], white[2])
+	return hdrcolour.New(
+		float32(scale/white[0]),
+		float32(scale/white[1]),
+		float32(scale/white[2]),
+	), nil
+}
+
+// blackbody returns the linear sRGB colour of black body radiation with the
+// given temperature (from 1667K to 25000K), using the approximation of the
+// Planckian locus by Kim et al.
+func blackbody(temperature float64) [3]float64 {
+	t := temperature
+	var x float64
+	if t <= 4000 {
+		x = -0.2661239e9/(t*t*t) - 0.2343589e6/(t*t) + 0.8776956e3/t + 0.179910
+	} else {
+		x = -3.0258469e9/(t*t*t) + 2.1070379e6/(t*t) + 0.2226347e3/t + 0.240390
+	}
+	var y float64
+	switch {
+	case t <= 2222:
+		y = -1.1063814*x*x*x - 1.34811020*x*x + 2.18555832*x - 0.20219683
+	case t <= 4000:
+		y = -0.9549476*x*x*x - 1.37418593*x*x + 2.09137015*x - 0.16748867
+	default:
+		y = 3.0817580*x*x*x - 5.87338670*x*x + 3.75112997*x - 0.37001483
+	}
+
+	// CIE XYZ (with Y = 1) to linear sRGB
+	X, Y, Z := x/y, 1.0, (1-x-y)/y
+	return [3]float64{
+		3.2404542*X - 1.5371385*Y - 0.4985314*Z,
+		-0.9692660*X + 1.8760108*Y + 0.0415560*Z,
+		0.0556434*X - 0.2040259*Y + 1.0572252*Z,
+	}
+}
+
+// luminance returns the luminance of a linear sRGB colour
+func luminance(r, g, b float64) float64 {
+	return 0.2126*r + 0.7152*g + 0.0722*b
+}
+
+// reinhard compresses the luminance of the colour with l / (1 + l),
+// keeping its hue
+func reinhard(colour *hdrcolour.Colour) *hdrcolour.Colour {
+	l := luminance(float64(colour.R), float64(colour.G), float64(colour.B))
+	if l <= 0 {
+		return hdrcolour.New(0, 0, 0)
+	}
+	return colour.Scaled(float32(1 / (1 + l)))
+}
+
+// filmic applies John Hable's filmic curve (from Uncharted 2) to each
+// component
+func filmic(colour *hdrcolour.Colour) *hdrcolour.Colour {
+	curve := func(x float64) float64 {
+		const a, b, c, d, e, f = 0.15, 0.50, 0.10, 0.20, 0.02, 0.30
+		return (x*(a*x+c*b)+d*e)/(x*(a*x+b)+d*f) - e/f
+	}
+	const exposureBias, whitePoint = 2.0, 11.2
+	white := curve(whitePoint)
+	return perComponent(colour, func(x float64) float64 {
+		return curve(exposureBias*math.Max(x, 0)) / white
+	})
+}
+
+// aces applies Krzysztof Narkowicz's fit of the ACES filmic curve to each
+// component
+func aces(colour *hdrcolour.Colour) *hdrcolour.Colour {
+	return perComponent(colour, func(x float64) float64 {
+		x = 0.6 * math.Max(x, 0)
+		return (x * (2.51*x + 0.03)) / (x*(2.43*x+0.59) + 0.14)
+	})
+}
+
+// agx applies an approximation of Troy Sobotka's AgX: the colour is
+// desaturated a little (so that bright saturated colours go to white), its
+// logarithm is passed through a sigmoid, and the saturation is restored
+func agx(colour *hdrcolour.Colour) *hdrcolour.Colour {
+	const minEV, maxEV = -12.47393, 4.026069
+	r, g, b := math.Max(float64(colour.R), 0), math.Max(float64(colour.G), 0), math.Max(float64(colour.B), 0)
+	inset := [3]float64{
+		0.842479062253094*r + 0.0784335999999992*g + 0.0792237451477643*b,
+		0.0423282422610123*r + 0.878468636469772*g + 0.0791661274605434*b,
+		0.0423756549057051*r + 0.0784336*g + 0.879142973793104*b,
+	}
+	for i, x := range inset {
+		x = (math.Max(minEV, math.Min(maxEV, math.Log2(x))) - minEV) / (maxEV - minEV)
+		x2 := x * x
+		x4 := x2 * x2
+		inset[i] = 15.5*x4*x2 - 40.14*x4*x + 31.96*x4 - 6.868*x2*x + 0.4298*x2 + 0.1191*x - 0.00232
+	}
+	r, g, b = inset[0], inset[1], inset[2]
+	outset := [3]float64{
+		1.19687900512017*r - 0.0980208811401368*g - 0.0990297440797205*b,
+		-0.0528968517574562*r + 1.15190312990417*g - 0.0989611768448433*b,
+		-0.0529716355144438*r - 0.0980434501171241*g + 1.15107367264116*b,
+	}
+	// the sigmoid gives display encoded values, so they're made linear again
+	for i, x := range outset {
+		outset[i] = math.Pow(math.Max(0, math.Min(1, x)), 2.2)
+	}
+	return hdrcolour.New(float32(outset[0]), float32(outset[1]), float32(outset[2]))
+}
+
+// perComponent returns the colour with the curve applied to each component
+// (and clamped to 1, since the curves go a little above it)
+func perComponent(colour *hdrcolour.Colour, curve func(float64) float64) *hdrcolour.Colour {
+	apply := func(x float32) float32 {
+		return float32(math.Min(1, curve(float64(x))))
+	}
+	return hdrcolour.New(apply(colour.R), apply(colour.G), apply(colour.B))
+}
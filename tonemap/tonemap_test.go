@@ -0,0 +1,89 @@
+package tonemap
+
+import (
+	"testing"
+
+	"github.com/DexterLB/traytor/hdrcolour"
+	"github.com/DexterLB/traytor/hdrimage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	assert := assert.New(t)
+
+	operator, err := New("clamp")
+	assert.Nil(err)
+	assert.Nil(operator, "The clamp operator should be nil")
+
+	for _, name := range Names[1:] {
+		operator, err = New(name)
+		assert.Nil(err)
+		assert.NotNil(operator, "%s operator shouldn't be nil", name)
+	}
+
+	_, err = New("foo")
+	assert.NotNil(err, "Unknown operator names should be an error")
+}
+
+func TestOperators(t *testing.T) {
+	assert := assert.New(t)
+
+	for _, name := range Names[1:] {
+		operator, _ := New(name)
+		assert.InDelta(0, operator(hdrcolour.New(0, 0, 0)).G, 1e-3, name)
+
+		previous := float32(-1)
+		for _, value := range []float32{0.01, 0.1, 0.5, 1, 2, 10, 100, 1e4} {
+			mapped := operator(hdrcolour.New(value, value, value))
+			assert.True(mapped.G >= previous, "%s shouldn't be decreasing at %g", name, value)
+			assert.True(mapped.G <= 1.001, "%s should map %g below 1", name, value)
+			assert.InDelta(mapped.R, mapped.G, 1e-3, "%s should keep greys grey", name)
+			assert.InDelta(mapped.B, mapped.G, 1e-3, "%s should keep greys grey", name)
+			previous = mapped.G
+		}
+	}
+}
+
+func TestToneMapper(t *testing.T) {
+	assert := assert.New(t)
+	colour := hdrcolour.New(0.25, 0.5, 2)
+
+	assert.Equal(colour, (&ToneMapper{}).Map(colour))
+	assert.Equal(hdrcolour.New(1, 2, 8), (&ToneMapper{Exposure: 2}).Map(colour))
+	assert.Equal(hdrcolour.New(0.5, 0.5, 1), (&ToneMapper{
+		WhiteBalance: hdrcolour.New(2, 1, 0.5),
+	}).Map(colour))
+	assert.Equal(hdrcolour.New(0.25, 0.5, 2), colour, "Map shouldn't change the colour")
+
+	im := hdrimage.New(2, 1)
+	im.Pixels[1][0].SetColour(0.25, 0.5, 2)
+	mapped := (&ToneMapper{Exposure: -1}).Image(im)
+	assert.Equal(im.Bounds(), mapped.Bounds())
+	assert.Equal(hdrcolour.New(0.125, 0.25, 1).To32Bit(), mapped.At(1, 0))
+}
+
+func TestWhiteBalance(t *testing.T) {
+	assert := assert.New(t)
+
+	neutral, err := WhiteBalance("6504K")
+	assert.Nil(err)
+	assert.InDelta(1, neutral.R, 1e-6)
+	assert.InDelta(1, neutral.G, 1e-6)
+	assert.InDelta(1, neutral.B, 1e-6)
+
+	// warm light needs less red and more blue
+	warm, err := WhiteBalance("3200")
+	assert.Nil(err)
+	assert.True(warm.R < 1 && warm.B > 1)
+
+	balance, err := WhiteBalance("1, 0.5, 0.25")
+	assert.Nil(err)
+	white := hdrcolour.MultiplyColours(hdrcolour.New(1, 0.5, 0.25), balance)
+	assert.InDelta(white.R, white.G, 1e-6)
+	assert.InDelta(white.R, white.B, 1e-6)
+
+	for _, wrong := range []string{"", "warm", "100K", "1,0,1", "1,2"} {
+		_, err = WhiteBalance(wrong)
+		assert.NotNil(err, "'%s' should be an invalid white balance", wrong)
+	}
+}